@@ -0,0 +1,96 @@
+package backend
+
+import (
+	"database/sql"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// currentAddressWindow: 機器の最終検出からこの期間内に観測されたアドレスを「現在のアドレス」とする
+const currentAddressWindow = 24 * time.Hour
+
+// DeviceAddress type: device_address テーブルの1行（機器の1つのIPアドレスと検出日時）
+type DeviceAddress struct {
+	IPAddress string `json:"ip_address"`
+	Family    string `json:"family"` // ipv4 | ipv6
+	Scope     string `json:"scope"`  // global | private | link-local | loopback
+	FirstSeen string `json:"first_seen"`
+	LastSeen  string `json:"last_seen"`
+	SeenCount int    `json:"seen_count"`
+}
+
+// addressFamily function: IPアドレスの種類（ipv4 / ipv6）と範囲を判定
+func addressFamily(ip string) (family, scope string) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return "", ""
+	}
+	family = "ipv6"
+	if addr.Unmap().Is4() {
+		family = "ipv4"
+	}
+	switch {
+	case addr.IsLoopback():
+		scope = "loopback"
+	case addr.IsLinkLocalUnicast():
+		scope = "link-local"
+	case addr.IsPrivate():
+		scope = "private"
+	default:
+		scope = "global"
+	}
+	return family, scope
+}
+
+// recordAddresses function: 観測されたIPアドレスを device_address に記録（既存のアドレスは検出日時と回数を更新）
+// spool から遅れて届いた古い観測でも first_seen / last_seen が正しくなるよう MIN / MAX で更新する
+func recordAddresses(tx *sql.Tx, macAddress string, ips []string, at string) error {
+	for _, ip := range ips {
+		family, _ := addressFamily(ip)
+		_, err := tx.Exec(`INSERT INTO device_address (mac_address, ip_address, family, first_seen, last_seen, seen_count)
+			VALUES (?, ?, ?, ?, ?, 1)
+			ON CONFLICT (mac_address, ip_address) DO UPDATE SET
+				first_seen = MIN(first_seen, excluded.first_seen),
+				last_seen = MAX(last_seen, excluded.last_seen),
+				seen_count = seen_count + 1`,
+			macAddress, ip, family, at, at)
+		if err != nil {
+			return fmt.Errorf("アドレス記録エラー (MAC: %s, IP: %s): %v", macAddress, ip, err)
+		}
+	}
+	return nil
+}
+
+// queryAddresses function: 条件に一致するアドレスを機器ごとに取得（IPv4 を先に、最近検出された順）
+func queryAddresses(where string, args ...interface{}) (map[string][]DeviceAddress, error) {
+	query := `SELECT a.mac_address, a.ip_address, a.first_seen, a.last_seen, a.seen_count
+		FROM device_address a JOIN device d ON d.mac_address = a.mac_address`
+	if where != "" {
+		query += " WHERE " + where
+	}
+	query += " ORDER BY a.mac_address, a.family, a.last_seen DESC, a.ip_address"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("アドレス取得エラー: %v", err)
+	}
+	defer rows.Close()
+
+	byMAC := map[string][]DeviceAddress{}
+	for rows.Next() {
+		var mac string
+		var a DeviceAddress
+		if err := rows.Scan(&mac, &a.IPAddress, &a.FirstSeen, &a.LastSeen, &a.SeenCount); err != nil {
+			return nil, fmt.Errorf("アドレス読み込みエラー: %v", err)
+		}
+		a.Family, a.Scope = addressFamily(a.IPAddress)
+		byMAC[mac] = append(byMAC[mac], a)
+	}
+	return byMAC, rows.Err()
+}
+
+// CurrentDeviceAddresses function: 機器ごとの現在のアドレス（最終検出から currentAddressWindow 以内に観測されたもの）
+func CurrentDeviceAddresses() (map[string][]DeviceAddress, error) {
+	return queryAddresses("a.last_seen >= datetime(d.last_seen, ?)", fmt.Sprintf("-%d seconds", int(currentAddressWindow.Seconds())))
+}
@@ -0,0 +1,76 @@
+package backend
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// adminToken type: 管理操作用のトークンと、そのトークンで操作するオペレーター名
+type adminToken struct {
+	Operator string
+	Token    string
+}
+
+// adminTokens function: 環境変数 ADMIN_TOKENS（"オペレーター名:トークン" のカンマ区切り）から管理操作用のトークンを取得
+// 形式が不正なものと、センサーと共有する NET_TOKEN と同じトークンは使わない（理由を warnings に返す）
+func adminTokens() (tokens []adminToken, warnings []string) {
+	netToken := os.Getenv("NET_TOKEN")
+	for _, entry := range strings.Split(os.Getenv("ADMIN_TOKENS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		operator, token, ok := strings.Cut(entry, ":")
+		operator, token = strings.TrimSpace(operator), strings.TrimSpace(token)
+		switch {
+		case !ok || operator == "" || token == "":
+			warnings = append(warnings, "ADMIN_TOKENS の値が不正です（オペレーター名:トークン の形式で指定してください）")
+		case token == netToken:
+			warnings = append(warnings, fmt.Sprintf("ADMIN_TOKENS のオペレーター %s のトークンが NET_TOKEN と同じため無視します", operator))
+		default:
+			tokens = append(tokens, adminToken{Operator: operator, Token: token})
+		}
+	}
+	return tokens, warnings
+}
+
+// checkAdminTokens function: 起動時に管理トークンの設定を確認して警告を出す
+func checkAdminTokens() {
+	tokens, warnings := adminTokens()
+	for _, warning := range warnings {
+		log.Printf("警告: %s", warning)
+	}
+	if len(tokens) == 0 {
+		log.Printf("警告: ADMIN_TOKENS が設定されていないため、手動判定の設定・解除、インシデントの確認・解決、注釈・登録済み機器の更新、機器台帳のインポートはできません")
+	}
+}
+
+// authorizeAdmin function: 管理操作（手動判定の設定・解除、インシデントの確認・解決、注釈・登録済み機器の更新、機器台帳のインポート）の Authorization ヘッダーを検証し、オペレーター名を返す
+// オペレーター名はリクエスト本文ではなく、認証に使ったトークンから決める。
+// 失敗時は401を返す（ADMIN_TOKENS が未設定の場合は管理操作を無効として403を返す）
+func authorizeAdmin(w http.ResponseWriter, r *http.Request) (string, bool) {
+	tokens, _ := adminTokens()
+	if len(tokens) == 0 {
+		log.Printf("エラー: ADMIN_TOKENS が設定されていないため管理操作はできません")
+		http.Error(w, "Admin operations are disabled (ADMIN_TOKENS is not set)", http.StatusForbidden)
+		return "", false
+	}
+
+	authHeader := r.Header.Get("Authorization")
+	if strings.HasPrefix(authHeader, "Bearer ") {
+		presented := strings.TrimSpace(strings.TrimPrefix(authHeader, "Bearer "))
+		for _, t := range tokens {
+			if subtle.ConstantTimeCompare([]byte(presented), []byte(t.Token)) == 1 {
+				log.Printf("✅ 管理トークン認証成功 (オペレーター: %s)", t.Operator)
+				return t.Operator, true
+			}
+		}
+	}
+	log.Printf("エラー: 管理トークン認証失敗")
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return "", false
+}
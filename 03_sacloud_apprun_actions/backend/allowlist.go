@@ -0,0 +1,444 @@
+package backend
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 登録済み機器の種類 (known_device.kind)
+const (
+	KnownKindMAC = "mac" // MACアドレス1件
+	KnownKindOUI = "oui" // 先頭3オクテット（ベンダー単位）
+)
+
+// EventUnknownDevice: 登録済み機器一覧にない機器を検出
+const EventUnknownDevice = "unknown_device"
+
+// KnownDevice type: known_device テーブルの1行を表す
+type KnownDevice struct {
+	ID      int64  `json:"id"`
+	Pattern string `json:"pattern"`
+	Kind    string `json:"kind"`
+	Label   string `json:"label"`
+	AddedAt string `json:"added_at"`
+	AddedBy string `json:"added_by,omitempty"`
+}
+
+// knownDeviceRequest type: 登録済み機器の追加APIのリクエスト（登録者は管理トークンから決める）
+type knownDeviceRequest struct {
+	Pattern string `json:"pattern"`
+	Label   string `json:"label"`
+}
+
+// importError type: CSVインポートで取り込めなかった行
+type importError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// parseKnownPattern function: MACアドレスまたはOUIを小文字・コロン区切りに揃え、種類を判定する
+// "AA-BB-CC", "aabb.ccdd.eeff", "AABBCCDDEEFF" などの表記を受け付ける
+func parseKnownPattern(value string) (string, string, error) {
+	hex := strings.NewReplacer(":", "", "-", "", ".", "").Replace(strings.ToLower(strings.TrimSpace(value)))
+	for _, c := range hex {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return "", "", fmt.Errorf("invalid MAC address or OUI: %q", value)
+		}
+	}
+
+	var kind string
+	switch len(hex) {
+	case 6:
+		kind = KnownKindOUI
+	case 12:
+		kind = KnownKindMAC
+	default:
+		return "", "", fmt.Errorf("invalid MAC address or OUI: %q", value)
+	}
+	octets := make([]string, 0, len(hex)/2)
+	for i := 0; i < len(hex); i += 2 {
+		octets = append(octets, hex[i:i+2])
+	}
+	return strings.Join(octets, ":"), kind, nil
+}
+
+// isUnknownDevice function: 機器が登録済み機器一覧にないかどうかを判定
+// 一覧が空の場合は未設定とみなし、未登録として扱わない
+func isUnknownDevice(tx *sql.Tx, macAddress string) (bool, error) {
+	mac := strings.ToLower(macAddress)
+	var total, matched int
+	err := tx.QueryRow(`SELECT COUNT(*), COALESCE(SUM(CASE
+			WHEN kind = ? AND pattern = ? THEN 1
+			WHEN kind = ? AND pattern = substr(?, 1, 8) THEN 1
+			ELSE 0 END), 0)
+		FROM known_device`, KnownKindMAC, mac, KnownKindOUI, mac).Scan(&total, &matched)
+	if err != nil {
+		return false, fmt.Errorf("登録済み機器確認エラー (MAC: %s): %v", macAddress, err)
+	}
+	return total > 0 && matched == 0, nil
+}
+
+// refreshUnknownFlag function: 登録済み機器一覧と照合して device.is_unknown を更新
+// 登録済み→未登録に変わった時点でセキュリティイベントを記録する
+func refreshUnknownFlag(tx *sql.Tx, macAddress, at string) error {
+	var wasUnknown bool
+	var ipAddress string
+	err := tx.QueryRow("SELECT COALESCE(is_unknown, FALSE), COALESCE(ip_address, '') FROM device WHERE mac_address = ?",
+		macAddress).Scan(&wasUnknown, &ipAddress)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("未登録フラグ取得エラー (MAC: %s): %v", macAddress, err)
+	}
+	isUnknown, err := isUnknownDevice(tx, macAddress)
+	if err != nil {
+		return err
+	}
+	if wasUnknown == isUnknown {
+		return nil
+	}
+
+	if _, err := tx.Exec("UPDATE device SET is_unknown = ? WHERE mac_address = ?", isUnknown, macAddress); err != nil {
+		return fmt.Errorf("未登録フラグ更新エラー (MAC: %s): %v", macAddress, err)
+	}
+	if !isUnknown {
+		return nil
+	}
+	return recordSecurityEvent(tx, SecurityEvent{
+		EventType:  EventUnknownDevice,
+		MACAddress: macAddress,
+		IPAddress:  ipAddress,
+		Reason:     fmt.Sprintf("登録されていない機器 %s (IP: %s) を検出しました", macAddress, ipAddress),
+	}, at)
+}
+
+// refreshAllUnknownFlags function: 登録済み機器一覧の変更後に全機器の未登録フラグを更新
+func refreshAllUnknownFlags(tx *sql.Tx, at string) error {
+	rows, err := tx.Query("SELECT mac_address FROM device")
+	if err != nil {
+		return fmt.Errorf("機器一覧取得エラー: %v", err)
+	}
+	var macs []string
+	for rows.Next() {
+		var mac string
+		if err := rows.Scan(&mac); err != nil {
+			rows.Close()
+			return fmt.Errorf("機器一覧読み込みエラー: %v", err)
+		}
+		macs = append(macs, mac)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, mac := range macs {
+		if err := refreshUnknownFlag(tx, mac, at); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addKnownDevice function: 登録済み機器を追加（同じパターンがあればラベルを更新）
+func addKnownDevice(tx *sql.Tx, pattern, kind, label, operator, at string) error {
+	_, err := tx.Exec(`INSERT INTO known_device (pattern, kind, label, added_at, added_by) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (pattern) DO UPDATE SET label = excluded.label`,
+		pattern, kind, label, at, operator)
+	if err != nil {
+		return fmt.Errorf("登録済み機器追加エラー (%s): %v", pattern, err)
+	}
+	return nil
+}
+
+// queryKnownDevices function: 条件に一致する登録済み機器を取得
+func queryKnownDevices(where string, args ...interface{}) ([]KnownDevice, error) {
+	query := "SELECT id, pattern, kind, COALESCE(label, ''), added_at, COALESCE(added_by, '') FROM known_device"
+	if where != "" {
+		query += " WHERE " + where
+	}
+	query += " ORDER BY pattern"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("登録済み機器取得エラー: %v", err)
+	}
+	defer rows.Close()
+
+	known := []KnownDevice{}
+	for rows.Next() {
+		var k KnownDevice
+		if err := rows.Scan(&k.ID, &k.Pattern, &k.Kind, &k.Label, &k.AddedAt, &k.AddedBy); err != nil {
+			return nil, fmt.Errorf("登録済み機器読み込みエラー: %v", err)
+		}
+		known = append(known, k)
+	}
+	return known, rows.Err()
+}
+
+// CountUnknownDevices function: 未登録の機器数を返す（ダッシュボード表示用）
+func CountUnknownDevices() int {
+	if db == nil {
+		return 0
+	}
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM device WHERE is_unknown = TRUE").Scan(&count); err != nil {
+		log.Printf("未登録機器数の取得エラー: %v", err)
+	}
+	return count
+}
+
+// allowlistHandler function: 登録済み機器の一覧（GET）と追加（POST、管理トークン（ADMIN_TOKENS）が必要）
+func allowlistHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		if !authorizeRequest(w, r) || !databaseReady(w) {
+			return
+		}
+		known, err := queryKnownDevices("")
+		if err != nil {
+			log.Printf("❌ %v", err)
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status":    "success",
+			"count":     len(known),
+			"allowlist": known,
+			"timestamp": time.Now().Format("2006-01-02 15:04:05"),
+		})
+		return
+	}
+
+	operator, ok := authorizeAdmin(w, r)
+	if !ok || !databaseReady(w) {
+		return
+	}
+	var req knownDeviceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON data: %v", err), http.StatusBadRequest)
+		return
+	}
+	pattern, kind, err := parseKnownPattern(req.Pattern)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = updateAllowlist(func(tx *sql.Tx, now string) error {
+		return addKnownDevice(tx, pattern, kind, strings.TrimSpace(req.Label), operator, now)
+	})
+	if err != nil {
+		log.Printf("❌ %v", err)
+		http.Error(w, "Database update failed", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("✅ 登録済み機器を追加しました (%s: %s, by %s)", kind, pattern, operator)
+
+	known, err := queryKnownDevices("pattern = ?", pattern)
+	if err != nil || len(known) == 0 {
+		log.Printf("❌ 登録済み機器取得エラー: %v", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":        "success",
+		"entry":         known[0],
+		"unknown_count": CountUnknownDevices(),
+		"timestamp":     time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
+
+// allowlistEntryHandler function: 登録済み機器を削除（管理トークン（ADMIN_TOKENS）が必要）
+func allowlistEntryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	operator, ok := authorizeAdmin(w, r)
+	if !ok || !databaseReady(w) {
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "Invalid allowlist id", http.StatusBadRequest)
+		return
+	}
+
+	found := false
+	err = updateAllowlist(func(tx *sql.Tx, now string) error {
+		result, err := tx.Exec("DELETE FROM known_device WHERE id = ?", id)
+		if err != nil {
+			return fmt.Errorf("登録済み機器削除エラー (ID: %d): %v", id, err)
+		}
+		n, _ := result.RowsAffected()
+		found = n > 0
+		return nil
+	})
+	if err != nil {
+		log.Printf("❌ %v", err)
+		http.Error(w, "Database update failed", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Allowlist entry not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("✅ 登録済み機器を削除しました (ID: %d, by %s)", id, operator)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":        "success",
+		"message":       "登録済み機器を削除しました",
+		"unknown_count": CountUnknownDevices(),
+		"timestamp":     time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
+
+// allowlistImportHandler function: CSV（pattern,label）から登録済み機器をまとめて登録
+// 1行目が "pattern" / "mac" / "oui" で始まる場合はヘッダーとして読み飛ばす。
+// ?replace=true の場合は既存の一覧を置き換える。不正な行が1行でもあれば何も登録しない。
+// 管理トークン（ADMIN_TOKENS）が必要で、登録者はトークンから決める
+func allowlistImportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	operator, ok := authorizeAdmin(w, r)
+	if !ok || !databaseReady(w) {
+		return
+	}
+	replace := r.URL.Query().Get("replace") == "true"
+
+	type entry struct{ pattern, kind, label string }
+	var entries []entry
+	var importErrors []importError
+
+	reader := csv.NewReader(r.Body)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		line, _ := reader.FieldPos(0)
+		if err != nil {
+			importErrors = append(importErrors, importError{Line: line, Error: err.Error()})
+			break
+		}
+		if len(record) == 0 || strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		if len(entries) == 0 && len(importErrors) == 0 {
+			switch strings.ToLower(strings.TrimSpace(record[0])) {
+			case "pattern", "mac", "oui":
+				continue
+			}
+		}
+
+		pattern, kind, err := parseKnownPattern(record[0])
+		if err != nil {
+			importErrors = append(importErrors, importError{Line: line, Error: err.Error()})
+			continue
+		}
+		label := ""
+		if len(record) > 1 {
+			label = strings.TrimSpace(record[1])
+		}
+		entries = append(entries, entry{pattern, kind, label})
+	}
+
+	if len(importErrors) > 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"status":    "error",
+			"message":   "CSVに不正な行があるため登録しませんでした",
+			"errors":    importErrors,
+			"timestamp": time.Now().Format("2006-01-02 15:04:05"),
+		})
+		return
+	}
+
+	err := updateAllowlist(func(tx *sql.Tx, now string) error {
+		if replace {
+			if _, err := tx.Exec("DELETE FROM known_device"); err != nil {
+				return fmt.Errorf("登録済み機器削除エラー: %v", err)
+			}
+		}
+		for _, e := range entries {
+			if err := addKnownDevice(tx, e.pattern, e.kind, e.label, operator, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("❌ %v", err)
+		http.Error(w, "Database update failed", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("✅ 登録済み機器をインポートしました (%d件, 置き換え: %v, by %s)", len(entries), replace, operator)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":        "success",
+		"imported":      len(entries),
+		"replaced":      replace,
+		"unknown_count": CountUnknownDevices(),
+		"timestamp":     time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
+
+// updateAllowlist function: 登録済み機器一覧を変更し、同じトランザクションで全機器の未登録フラグを更新
+func updateAllowlist(change func(tx *sql.Tx, now string) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("トランザクション開始エラー: %v", err)
+	}
+	defer tx.Rollback()
+
+	now := nowTimestamp()
+	if err := change(tx, now); err != nil {
+		return err
+	}
+	if err := refreshAllUnknownFlags(tx, now); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// unknownDevicesHandler function: 登録済み機器一覧にない機器を返す
+func unknownDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeRequest(w, r) || !databaseReady(w) {
+		return
+	}
+
+	devices, err := queryDevices("is_unknown = TRUE")
+	if err != nil {
+		log.Printf("❌ %v", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":    "success",
+		"count":     len(devices),
+		"devices":   devices,
+		"timestamp": time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
@@ -0,0 +1,354 @@
+package backend
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxTagLength: タグ1件の最大文字数
+const maxTagLength = 50
+
+// Annotation type: 機器に付ける名前・所有者・設置場所・メモ・タグ（device_annotation / device_tag）
+type Annotation struct {
+	MACAddress string   `json:"mac_address"`
+	Name       string   `json:"name"`
+	Owner      string   `json:"owner"`
+	Location   string   `json:"location"`
+	Notes      string   `json:"notes"`
+	Tags       []string `json:"tags"`
+	UpdatedAt  string   `json:"updated_at,omitempty"`
+	UpdatedBy  string   `json:"updated_by,omitempty"`
+}
+
+// annotationRequest type: 注釈APIのリクエスト（更新者は管理トークンから決める）
+// PATCH では指定された項目のみ更新し、PUT では指定されなかった項目を空にする
+type annotationRequest struct {
+	Name     *string   `json:"name"`
+	Owner    *string   `json:"owner"`
+	Location *string   `json:"location"`
+	Notes    *string   `json:"notes"`
+	Tags     *[]string `json:"tags"`
+}
+
+// normalizeTags function: タグの前後の空白を除き、重複と空文字を取り除いて並べ替える
+func normalizeTags(tags []string) ([]string, error) {
+	seen := map[string]bool{}
+	result := []string{}
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if len([]rune(tag)) > maxTagLength {
+			return nil, fmt.Errorf("tag is too long (max %d characters): %s", maxTagLength, tag)
+		}
+		seen[tag] = true
+		result = append(result, tag)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// apply function: リクエストの内容を既存の注釈に反映
+func (req annotationRequest) apply(a *Annotation, replace bool) error {
+	set := func(dst *string, src *string) {
+		if src != nil {
+			*dst = strings.TrimSpace(*src)
+		} else if replace {
+			*dst = ""
+		}
+	}
+	set(&a.Name, req.Name)
+	set(&a.Owner, req.Owner)
+	set(&a.Location, req.Location)
+	set(&a.Notes, req.Notes)
+
+	if req.Tags != nil {
+		tags, err := normalizeTags(*req.Tags)
+		if err != nil {
+			return err
+		}
+		a.Tags = tags
+	} else if replace {
+		a.Tags = []string{}
+	}
+	return nil
+}
+
+// saveAnnotation function: 注釈とタグを保存
+func saveAnnotation(tx *sql.Tx, a Annotation) error {
+	_, err := tx.Exec(`INSERT INTO device_annotation (mac_address, name, owner, location, notes, updated_at, updated_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (mac_address) DO UPDATE SET name = excluded.name, owner = excluded.owner, location = excluded.location,
+			notes = excluded.notes, updated_at = excluded.updated_at, updated_by = excluded.updated_by`,
+		a.MACAddress, a.Name, a.Owner, a.Location, a.Notes, a.UpdatedAt, a.UpdatedBy)
+	if err != nil {
+		return fmt.Errorf("注釈保存エラー (MAC: %s): %v", a.MACAddress, err)
+	}
+
+	if _, err := tx.Exec("DELETE FROM device_tag WHERE mac_address = ?", a.MACAddress); err != nil {
+		return fmt.Errorf("タグ削除エラー (MAC: %s): %v", a.MACAddress, err)
+	}
+	for _, tag := range a.Tags {
+		if _, err := tx.Exec("INSERT INTO device_tag (mac_address, tag) VALUES (?, ?)", a.MACAddress, tag); err != nil {
+			return fmt.Errorf("タグ保存エラー (MAC: %s): %v", a.MACAddress, err)
+		}
+	}
+	return nil
+}
+
+// queryAnnotations function: 条件に一致する注釈をタグ付きで取得
+func queryAnnotations(where string, args ...interface{}) ([]Annotation, error) {
+	query := `SELECT mac_address, COALESCE(name, ''), COALESCE(owner, ''), COALESCE(location, ''), COALESCE(notes, ''),
+		updated_at, COALESCE(updated_by, '') FROM device_annotation`
+	if where != "" {
+		query += " WHERE " + where
+	}
+	query += " ORDER BY mac_address"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("注釈取得エラー: %v", err)
+	}
+	defer rows.Close()
+
+	annotations := []Annotation{}
+	for rows.Next() {
+		var a Annotation
+		if err := rows.Scan(&a.MACAddress, &a.Name, &a.Owner, &a.Location, &a.Notes, &a.UpdatedAt, &a.UpdatedBy); err != nil {
+			return nil, fmt.Errorf("注釈読み込みエラー: %v", err)
+		}
+		a.Tags = []string{}
+		annotations = append(annotations, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	tags, err := deviceTags()
+	if err != nil {
+		return nil, err
+	}
+	for i := range annotations {
+		if t, ok := tags[annotations[i].MACAddress]; ok {
+			annotations[i].Tags = t
+		}
+	}
+	return annotations, nil
+}
+
+// deviceTags function: 全機器のタグをMACアドレスごとにまとめて返す
+func deviceTags() (map[string][]string, error) {
+	rows, err := db.Query("SELECT mac_address, tag FROM device_tag ORDER BY mac_address, tag")
+	if err != nil {
+		return nil, fmt.Errorf("タグ取得エラー: %v", err)
+	}
+	defer rows.Close()
+
+	tags := map[string][]string{}
+	for rows.Next() {
+		var mac, tag string
+		if err := rows.Scan(&mac, &tag); err != nil {
+			return nil, fmt.Errorf("タグ読み込みエラー: %v", err)
+		}
+		tags[mac] = append(tags[mac], tag)
+	}
+	return tags, rows.Err()
+}
+
+// DeviceAnnotations function: 注釈をMACアドレスごとにまとめて返す（ダッシュボード表示用）
+func DeviceAnnotations() (map[string]Annotation, error) {
+	annotations, err := queryAnnotations("")
+	if err != nil {
+		return nil, err
+	}
+	byMAC := map[string]Annotation{}
+	for _, a := range annotations {
+		byMAC[a.MACAddress] = a
+	}
+	return byMAC, nil
+}
+
+// annotationMACFromPath function: パスの {mac} を正規化したMACアドレスとして取得（"AA-BB-..." なども受け付ける）
+func annotationMACFromPath(w http.ResponseWriter, r *http.Request) (string, bool) {
+	mac, err := normalizeMAC(r.PathValue("mac"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	return mac, true
+}
+
+// annotationsHandler function: 注釈の一覧を返す（?tag= でタグを指定して絞り込み）
+func annotationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeRequest(w, r) || !databaseReady(w) {
+		return
+	}
+
+	where := ""
+	var args []interface{}
+	if tag := strings.TrimSpace(r.URL.Query().Get("tag")); tag != "" {
+		where = "mac_address IN (SELECT mac_address FROM device_tag WHERE tag = ?)"
+		args = append(args, tag)
+	}
+
+	annotations, err := queryAnnotations(where, args...)
+	if err != nil {
+		log.Printf("❌ %v", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":      "success",
+		"count":       len(annotations),
+		"annotations": annotations,
+		"timestamp":   time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
+
+// deviceAnnotationHandler function: 機器1台の注釈の取得（GET）・置き換え（PUT）・部分更新（PATCH）・削除（DELETE）
+// 機器がまだ検出されていなくても登録でき、後の /upload で検出された時点で表示される。
+// 更新・削除には管理トークン（ADMIN_TOKENS）が必要
+func deviceAnnotationHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodDelete:
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	operator := ""
+	if r.Method == http.MethodGet {
+		if !authorizeRequest(w, r) {
+			return
+		}
+	} else {
+		var ok bool
+		if operator, ok = authorizeAdmin(w, r); !ok {
+			return
+		}
+	}
+	if !databaseReady(w) {
+		return
+	}
+	mac, ok := annotationMACFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		annotations, err := queryAnnotations("mac_address = ?", mac)
+		if err != nil {
+			log.Printf("❌ %v", err)
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			return
+		}
+		if len(annotations) == 0 {
+			http.Error(w, "Annotation not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status":     "success",
+			"annotation": annotations[0],
+			"timestamp":  time.Now().Format("2006-01-02 15:04:05"),
+		})
+
+	case http.MethodDelete:
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("❌ トランザクション開始エラー: %v", err)
+			http.Error(w, "Database update failed", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		result, err := tx.Exec("DELETE FROM device_annotation WHERE mac_address = ?", mac)
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM device_tag WHERE mac_address = ?", mac)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Printf("❌ 注釈削除エラー (MAC: %s): %v", mac, err)
+			http.Error(w, "Database update failed", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			http.Error(w, "Annotation not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("✅ 注釈を削除しました (MAC: %s, by %s)", mac, operator)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status":    "success",
+			"message":   "注釈を削除しました",
+			"timestamp": time.Now().Format("2006-01-02 15:04:05"),
+		})
+
+	default:
+		updateAnnotation(w, r, mac, operator, r.Method == http.MethodPut)
+	}
+}
+
+// updateAnnotation function: 注釈を保存して保存後の内容を返す
+func updateAnnotation(w http.ResponseWriter, r *http.Request, mac, operator string, replace bool) {
+	var req annotationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON data: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	existing, err := queryAnnotations("mac_address = ?", mac)
+	if err != nil {
+		log.Printf("❌ %v", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	annotation := Annotation{MACAddress: mac, Tags: []string{}}
+	if len(existing) > 0 {
+		annotation = existing[0]
+	}
+	if err := req.apply(&annotation, replace); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	annotation.UpdatedAt = nowTimestamp()
+	annotation.UpdatedBy = operator
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("❌ トランザクション開始エラー: %v", err)
+		http.Error(w, "Database update failed", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if err := saveAnnotation(tx, annotation); err != nil {
+		log.Printf("❌ %v", err)
+		http.Error(w, "Database update failed", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("❌ コミットエラー: %v", err)
+		http.Error(w, "Database update failed", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("✅ 注釈を保存しました (MAC: %s, 名前: %s, by %s)", mac, annotation.Name, operator)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":     "success",
+		"annotation": annotation,
+		"timestamp":  time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
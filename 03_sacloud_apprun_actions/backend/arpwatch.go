@@ -0,0 +1,391 @@
+package backend
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// セキュリティイベントの種別
+const (
+	EventIPChange         = "ip_change"          // MACアドレスが別のIPに移動
+	EventIPConflict       = "ip_conflict"        // 複数のMACアドレスが同じIPを主張
+	EventGatewayMACChange = "gateway_mac_change" // ゲートウェイIPのMACアドレスが変化（ARPスプーフィングの疑い）
+)
+
+// eventSeverity: イベント種別ごとの危険度
+var eventSeverity = map[string]string{
+	EventIPChange:         SeverityLow,
+	EventIPConflict:       SeverityHigh,
+	EventGatewayMACChange: SeverityCritical,
+	EventUnknownDevice:    SeverityMedium,
+	EventVendorMismatch:   SeverityMedium,
+}
+
+// defaultConflictWindowMinutes: 別スキャンでのIP競合とみなす期間（分）のデフォルト値
+const defaultConflictWindowMinutes = 10
+
+// SecurityEvent type: security_event テーブルの1行を表す
+type SecurityEvent struct {
+	ID              int64  `json:"id"`
+	EventType       string `json:"event_type"`
+	MACAddress      string `json:"mac_address"`
+	IPAddress       string `json:"ip_address"`
+	PreviousValue   string `json:"previous_value"`
+	RelatedMAC      string `json:"related_mac"`
+	Reason          string `json:"reason"`
+	MarkedDangerous bool   `json:"marked_dangerous"`
+	DetectedAt      string `json:"detected_at"`
+}
+
+// gatewayIP function: 監視対象のゲートウェイIPを環境変数 GATEWAY_IP から取得
+func gatewayIP() string {
+	return strings.TrimSpace(os.Getenv("GATEWAY_IP"))
+}
+
+// dangerousEventTypes function: 機器を危険とみなすイベント種別を環境変数 ARP_DANGER_EVENTS から取得
+func dangerousEventTypes() map[string]bool {
+	value := os.Getenv("ARP_DANGER_EVENTS")
+	if value == "" {
+		value = EventIPConflict + "," + EventGatewayMACChange
+	}
+	types := map[string]bool{}
+	for _, t := range strings.Split(value, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types[t] = true
+		}
+	}
+	return types
+}
+
+// previousAddresses function: 更新前の機器の現在のアドレス（最終検出から currentAddressWindow 以内に観測されたもの）
+// device_address がない古い機器は device.ip_address を使う
+func previousAddresses(tx *sql.Tx, macAddress string) ([]string, error) {
+	rows, err := tx.Query(`SELECT a.ip_address FROM device_address a JOIN device d ON d.mac_address = a.mac_address
+		WHERE a.mac_address = ? AND a.last_seen >= datetime(d.last_seen, ?) ORDER BY a.ip_address`,
+		macAddress, fmt.Sprintf("-%d seconds", int(currentAddressWindow.Seconds())))
+	if err != nil {
+		return nil, fmt.Errorf("前回IP取得エラー (MAC: %s): %v", macAddress, err)
+	}
+	defer rows.Close()
+	var ips []string
+	for rows.Next() {
+		var ip string
+		if err := rows.Scan(&ip); err != nil {
+			return nil, fmt.Errorf("前回IP読み込みエラー (MAC: %s): %v", macAddress, err)
+		}
+		ips = append(ips, ip)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ips) > 0 {
+		return ips, nil
+	}
+
+	var previousIP sql.NullString
+	err = tx.QueryRow("SELECT ip_address FROM device WHERE mac_address = ?", macAddress).Scan(&previousIP)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("前回IP取得エラー (MAC: %s): %v", macAddress, err)
+	}
+	if previousIP.Valid && previousIP.String != "" {
+		ips = []string{previousIP.String}
+	}
+	return ips, nil
+}
+
+// changedAddresses function: アドレスの種類（ipv4 / ipv6）ごとに比較し、前回のアドレスが1つも報告されなくなった種類の前回・今回のアドレスを返す
+// 報告の順序の違いやアドレスの追加は変化とみなさない
+func changedAddresses(previous, current []string) (before, after []string) {
+	byFamily := func(ips []string) map[string][]string {
+		m := map[string][]string{}
+		for _, ip := range ips {
+			family, _ := addressFamily(ip)
+			m[family] = append(m[family], ip)
+		}
+		return m
+	}
+	reported := map[string]bool{}
+	for _, ip := range current {
+		reported[ip] = true
+	}
+	previousByFamily, currentByFamily := byFamily(previous), byFamily(current)
+	for _, family := range sortedKeys(previousByFamily) {
+		if len(currentByFamily[family]) == 0 {
+			continue
+		}
+		kept := false
+		for _, ip := range previousByFamily[family] {
+			kept = kept || reported[ip]
+		}
+		if !kept {
+			before = append(before, previousByFamily[family]...)
+			after = append(after, currentByFamily[family]...)
+		}
+	}
+	return before, after
+}
+
+// detectBindingChanges function: 更新前の device・device_address テーブルと比較してARPバインディングの変化を検出
+// 報告されたすべてのアドレス（複数のIPアドレス・IPv6 を含む）を対象にする。機器の更新より前に呼び出す必要がある
+func detectBindingChanges(tx *sql.Tx, macAddress string, ips []string, seenAt string) ([]SecurityEvent, error) {
+	var events []SecurityEvent
+
+	// (a) MACアドレスが別のIPに移動
+	previous, err := previousAddresses(tx, macAddress)
+	if err != nil {
+		return nil, err
+	}
+	if before, after := changedAddresses(previous, ips); len(after) > 0 {
+		events = append(events, SecurityEvent{
+			EventType:     EventIPChange,
+			MACAddress:    macAddress,
+			IPAddress:     after[0],
+			PreviousValue: strings.Join(before, ","),
+			Reason:        fmt.Sprintf("IPアドレスが %s から %s に変化しました", strings.Join(before, ", "), strings.Join(after, ", ")),
+		})
+	}
+
+	// IP競合のウィンドウは観測日時を基準にする（スプールから遅れて届いた観測も当時の状況で判定する）
+	window := time.Duration(envInt("ARP_CONFLICT_WINDOW_MINUTES", defaultConflictWindowMinutes)) * time.Minute
+	conflictFrom := parseTimestamp(seenAt).Add(-window).Format(timestampLayout)
+	gw := gatewayIP()
+	for _, ipAddress := range ips {
+		// (c) ゲートウェイIPのMACアドレスが変化
+		if gw != "" && ipAddress == gw {
+			var previousMAC string
+			err := tx.QueryRow(`SELECT mac_address FROM device_observation WHERE ip_address = ? AND observed_at < ?
+				ORDER BY observed_at DESC, id DESC LIMIT 1`, gw, seenAt).Scan(&previousMAC)
+			if err != nil && err != sql.ErrNoRows {
+				return nil, fmt.Errorf("ゲートウェイMAC取得エラー (IP: %s): %v", gw, err)
+			}
+			if previousMAC != "" && previousMAC != macAddress {
+				events = append(events, SecurityEvent{
+					EventType:     EventGatewayMACChange,
+					MACAddress:    macAddress,
+					IPAddress:     ipAddress,
+					PreviousValue: previousMAC,
+					RelatedMAC:    previousMAC,
+					Reason:        fmt.Sprintf("ゲートウェイ %s のMACアドレスが %s から %s に変化しました（ARPスプーフィングの疑い）", gw, previousMAC, macAddress),
+				})
+			}
+			// ゲートウェイは上記で判定するため通常のIP競合判定は行わない
+			continue
+		}
+
+		// (b) 直近の別スキャンで他のMACアドレスが同じIPを使用していた
+		conflicts, err := conflictingMACs(tx, macAddress, ipAddress, conflictFrom, seenAt)
+		if err != nil {
+			return nil, err
+		}
+		for _, otherMAC := range conflicts {
+			events = append(events, SecurityEvent{
+				EventType:  EventIPConflict,
+				MACAddress: macAddress,
+				IPAddress:  ipAddress,
+				RelatedMAC: otherMAC,
+				Reason:     fmt.Sprintf("IPアドレス %s を %s も直近のスキャンで使用していました", ipAddress, otherMAC),
+			})
+		}
+	}
+	return events, nil
+}
+
+// conflictingMACs function: from 以降 to より前に同じIPアドレスで観測された他の機器のMACアドレス
+func conflictingMACs(tx *sql.Tx, macAddress, ipAddress, from, to string) ([]string, error) {
+	rows, err := tx.Query(`SELECT DISTINCT mac_address FROM device_address
+		WHERE ip_address = ? AND mac_address != ? AND last_seen >= ? AND last_seen < ? ORDER BY mac_address`,
+		ipAddress, macAddress, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("IP競合確認エラー (IP: %s): %v", ipAddress, err)
+	}
+	defer rows.Close()
+	var macs []string
+	for rows.Next() {
+		var otherMAC string
+		if err := rows.Scan(&otherMAC); err != nil {
+			return nil, fmt.Errorf("IP競合確認エラー (IP: %s): %v", ipAddress, err)
+		}
+		macs = append(macs, otherMAC)
+	}
+	return macs, rows.Err()
+}
+
+// detectScanConflicts function: 1回のスキャン内で同じIPを主張する複数のMACアドレスを検出
+func detectScanConflicts(macsByIP map[string][]string) []SecurityEvent {
+	var events []SecurityEvent
+	for ipAddress, macs := range macsByIP {
+		if ipAddress == "" || len(macs) < 2 {
+			continue
+		}
+		for _, mac := range macs[1:] {
+			events = append(events, SecurityEvent{
+				EventType:  EventIPConflict,
+				MACAddress: mac,
+				IPAddress:  ipAddress,
+				RelatedMAC: macs[0],
+				Reason:     fmt.Sprintf("同一スキャン内で IPアドレス %s を %s と %s が主張しています", ipAddress, macs[0], mac),
+			})
+		}
+	}
+	return events
+}
+
+// recordSecurityEvent function: セキュリティイベントを記録し、設定に応じて機器を危険に設定
+func recordSecurityEvent(tx *sql.Tx, event SecurityEvent, detectedAt string) error {
+	event.MarkedDangerous = dangerousEventTypes()[event.EventType]
+
+	_, err := tx.Exec(`INSERT INTO security_event (event_type, mac_address, ip_address, previous_value, related_mac, reason, marked_dangerous, detected_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		event.EventType, event.MACAddress, event.IPAddress, event.PreviousValue, event.RelatedMAC, event.Reason, event.MarkedDangerous, detectedAt)
+	if err != nil {
+		return fmt.Errorf("セキュリティイベント記録エラー (MAC: %s): %v", event.MACAddress, err)
+	}
+	log.Printf("  🚨 セキュリティイベント検出 [%s] %s", event.EventType, event.Reason)
+
+	if !event.MarkedDangerous {
+		return nil
+	}
+	hit := dangerHit{
+		Source:   DangerSourceARP,
+		Severity: eventSeverity[event.EventType],
+		Reason:   event.Reason,
+		Evidence: []string{fmt.Sprintf("%s [%s] %s", detectedAt, event.EventType, event.Reason)},
+	}
+	return raiseDanger(tx, event.MACAddress, hit, detectedAt)
+}
+
+// scanEventSet type: 1回のスキャン（/upload）で記録したセキュリティイベント
+// 別スキャンとの比較と同一スキャン内の比較の両方で同じIP競合を検出しても、1回だけ記録するために使う
+type scanEventSet map[string]bool
+
+// eventKeys function: イベントを識別するキー（種別・IP・MACアドレス、相手のいるイベントは両者の組も）
+func (set scanEventSet) eventKeys(event SecurityEvent) []string {
+	keys := []string{event.EventType + "|" + event.IPAddress + "|" + event.MACAddress}
+	if event.RelatedMAC != "" {
+		pair := []string{event.MACAddress, event.RelatedMAC}
+		sort.Strings(pair)
+		keys = append(keys, event.EventType+"|"+event.IPAddress+"|"+strings.Join(pair, "-"))
+	}
+	return keys
+}
+
+// filter function: このスキャンで未記録のイベントだけを返す（返したイベントは記録済みとして追加する）
+func (set scanEventSet) filter(events []SecurityEvent) []SecurityEvent {
+	var result []SecurityEvent
+	for _, event := range events {
+		keys := set.eventKeys(event)
+		duplicate := false
+		for _, key := range keys {
+			duplicate = duplicate || set[key]
+		}
+		if duplicate {
+			log.Printf("  このスキャンで記録済みのため省略 [%s] %s", event.EventType, event.Reason)
+			continue
+		}
+		for _, key := range keys {
+			set[key] = true
+		}
+		result = append(result, event)
+	}
+	return result
+}
+
+// recordScanConflicts function: 同一スキャン内のIP競合をまとめて記録（別スキャンとの比較で記録済みのものは除く）
+func recordScanConflicts(events []SecurityEvent, recorded scanEventSet, detectedAt string) error {
+	events = recorded.filter(events)
+	if len(events) == 0 {
+		return nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("トランザクション開始エラー: %v", err)
+	}
+	defer tx.Rollback()
+
+	for _, event := range events {
+		if err := recordSecurityEvent(tx, event, detectedAt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// querySecurityEvents function: 条件に一致するセキュリティイベントを新しい順に最大 limit 件取得
+func querySecurityEvents(where string, limit int, args ...interface{}) ([]SecurityEvent, error) {
+	query := `SELECT id, event_type, mac_address, COALESCE(ip_address, ''), COALESCE(previous_value, ''), COALESCE(related_mac, ''),
+		COALESCE(reason, ''), marked_dangerous, detected_at FROM security_event`
+	if where != "" {
+		query += " WHERE " + where
+	}
+	query += " ORDER BY detected_at DESC, id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("セキュリティイベント取得エラー: %v", err)
+	}
+	defer rows.Close()
+
+	events := []SecurityEvent{}
+	for rows.Next() {
+		var e SecurityEvent
+		if err := rows.Scan(&e.ID, &e.EventType, &e.MACAddress, &e.IPAddress, &e.PreviousValue, &e.RelatedMAC,
+			&e.Reason, &e.MarkedDangerous, &e.DetectedAt); err != nil {
+			return nil, fmt.Errorf("セキュリティイベント読み込みエラー: %v", err)
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// securityEventsHandler function: 記録されたセキュリティイベントを新しい順に返す
+func securityEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeRequest(w, r) || !databaseReady(w) {
+		return
+	}
+
+	var conditions []string
+	var args []interface{}
+	if eventType := r.URL.Query().Get("type"); eventType != "" {
+		conditions = append(conditions, "event_type = ?")
+		args = append(args, eventType)
+	}
+	if mac := r.URL.Query().Get("mac"); mac != "" {
+		conditions = append(conditions, "(mac_address = ? OR related_mac = ?)")
+		args = append(args, macFilter(mac), macFilter(mac))
+	}
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	events, err := querySecurityEvents(strings.Join(conditions, " AND "), limit, args...)
+	if err != nil {
+		log.Printf("❌ %v", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":    "success",
+		"count":     len(events),
+		"events":    events,
+		"timestamp": time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
@@ -0,0 +1,52 @@
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDetectBindingChangesConflictWindow(t *testing.T) {
+	t.Setenv("ARP_CONFLICT_WINDOW_MINUTES", "60")
+	t.Setenv("GATEWAY_IP", "")
+	// スプールから2日遅れで届いた観測
+	seenAt := time.Now().UTC().Add(-48 * time.Hour).Truncate(time.Second)
+	at := func(d time.Duration) string { return seenAt.Add(d).Format(timestampLayout) }
+
+	tests := []struct {
+		name          string
+		otherLastSeen string
+		conflict      bool
+	}{
+		{name: "other device seen shortly before the observation", otherLastSeen: at(-10 * time.Minute), conflict: true},
+		{name: "other device seen before the window", otherLastSeen: at(-2 * time.Hour)},
+		{name: "other device seen after the observation", otherLastSeen: at(10 * time.Minute)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			database := openTestDatabase(t)
+			if _, err := database.Exec(`INSERT INTO device_address (mac_address, ip_address, family, first_seen, last_seen, seen_count)
+				VALUES ('aa:bb:cc:00:00:02', '192.168.1.10', 'ipv4', ?, ?, 1)`, tt.otherLastSeen, tt.otherLastSeen); err != nil {
+				t.Fatal(err)
+			}
+			tx, err := database.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Rollback()
+
+			events, err := detectBindingChanges(tx, "aa:bb:cc:00:00:01", []string{"192.168.1.10"}, at(0))
+			if err != nil {
+				t.Fatalf("detectBindingChanges error: %v", err)
+			}
+			conflict := false
+			for _, e := range events {
+				if e.EventType == EventIPConflict && e.RelatedMAC == "aa:bb:cc:00:00:02" {
+					conflict = true
+				}
+			}
+			if conflict != tt.conflict {
+				t.Errorf("ip_conflict = %v, want %v (%+v)", conflict, tt.conflict, events)
+			}
+		})
+	}
+}
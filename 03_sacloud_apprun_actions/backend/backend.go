@@ -11,31 +11,33 @@ import (
 	"time"
 )
 
+// Key type: {"key": "..."} 形式の値
+type Key struct {
+	Key string `json:"key"`
+}
+
+// Device type: /upload で送る機器1台分のデータ
+type Device struct {
+	MAC    Key `json:"mac"`
+	IP     Key `json:"ip"`
+	Vendor Key `json:"vendor"`
+}
+
 // JSON type: represents the structure of the incoming JSON data.
 type JSON struct {
-	Devices map[string]struct {
-		MAC struct {
-			Key string `json:"key"`
-		} `json:"mac"`
-		IP struct {
-			Key string `json:"key"`
-		} `json:"ip"`
-		Vendor struct {
-			Key string `json:"key"`
-		} `json:"vendor"`
-	} `json:"devices"`
+	Devices map[string]Device `json:"devices"`
+}
+
+// StatusDevice type: /status で送る危険機器1台分のデータ（log は危険判定の証跡となる元のログ行）
+type StatusDevice struct {
+	MAC Key `json:"mac"`
+	IP  Key `json:"ip"`
+	Log Key `json:"log"`
 }
 
 // StatusJSON type: represents the structure of the /status endpoint JSON data.
 type StatusJSON struct {
-	Devices map[string]struct {
-		MAC struct {
-			Key string `json:"key"`
-		} `json:"mac"`
-		IP struct {
-			Key string `json:"key"`
-		} `json:"ip"`
-	} `json:"devices"`
+	Devices map[string]StatusDevice `json:"devices"`
 }
 
 // データベースインスタンス
@@ -58,11 +60,101 @@ func RunBackend() {
 	// ヘルスチェック用エンドポイント
 	http.HandleFunc("/api/health", healthHandler)
 
+	// 検出履歴の参照用エンドポイント
+	http.HandleFunc("/api/v1/devices", devicesHandler)
+	http.HandleFunc("/api/v1/devices/new", newDevicesHandler)
+	http.HandleFunc("/api/v1/devices/stale", staleDevicesHandler)
+	http.HandleFunc("/api/v1/devices/{mac}", deviceDetailHandler)
+
+	// ARPバインディング監視のセキュリティイベント
+	http.HandleFunc("/api/v1/security-events", securityEventsHandler)
+
+	// 危険判定（発生元・危険度・理由・証跡）
+	http.HandleFunc("/api/v1/dangers", dangersHandler)
+
+	// インシデント（作成・確認・解決と所要時間）
+	http.HandleFunc("/api/v1/incidents", incidentsHandler)
+	http.HandleFunc("/api/v1/incidents/metrics", incidentMetricsHandler)
+	http.HandleFunc("/api/v1/incidents/{id}", incidentDetailHandler)
+	http.HandleFunc("/api/v1/incidents/{id}/ack", incidentAckHandler)
+	http.HandleFunc("/api/v1/incidents/{id}/resolve", incidentResolveHandler)
+
+	// 機器の注釈（名前・所有者・設置場所・メモ・タグ）
+	http.HandleFunc("/api/v1/annotations", annotationsHandler)
+	http.HandleFunc("/api/v1/devices/{mac}/annotation", deviceAnnotationHandler)
+
+	// オペレーターによる手動判定（危険・信頼済み）
+	http.HandleFunc("/api/v1/overrides", overridesHandler)
+	http.HandleFunc("/api/v1/devices/{mac}/override", deviceOverrideHandler)
+
+	// 登録済み機器（MACアドレス・OUI）と未登録機器
+	http.HandleFunc("/api/v1/allowlist", allowlistHandler)
+	http.HandleFunc("/api/v1/allowlist/import", allowlistImportHandler)
+	http.HandleFunc("/api/v1/allowlist/{id}", allowlistEntryHandler)
+	http.HandleFunc("/api/v1/devices/unknown", unknownDevicesHandler)
+
+	// netfilter の LOG 行の取り込みと通信記録
+	http.HandleFunc("/api/v1/netfilter", netfilterIngestHandler)
+	http.HandleFunc("/api/v1/flows", flowsHandler)
+
+	// DHCPリースの取り込み（ホスト名・client-id・期限）
+	http.HandleFunc("/api/v1/dhcp/leases", dhcpLeasesHandler)
+
+	// スキャンセッションと差分
+	http.HandleFunc("/api/v1/scans", scansHandler)
+	http.HandleFunc("/api/v1/scans/diff", scanDiffHandler)
+
+	// 機器台帳のエクスポート・インポート（CSV / JSON）
+	http.HandleFunc("/api/v1/inventory/export", inventoryExportHandler)
+	http.HandleFunc("/api/v1/inventory/import", inventoryImportHandler)
+
+	// データの保持期間と削除対象（dry-run）
+	http.HandleFunc("/api/v1/admin/retention", retentionHandler)
+
+	// incremental モードの危険判定の期限切れ処理
+	startDangerExpiry()
+
+	// 手動判定の期限切れ処理
+	startOverrideExpiry()
+
+	// 保持期間を過ぎたデータの削除
+	startRetention()
+
+	// 手動判定・インシデント・注釈などオペレーターの操作は NET_TOKEN とは別の管理トークンで行う
+	checkAdminTokens()
+
 	log.Println("Backend API endpoints registered")
 	log.Println("Available endpoints:")
-	log.Println("  POST /upload - デバイス情報をアップロード")
-	log.Println("  POST /status - 危険機器情報をアップロード")
+	log.Println("  POST /upload - デバイス情報をアップロード（Idempotency-Key 対応）")
+	log.Println("  POST /status - 危険機器情報をアップロード（Idempotency-Key 対応）")
 	log.Println("  GET /api/health - ヘルスチェック")
+	log.Println("  GET /api/v1/devices - 機器一覧（danger・vendor・ip・tag・seen_since で絞り込み、sort・cursor でページング）")
+	log.Println("  GET /api/v1/devices/new - 直近24時間以内の新規機器")
+	log.Println("  GET /api/v1/devices/stale - 長期間検出されていない機器")
+	log.Println("  GET /api/v1/devices/{mac} - 機器の詳細（IPアドレスの履歴・危険判定の遷移と証跡・注釈・インシデント）")
+	log.Println("  GET /api/v1/security-events - IP変化・IP競合・ゲートウェイMAC変化のイベント")
+	log.Println("  GET /api/v1/dangers - 危険判定の理由・危険度・証跡")
+	log.Println("  GET /api/v1/incidents - インシデント一覧")
+	log.Println("  GET /api/v1/incidents/metrics - 確認・解決までの所要時間")
+	log.Println("  GET /api/v1/incidents/{id} - インシデントの詳細")
+	log.Println("  POST /api/v1/incidents/{id}/ack - インシデントを確認済みにする（管理トークン）")
+	log.Println("  POST /api/v1/incidents/{id}/resolve - インシデントを解決する（管理トークン）")
+	log.Println("  GET /api/v1/annotations - 機器の注釈一覧")
+	log.Println("  GET/PUT/PATCH/DELETE /api/v1/devices/{mac}/annotation - 機器の注釈の参照・更新・削除（更新・削除は管理トークン）")
+	log.Println("  GET /api/v1/overrides - 手動判定（危険・信頼済み）の一覧")
+	log.Println("  GET/PUT/DELETE /api/v1/devices/{mac}/override - 手動判定の参照・設定・解除（設定・解除は管理トークン。理由・期限・実行者を記録）")
+	log.Println("  GET/POST /api/v1/allowlist - 登録済み機器の一覧・追加（追加は管理トークン）")
+	log.Println("  POST /api/v1/allowlist/import - 登録済み機器のCSVインポート（管理トークン）")
+	log.Println("  DELETE /api/v1/allowlist/{id} - 登録済み機器の削除（管理トークン）")
+	log.Println("  GET /api/v1/devices/unknown - 未登録の機器")
+	log.Println("  POST /api/v1/netfilter - netfilter のログ行を取り込んで危険判定（X-Sensor-Timezone / SENSOR_TIMEZONE でログの日時のタイムゾーンを指定）")
+	log.Println("  GET /api/v1/flows - 取り込んだ通信記録")
+	log.Println("  GET/POST /api/v1/dhcp/leases - DHCPリースの一覧・取り込み（dnsmasq / ISC dhcpd）")
+	log.Println("  GET /api/v1/scans - スキャンセッション一覧")
+	log.Println("  GET /api/v1/scans/diff - 2つのスキャン間の差分")
+	log.Println("  GET /api/v1/inventory/export - 機器台帳のエクスポート（?format=csv|json）")
+	log.Println("  POST /api/v1/inventory/import - 機器台帳・注釈・登録済み機器のインポート（CSV / JSON、?dry_run=true で変更内容のみ確認、管理トークン）")
+	log.Println("  GET /api/v1/admin/retention - データ種別ごとの保持期間と削除対象の件数（dry-run）")
 }
 
 // healthHandler function: ヘルスチェック用ハンドラー
@@ -102,23 +194,8 @@ func bearerAuth(expectedToken, authHeader string) bool {
 	return token == expectedToken
 }
 
-// statusHandler function: handles dangerous device status updates.
-func statusHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("=== 危険機器ステータス更新開始 ===")
-	log.Printf("リクエスト時刻: %s", time.Now().Format("2006-01-02 15:04:05"))
-	log.Printf("リクエスト元IP: %s", r.RemoteAddr)
-	log.Printf("リクエストメソッド: %s", r.Method)
-	log.Printf("Content-Type: %s", r.Header.Get("Content-Type"))
-	log.Printf("User-Agent: %s", r.Header.Get("User-Agent"))
-	
-	// Ensure the request method is POST.
-	if r.Method != http.MethodPost {
-		log.Printf("エラー: 無効なリクエストメソッド - %s", r.Method)
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
-		return
-	}
-
-	// Bearer token認証のチェック
+// authorizeRequest function: Authorizationヘッダーを検証し、失敗時は401を返す
+func authorizeRequest(w http.ResponseWriter, r *http.Request) bool {
 	authHeader := r.Header.Get("Authorization")
 	log.Printf("Authorization Header: %s", authHeader)
 	
@@ -135,75 +212,270 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 		log.Printf("エラー: Bearer token認証失敗")
 		log.Printf("Expected token: [REDACTED] (length: %d)", len(expectedToken))
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
+		return false
 	}
 	
 	log.Printf("✅ Bearer token認証成功")
+	return true
+}
 
-	// データベース接続確認
+// databaseReady function: データベース接続が設定済みか確認し、未設定時は500を返す
+func databaseReady(w http.ResponseWriter) bool {
 	if db == nil {
 		log.Printf("エラー: データベース接続が設定されていません")
 		http.Error(w, "Database not configured", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// writeJSON function: JSONレスポンスを書き込む
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// inSavepoint function: fn をセーブポイント内で実行し、fn が失敗した場合はその変更だけを取り消す
+// 1件ごとの処理の失敗を記録して続行する場合に、途中まで書き込んだ変更をコミットしないため。
+// fn のエラーは itemErr、セーブポイント自体の操作に失敗した場合は err で返す（リクエスト全体を失敗させる）
+func inSavepoint(tx *sql.Tx, fn func() error) (itemErr error, err error) {
+	if _, err := tx.Exec("SAVEPOINT item"); err != nil {
+		return nil, fmt.Errorf("セーブポイント作成エラー: %v", err)
+	}
+	if itemErr = fn(); itemErr != nil {
+		if _, err := tx.Exec("ROLLBACK TO item"); err != nil {
+			return itemErr, fmt.Errorf("セーブポイントへのロールバックエラー: %v", err)
+		}
+	}
+	if _, err := tx.Exec("RELEASE item"); err != nil {
+		return itemErr, fmt.Errorf("セーブポイント解放エラー: %v", err)
+	}
+	return itemErr, nil
+}
+
+// statusHandler function: handles dangerous device status updates.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("=== 危険機器ステータス更新開始 ===")
+	log.Printf("リクエスト時刻: %s", time.Now().Format("2006-01-02 15:04:05"))
+	log.Printf("リクエスト元IP: %s", r.RemoteAddr)
+	log.Printf("リクエストメソッド: %s", r.Method)
+	log.Printf("Content-Type: %s", r.Header.Get("Content-Type"))
+	log.Printf("User-Agent: %s", r.Header.Get("User-Agent"))
+	
+	// Ensure the request method is POST.
+	if r.Method != http.MethodPost {
+		log.Printf("エラー: 無効なリクエストメソッド - %s", r.Method)
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
 	}
 
+	// Bearer token認証のチェック
+	if !authorizeRequest(w, r) {
+		return
+	}
+
+	// データベース接続確認
+	if !databaseReady(w) {
+		return
+	}
+
+	// 同じ Idempotency-Key の再送には保存済みのレスポンスを返す（機器の更新・危険判定の解除を再実行しない）
+	w, finishIdempotent, replayed := beginIdempotent(w, r, "/status")
+	if replayed {
+		return
+	}
+	defer finishIdempotent()
+
 	// JSONデータのパース
 	log.Printf("危険機器JSONデータのパース開始...")
 	statusData := parseStatusJSON(w, r)
-	if len(statusData.Devices) == 0 {
+	if len(statusData.Observations) == 0 {
 		log.Printf("警告: 危険機器データが空です")
 		return
 	}
 
-	log.Printf("受信した危険機器数: %d", len(statusData.Devices))
+	log.Printf("受信した危険機器数: %d (v%d, Scan ID: %s)", len(statusData.Observations), statusData.Version, statusData.ScanID)
 
-	// まず全ての機器を安全に設定
-	_, err := db.Exec("UPDATE device SET is_dangerous = FALSE")
+	// MACアドレス・IPアドレスを検証して正規化（不正な機器は個別にエラーとして返す）
+	observations, itemErrors := validateObservations(statusData.Observations)
+	for _, e := range itemErrors {
+		log.Printf("  ❌ 不正な危険機器データ (Key: %s): %s", e.Key, e.Error)
+	}
+
+	// 危険判定モード（?mode= で1回分だけ上書き可能）
+	policy := loadDangerPolicy()
+	if mode := r.URL.Query().Get("mode"); mode != "" {
+		if mode != DangerModeIncremental && mode != DangerModeReplace {
+			http.Error(w, "mode must be incremental or replace", http.StatusBadRequest)
+			return
+		}
+		policy.Mode = mode
+	}
+	log.Printf("危険判定モード: %s", policy.Mode)
+
+	now := nowTimestamp()
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("エラー: トランザクション開始に失敗: %v", err)
+		http.Error(w, "Database update failed", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var clearedCount int
+	if policy.Mode == DangerModeReplace {
+		// 今回報告されなかった機器の kern.log 由来の危険判定を解除（ARP監視など他の発生元の判定は保持）
+		// 受け付けた機器が1台もない場合は、不正なデータで全機器の判定を解除しないよう置き換えを行わない
+		if len(observations) > 0 {
+			reported := map[string]bool{}
+			for _, deviceData := range observations {
+				reported[deviceData.MAC] = true
+			}
+			clearedCount, err = clearUnreportedKernLogDangers(tx, reported, now)
+		} else {
+			log.Printf("警告: 受け付けた危険機器がないため kern.log 由来の危険判定の置き換えを行いません")
+		}
+		if err == nil {
+			// 検知ルール・ARP由来の判定は置き換えの対象外のため、TTLで解除する
+			var expired int
+			expired, err = policy.expireDangers(tx, now)
+			clearedCount += expired
+		}
+	} else {
+		// TTLの間報告のなかった kern.log 由来の危険判定のみ解除
+		clearedCount, err = policy.expireDangers(tx, now)
+	}
 	if err != nil {
-		log.Printf("エラー: 全機器の安全設定に失敗: %v", err)
+		log.Printf("エラー: kern.log 由来の危険判定の解除に失敗: %v", err)
 		http.Error(w, "Database update failed", http.StatusInternalServerError)
 		return
 	}
-	log.Printf("✅ 全機器を安全に設定しました")
+	log.Printf("✅ kern.log 由来の危険判定を解除しました (%d件)", clearedCount)
 
-	// 指定された機器を危険に設定
+	// 指定された機器を危険に設定（1エントリ = 1ヒットとして証跡とともに記録）
 	dangerousCount := 0
+	pendingCount := 0
+	trustedCount := 0
 	notFoundCount := 0
-	
-	for deviceKey, deviceData := range statusData.Devices {
+	registered := map[string]bool{}
+
+	for _, deviceData := range observations {
+		deviceKey := deviceData.Key
 		log.Printf("--- 危険機器処理開始 (Key: %s) ---", deviceKey)
-		log.Printf("  MAC Address: %s", deviceData.MAC.Key)
-		log.Printf("  IP Address: %s", deviceData.IP.Key)
+		log.Printf("  MAC Address: %s", deviceData.MAC)
+		log.Printf("  IP Address: %s", deviceData.IP())
+
+		// MAC アドレスで機器を検索
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM device WHERE mac_address = ?)", deviceData.MAC).Scan(&exists); err != nil {
+			log.Printf("  ❌ 機器存在確認エラー: %v", err)
+			itemErrors = append(itemErrors, itemError{Key: deviceKey, Error: "database error"})
+			continue
+		}
+		if !exists {
+			log.Printf("  ⚠️ 機器が見つかりません (MAC: %s)", deviceData.MAC)
+			notFoundCount++
+			continue
+		}
+		registered[deviceData.MAC] = true
 
-		// MAC アドレスで機器を検索して危険フラグを設定
-		result, err := db.Exec("UPDATE device SET is_dangerous = TRUE WHERE mac_address = ?", deviceData.MAC.Key)
+		hit := dangerHit{
+			Source:   DangerSourceKernLog,
+			Severity: SeverityMedium,
+			Reason:   fmt.Sprintf("kern.log で不審な通信を検知しました (IP: %s)", deviceData.IP()),
+			Evidence: []string{deviceData.Log},
+		}
+		// 1件の失敗で他の機器の判定を止めないよう、失敗した機器の変更だけを取り消して続行する
+		var state string
+		var trusted bool
+		itemErr, err := inSavepoint(tx, func() error {
+			var err error
+			if state, err = policy.applyHit(tx, deviceData.MAC, hit, now); err != nil {
+				return fmt.Errorf("危険フラグ設定エラー: %v", err)
+			}
+			// 手動で信頼済みに設定された機器はヒットを記録するだけで危険にしない
+			trusted, err = deviceTrusted(tx, deviceData.MAC, now)
+			return err
+		})
 		if err != nil {
-			log.Printf("  ❌ 危険フラグ設定エラー: %v", err)
+			log.Printf("❌ %v", err)
+			http.Error(w, "Database update failed", http.StatusInternalServerError)
+			return
+		}
+		if itemErr != nil {
+			log.Printf("  ❌ %v", itemErr)
+			itemErrors = append(itemErrors, itemError{Key: deviceKey, Error: "database error"})
 			continue
 		}
-
-		rowsAffected, _ := result.RowsAffected()
-		if rowsAffected > 0 {
+		if trusted {
+			log.Printf("  🔒 信頼済みに設定されているため危険にしません（ヒットのみ記録）")
+			trustedCount++
+		} else if state == DangerStateActive {
 			log.Printf("  ✅ 危険フラグ設定成功")
 			dangerousCount++
 		} else {
-			log.Printf("  ⚠️ 機器が見つかりません (MAC: %s)", deviceData.MAC.Key)
-			notFoundCount++
+			log.Printf("  ⏳ ヒットを記録しました（危険判定の閾値未満）")
+			pendingCount++
 		}
 		log.Printf("--- 危険機器処理完了 (Key: %s) ---", deviceKey)
 	}
 
+	// 証跡の netfilter のログ行を通信記録として保存し、スキャン検知（ポートスキャン・横展開）を行う
+	sensorID := statusData.SensorID
+	if sensorID == "" {
+		sensorID = sensorIDFromRequest(r)
+	}
+	latestByMAC, err := insertFlows(tx, statusFlows(observations, sensorID, now))
+	if err != nil {
+		log.Printf("❌ %v", err)
+		http.Error(w, "Database update failed", http.StatusInternalServerError)
+		return
+	}
+	scanConfig := loadScanDetectConfig()
+	detections := []ScanDetection{}
+	for _, mac := range sortedKeys(latestByMAC) {
+		if !registered[mac] {
+			continue
+		}
+		found, _, err := scanConfig.raiseScans(tx, policy, mac, latestByMAC[mac], now)
+		if err != nil {
+			log.Printf("  ❌ %v", err)
+			http.Error(w, "Database update failed", http.StatusInternalServerError)
+			return
+		}
+		detections = append(detections, found...)
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("エラー: コミットに失敗: %v", err)
+		http.Error(w, "Database update failed", http.StatusInternalServerError)
+		return
+	}
+
 	log.Printf("危険機器処理結果サマリー:")
 	log.Printf("  危険設定成功: %d件", dangerousCount)
+	log.Printf("  閾値未満: %d件", pendingCount)
+	log.Printf("  信頼済み: %d件", trustedCount)
+	log.Printf("  解除: %d件", clearedCount)
 	log.Printf("  機器未発見: %d件", notFoundCount)
-	log.Printf("  処理対象: %d件", len(statusData.Devices))
+	log.Printf("  エラー: %d件", len(itemErrors))
+	log.Printf("  処理対象: %d件", len(statusData.Observations))
 
 	// レスポンスを返す
 	response := map[string]interface{}{
 		"status":           "success",
 		"message":          "危険機器ステータスを正常に更新しました",
-		"processed":        len(statusData.Devices),
+		"processed":        len(statusData.Observations),
+		"error_count":      len(itemErrors),
+		"errors":           itemErrors,
+		"version":          statusData.Version,
 		"dangerous_count":  dangerousCount,
+		"pending_count":    pendingCount,
+		"trusted_count":    trustedCount,
+		"cleared_count":    clearedCount,
+		"scan_detections":  detections,
+		"mode":             policy.Mode,
 		"not_found_count":  notFoundCount,
 		"timestamp":        time.Now().Format("2006-01-02 15:04:05"),
 	}
@@ -232,78 +504,104 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Bearer token認証のチェック
-	authHeader := r.Header.Get("Authorization")
-	log.Printf("Authorization Header: %s", authHeader)
-	
-	// 環境変数からトークンを取得
-	expectedToken := os.Getenv("NET_TOKEN")
-	
-	// 環境変数が設定されていない場合のデフォルト値
-	if expectedToken == "" {
-		expectedToken = "default-secret-token"  // デフォルトトークン
-		log.Printf("警告: NET_TOKEN環境変数が設定されていません。デフォルトトークンを使用します")
-	}
-	
-	if !bearerAuth(expectedToken, authHeader) {
-		log.Printf("エラー: Bearer token認証失敗")
-		log.Printf("Expected token: [REDACTED] (length: %d)", len(expectedToken))
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	if !authorizeRequest(w, r) {
 		return
 	}
-	
-	log.Printf("✅ Bearer token認証成功")
 
 	// データベース接続確認
-	if db == nil {
-		log.Printf("エラー: データベース接続が設定されていません")
-		http.Error(w, "Database not configured", http.StatusInternalServerError)
+	if !databaseReady(w) {
 		return
 	}
 
+	// 同じ Idempotency-Key の再送には保存済みのレスポンスを返す（機器の更新・危険判定の解除を再実行しない）
+	w, finishIdempotent, replayed := beginIdempotent(w, r, "/upload")
+	if replayed {
+		return
+	}
+	defer finishIdempotent()
+
 	// Call the parseJSON function to handle the request.
 	log.Printf("JSONデータのパース開始...")
 	jsonData := parseJSON(w, r)
-	if len(jsonData.Devices) == 0 {
+	if len(jsonData.Observations) == 0 {
 		log.Printf("警告: デバイスデータが空です")
 		return
 	}
 
-	log.Printf("受信したデバイス数: %d", len(jsonData.Devices))
+	log.Printf("受信したデバイス数: %d (v%d)", len(jsonData.Observations), jsonData.Version)
+
+	// MACアドレス・IPアドレスを検証して正規化（不正な機器は個別にエラーとして返す）
+	observations, itemErrors := validateObservations(jsonData.Observations)
+	for _, e := range itemErrors {
+		log.Printf("  ❌ 不正なデバイスデータ (Key: %s): %s", e.Key, e.Error)
+	}
 
 	// Process and save devices to database
 	successCount := 0
-	errorCount := 0
+	seenAt := nowTimestamp()
+	macsByIP := map[string][]string{}
+	recordedEvents := scanEventSet{}
+
+	// 1回のアップロードを1つのスキャンセッションとして記録（v2 の sensor_id はヘッダーより優先）
+	sensorID := jsonData.SensorID
+	if sensorID == "" {
+		sensorID = sensorIDFromRequest(r)
+	}
+	session, err := startScanSession(sensorID, jsonData.ScanID, seenAt)
+	if err != nil {
+		log.Printf("❌ %v", err)
+		http.Error(w, "Database update failed", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("スキャンセッション開始 (ID: %d, Sensor: %s, Sensor Scan ID: %s)", session.ID, session.SensorID, session.SensorScanID)
 	
-	for deviceKey, deviceData := range jsonData.Devices {
+	for _, deviceData := range observations {
+		deviceKey := deviceData.Key
 		log.Printf("--- デバイス処理開始 (Key: %s) ---", deviceKey)
-		log.Printf("  MAC Address: %s", deviceData.MAC.Key)
-		log.Printf("  IP Address: %s", deviceData.IP.Key)
-		log.Printf("  Vendor: %s", deviceData.Vendor.Key)
+		log.Printf("  MAC Address: %s", deviceData.MAC)
+		log.Printf("  IP Address: %s", strings.Join(deviceData.IPs, ", "))
+		log.Printf("  Vendor: %s", deviceData.Vendor)
 
 		// データベースに挿入（危険フラグは既存の値を保持）
-		err := insertOrUpdateDevice(deviceData.MAC.Key, deviceData.IP.Key, deviceData.Vendor.Key)
+		err := insertOrUpdateDevice(session, deviceData, recordedEvents)
 		if err != nil {
 			log.Printf("  ❌ データベース挿入エラー: %v", err)
-			errorCount++
+			itemErrors = append(itemErrors, itemError{Key: deviceKey, Error: "database error"})
 		} else {
 			log.Printf("  ✅ データベース挿入成功")
 			successCount++
+			for _, ip := range deviceData.IPs {
+				macsByIP[ip] = append(macsByIP[ip], deviceData.MAC)
+			}
 		}
 		log.Printf("--- デバイス処理完了 (Key: %s) ---", deviceKey)
 	}
 
+	// 同一スキャン内のIP競合を記録
+	if err := recordScanConflicts(detectScanConflicts(macsByIP), recordedEvents, seenAt); err != nil {
+		log.Printf("❌ IP競合記録エラー: %v", err)
+	}
+
+	if err := finishScanSession(session, successCount); err != nil {
+		log.Printf("❌ %v", err)
+	}
+
 	log.Printf("処理結果サマリー:")
 	log.Printf("  成功: %d件", successCount)
-	log.Printf("  失敗: %d件", errorCount)
-	log.Printf("  合計: %d件", successCount + errorCount)
+	log.Printf("  失敗: %d件", len(itemErrors))
+	log.Printf("  合計: %d件", successCount + len(itemErrors))
 
 	// レスポンスを返す
 	response := map[string]interface{}{
 		"status":       "success",
 		"message":      "デバイスデータを正常に受信しました",
-		"processed":    len(jsonData.Devices),
+		"processed":    len(jsonData.Observations),
 		"success_count": successCount,
-		"error_count":   errorCount,
+		"error_count":   len(itemErrors),
+		"errors":        itemErrors,
+		"scan_id":       session.ID,
+		"sensor_scan_id": session.SensorScanID,
+		"version":       jsonData.Version,
 		"timestamp":    time.Now().Format("2006-01-02 15:04:05"),
 	}
 
@@ -314,56 +612,128 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("=== デバイスデータアップロード完了 ===\n")
 }
 
-// insertOrUpdateDevice function: データベースにデバイス情報を挿入または更新
-func insertOrUpdateDevice(macAddress, ipAddress, vendor string) error {
+// insertOrUpdateDevice function: データベースにデバイス情報を挿入または更新し、観測履歴とARPバインディングの変化を記録
+// 検出日時はセンサーの観測日時（observed_at）を使う。recorded は同じスキャンで記録済みのセキュリティイベント
+func insertOrUpdateDevice(session ScanSession, obs observation, recorded scanEventSet) error {
+	macAddress, ipAddress, vendor := obs.MAC, obs.IP(), obs.Vendor
+	now := obs.ObservedAt
+	if now == "" {
+		now = session.StartedAt
+	}
+
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("トランザクション開始エラー (MAC: %s): %v", macAddress, err)
+	}
+	defer tx.Rollback()
+
 	// 既存の機器かどうかをチェック
 	var exists bool
-	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM device WHERE mac_address = ?)", macAddress).Scan(&exists)
+	err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM device WHERE mac_address = ?)", macAddress).Scan(&exists)
 	if err != nil {
 		return fmt.Errorf("機器存在確認エラー (MAC: %s): %v", macAddress, err)
 	}
 
+	// 更新前の状態と比較してIP変化・IP競合・ゲートウェイMAC変化を検出
+	events, err := detectBindingChanges(tx, macAddress, obs.IPs, now)
+	if err != nil {
+		return err
+	}
+
+	// OUIと照合（ベンダーが報告されていなければOUIのベンダーで補完）
+	reportedVendor := vendor
+	check, err := checkVendor(tx, macAddress, reportedVendor)
+	if err != nil {
+		return err
+	}
+	vendor = check.Vendor
+
 	if exists {
-		// 既存機器の場合、is_dangerousを保持してIP、vendorのみ更新
-		query := `UPDATE device SET ip_address = ?, vendor = ? WHERE mac_address = ?`
-		_, err = db.Exec(query, ipAddress, vendor, macAddress)
+		// 既存機器の場合、is_dangerousを保持してIP、vendor、ホスト名、検出日時のみ更新
+		// first_seen は履歴導入前からある機器のみ今回の検出日時で埋める。
+		// spool から遅れて届いた古い観測で最新の状態を上書きしないよう、IP・ベンダー・ホスト名は last_seen 以降の観測のみ反映する
+		query := `UPDATE device SET
+			ip_address = CASE WHEN ? >= COALESCE(last_seen, '') THEN ? ELSE ip_address END,
+			vendor = CASE WHEN ? >= COALESCE(last_seen, '') THEN ? ELSE vendor END,
+			hostname = CASE WHEN ? >= COALESCE(last_seen, '') THEN COALESCE(NULLIF(?, ''), hostname) ELSE hostname END,
+			first_seen = COALESCE(first_seen, ?), last_seen = MAX(COALESCE(last_seen, ?), ?),
+			seen_count = COALESCE(seen_count, 0) + 1 WHERE mac_address = ?`
+		_, err = tx.Exec(query, now, ipAddress, now, vendor, now, obs.Hostname, now, now, now, macAddress)
 	} else {
-		// 新規機器の場合、is_dangerous = FALSEで挿入
-		query := `INSERT INTO device (mac_address, ip_address, vendor, is_dangerous) VALUES (?, ?, ?, FALSE)`
-		_, err = db.Exec(query, macAddress, ipAddress, vendor)
+		// 新規機器の場合、is_dangerous = FALSEで挿入（ホスト名が報告されなければ取り込み済みのDHCPリースから補完）
+		query := `INSERT INTO device (mac_address, ip_address, vendor, hostname, is_dangerous, first_seen, last_seen, seen_count)
+			VALUES (?, ?, ?, COALESCE(NULLIF(?, ''), (SELECT hostname FROM dhcp_lease WHERE mac_address = ? AND hostname IS NOT NULL
+				ORDER BY updated_at DESC LIMIT 1)), FALSE, ?, ?, 1)`
+		_, err = tx.Exec(query, macAddress, ipAddress, vendor, obs.Hostname, macAddress, now, now)
 	}
 	
 	if err != nil {
 		return fmt.Errorf("デバイス挿入/更新エラー (MAC: %s): %v", macAddress, err)
 	}
+
+	obs.Vendor = vendor
+	if err := recordObservation(tx, session, obs); err != nil {
+		return err
+	}
+
+	// 報告されたすべてのIPアドレス（IPv4 の別名・IPv6 を含む）を記録
+	if err := recordAddresses(tx, macAddress, obs.IPs, now); err != nil {
+		return err
+	}
+
+	if err := recordVendorCheck(tx, macAddress, ipAddress, reportedVendor, check, now); err != nil {
+		return err
+	}
+
+	// 登録済み機器一覧と照合（kern.log 由来の危険フラグとは別に管理）
+	if err := refreshUnknownFlag(tx, macAddress, now); err != nil {
+		return err
+	}
+
+	// コミットに失敗した場合は記録済みにしないよう、コピーで重複を除いてからコミット後に反映する
+	pending := scanEventSet{}
+	for key := range recorded {
+		pending[key] = true
+	}
+	for _, event := range pending.filter(events) {
+		if err := recordSecurityEvent(tx, event, now); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("コミットエラー (MAC: %s): %v", macAddress, err)
+	}
+	for key := range pending {
+		recorded[key] = true
+	}
 	
 	return nil
 }
 
-// parseJSON function: parses JSON requests.
-func parseJSON(w http.ResponseWriter, r *http.Request) JSON {
-	var data JSON
-	
-	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+// parseJSON function: parses JSON requests（v1 の devices マップと v2 の observations 配列）.
+func parseJSON(w http.ResponseWriter, r *http.Request) ingestBatch {
+	data, err := decodeIngestBatch(r, false)
+	if err != nil {
 		log.Printf("❌ JSONパースエラー: %v", err)
 		http.Error(w, fmt.Sprintf("Invalid JSON data: %v", err), http.StatusBadRequest)
-		return JSON{}
+		return ingestBatch{}
 	}
 
 	log.Printf("✅ JSONパース成功")
 	return data
 }
 
-// parseStatusJSON function: parses status JSON requests.
-func parseStatusJSON(w http.ResponseWriter, r *http.Request) StatusJSON {
-	var data StatusJSON
-	
-	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+// parseStatusJSON function: parses status JSON requests（v1 の devices マップと v2 の observations 配列）.
+func parseStatusJSON(w http.ResponseWriter, r *http.Request) ingestBatch {
+	data, err := decodeIngestBatch(r, true)
+	if err != nil {
 		log.Printf("❌ 危険機器JSONパースエラー: %v", err)
 		http.Error(w, fmt.Sprintf("Invalid JSON data: %v", err), http.StatusBadRequest)
-		return StatusJSON{}
+		return ingestBatch{}
 	}
 
 	log.Printf("✅ 危険機器JSONパース成功")
 	return data
-}
\ No newline at end of file
+}
@@ -0,0 +1,57 @@
+package backend
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestInSavepoint(t *testing.T) {
+	database := openTestDatabase(t)
+	tx, err := database.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	insert := func(mac string) error {
+		_, err := tx.Exec("INSERT INTO danger_hit (mac_address, source, hit_at) VALUES (?, 'kernlog', '2026-10-18 10:00:00')", mac)
+		return err
+	}
+	if itemErr, err := inSavepoint(tx, func() error { return insert("aa:bb:cc:00:00:01") }); itemErr != nil || err != nil {
+		t.Fatalf("inSavepoint(ok) = %v, %v", itemErr, err)
+	}
+	failed := errors.New("item failed")
+	itemErr, err := inSavepoint(tx, func() error {
+		if err := insert("aa:bb:cc:00:00:02"); err != nil {
+			return err
+		}
+		return failed
+	})
+	if itemErr != failed || err != nil {
+		t.Fatalf("inSavepoint(failing) = %v, %v, want %v, nil", itemErr, err, failed)
+	}
+	if itemErr, err := inSavepoint(tx, func() error { return insert("aa:bb:cc:00:00:03") }); itemErr != nil || err != nil {
+		t.Fatalf("inSavepoint(after failure) = %v, %v", itemErr, err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 失敗した項目の変更だけが取り消され、前後の項目の変更はコミットされる
+	rows, err := database.Query("SELECT mac_address FROM danger_hit ORDER BY mac_address")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got []string
+	for rows.Next() {
+		var mac string
+		if err := rows.Scan(&mac); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, mac)
+	}
+	if len(got) != 2 || got[0] != "aa:bb:cc:00:00:01" || got[1] != "aa:bb:cc:00:00:03" {
+		t.Errorf("committed hits = %v, want aa:bb:cc:00:00:01 and aa:bb:cc:00:00:03", got)
+	}
+}
@@ -0,0 +1,358 @@
+package backend
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// 危険判定の発生元 (device_danger.source)
+const (
+	DangerSourceKernLog = "kernlog" // kern.log の [LAN_TCP_SYN]/[LAN_UDP] (/status)
+	DangerSourceARP     = "arp"     // ARPバインディング監視 (/upload)
+	DangerSourceRule    = "rule"    // 通信記録に対するポートスキャン・横展開の検知 (/api/v1/netfilter)
+	DangerSourceManual  = "manual"  // オペレーターによる手動判定 (/api/v1/devices/{mac}/override)
+)
+
+// 危険度 (device_danger.severity)
+const (
+	SeverityLow      = "low"
+	SeverityMedium   = "medium"
+	SeverityHigh     = "high"
+	SeverityCritical = "critical"
+)
+
+// 危険判定の状態 (device_danger.state)
+const (
+	DangerStatePending = "pending" // ヒットはあるが危険とするにはまだ足りない（incremental モード）
+	DangerStateActive  = "active"
+	DangerStateCleared = "cleared"
+)
+
+// maxEvidenceLines: 1件の危険判定に保持する証跡行の上限（古いものから削除）
+const maxEvidenceLines = 20
+
+// severityRank: 危険度の大小比較用
+var severityRank = map[string]int{
+	SeverityLow:      1,
+	SeverityMedium:   2,
+	SeverityHigh:     3,
+	SeverityCritical: 4,
+}
+
+// DangerRecord type: device_danger テーブルの1行（機器ごと・発生元ごとの危険判定）を表す
+type DangerRecord struct {
+	MACAddress string   `json:"mac_address"`
+	Source     string   `json:"source"`
+	Severity   string   `json:"severity"`
+	Reason     string   `json:"reason"`
+	HitCount   int      `json:"hit_count"`
+	Evidence   []string `json:"evidence"`
+	State      string   `json:"state"`
+	FlaggedAt  string   `json:"flagged_at"`
+	LastHitAt  string   `json:"last_hit_at"`
+	ClearedAt  string   `json:"cleared_at,omitempty"`
+}
+
+// DangerTransition type: danger_transition テーブルの1行（危険判定の状態の遷移）を表す
+type DangerTransition struct {
+	ID             int64  `json:"id"`
+	MACAddress     string `json:"mac_address"`
+	Source         string `json:"source"`
+	FromState      string `json:"from_state"` // 初めての判定は空
+	ToState        string `json:"to_state"`
+	Severity       string `json:"severity"`
+	Reason         string `json:"reason"`
+	TransitionedAt string `json:"transitioned_at"`
+}
+
+// dangerHit type: 危険判定1件分の入力
+type dangerHit struct {
+	Source   string
+	Severity string
+	Reason   string
+	Evidence []string
+}
+
+// raiseDanger function: 危険判定を有効にする
+// 同じ発生元の判定が有効（または保留中）の間はヒット数と証跡を積み上げ、解除済み・未登録の場合は新たに有効化する
+func raiseDanger(tx *sql.Tx, macAddress string, hit dangerHit, at string) error {
+	return upsertDanger(tx, macAddress, hit, at, DangerStateActive)
+}
+
+// upsertDanger function: 危険判定を指定の状態（active / pending）で記録
+func upsertDanger(tx *sql.Tx, macAddress string, hit dangerHit, at, newState string) error {
+	var state, severity, evidenceJSON, flaggedAt string
+	err := tx.QueryRow(`SELECT state, severity, COALESCE(evidence, '[]'), flagged_at FROM device_danger WHERE mac_address = ? AND source = ?`,
+		macAddress, hit.Source).Scan(&state, &severity, &evidenceJSON, &flaggedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("危険判定取得エラー (MAC: %s): %v", macAddress, err)
+	}
+
+	if err == nil && (state == DangerStateActive || state == DangerStatePending) {
+		var evidence []string
+		json.Unmarshal([]byte(evidenceJSON), &evidence)
+		evidence = appendEvidence(evidence, hit.Evidence)
+		if severityRank[severity] > severityRank[hit.Severity] {
+			hit.Severity = severity
+		}
+		// 保留中から有効になった時点を「危険と判定された日時」とする
+		if state != newState {
+			flaggedAt = at
+		}
+		_, err = tx.Exec(`UPDATE device_danger SET severity = ?, reason = ?, hit_count = hit_count + 1, evidence = ?, state = ?,
+			flagged_at = ?, last_hit_at = ? WHERE mac_address = ? AND source = ?`,
+			hit.Severity, hit.Reason, encodeEvidence(evidence), newState, flaggedAt, at, macAddress, hit.Source)
+	} else {
+		_, err = tx.Exec(`INSERT INTO device_danger (mac_address, source, severity, reason, hit_count, evidence, state, flagged_at, last_hit_at, cleared_at)
+			VALUES (?, ?, ?, ?, 1, ?, ?, ?, ?, NULL)
+			ON CONFLICT (mac_address, source) DO UPDATE SET severity = excluded.severity, reason = excluded.reason, hit_count = 1,
+				evidence = excluded.evidence, state = excluded.state, flagged_at = excluded.flagged_at,
+				last_hit_at = excluded.last_hit_at, cleared_at = NULL`,
+			macAddress, hit.Source, hit.Severity, hit.Reason, encodeEvidence(appendEvidence(nil, hit.Evidence)), newState, at, at)
+	}
+	if err != nil {
+		return fmt.Errorf("危険判定記録エラー (MAC: %s): %v", macAddress, err)
+	}
+	if state != newState {
+		if err := recordDangerTransition(tx, macAddress, hit.Source, state, newState, hit.Severity, hit.Reason, at); err != nil {
+			return err
+		}
+	}
+	if err := refreshDangerFlag(tx, macAddress, at); err != nil {
+		return err
+	}
+	if newState != DangerStateActive {
+		return nil
+	}
+	// 信頼済みに設定された機器はヒットを記録するだけでインシデントにしない
+	if trusted, err := deviceTrusted(tx, macAddress, at); err != nil || trusted {
+		return err
+	}
+	return recordIncidentHit(tx, macAddress, hit, at)
+}
+
+// clearDanger function: 指定した発生元の有効（または保留中）な危険判定を解除
+func clearDanger(tx *sql.Tx, macAddress, source, at string) error {
+	var state, severity, reason string
+	err := tx.QueryRow(`SELECT state, severity, COALESCE(reason, '') FROM device_danger WHERE mac_address = ? AND source = ? AND state IN (?, ?)`,
+		macAddress, source, DangerStateActive, DangerStatePending).Scan(&state, &severity, &reason)
+	if err == sql.ErrNoRows {
+		return refreshDangerFlag(tx, macAddress, at)
+	} else if err != nil {
+		return fmt.Errorf("危険判定取得エラー (MAC: %s): %v", macAddress, err)
+	}
+
+	_, err = tx.Exec(`UPDATE device_danger SET state = ?, cleared_at = ? WHERE mac_address = ? AND source = ?`,
+		DangerStateCleared, at, macAddress, source)
+	if err != nil {
+		return fmt.Errorf("危険判定解除エラー (MAC: %s): %v", macAddress, err)
+	}
+	if err := recordDangerTransition(tx, macAddress, source, state, DangerStateCleared, severity, reason, at); err != nil {
+		return err
+	}
+	return refreshDangerFlag(tx, macAddress, at)
+}
+
+// recordDangerTransition function: 危険判定の状態の遷移を記録（from が空なら初めての判定）
+func recordDangerTransition(tx *sql.Tx, macAddress, source, from, to, severity, reason, at string) error {
+	_, err := tx.Exec(`INSERT INTO danger_transition (mac_address, source, from_state, to_state, severity, reason, transitioned_at)
+		VALUES (?, ?, NULLIF(?, ''), ?, ?, ?, ?)`, macAddress, source, from, to, severity, reason, at)
+	if err != nil {
+		return fmt.Errorf("危険判定の遷移記録エラー (MAC: %s): %v", macAddress, err)
+	}
+	return nil
+}
+
+// queryDangerTransitions function: 機器の危険判定の遷移を古い順に取得
+func queryDangerTransitions(macAddress string) ([]DangerTransition, error) {
+	rows, err := db.Query(`SELECT id, mac_address, source, COALESCE(from_state, ''), to_state, COALESCE(severity, ''), COALESCE(reason, ''), transitioned_at
+		FROM danger_transition WHERE mac_address = ? ORDER BY transitioned_at, id`, macAddress)
+	if err != nil {
+		return nil, fmt.Errorf("危険判定の遷移取得エラー: %v", err)
+	}
+	defer rows.Close()
+
+	transitions := []DangerTransition{}
+	for rows.Next() {
+		var t DangerTransition
+		if err := rows.Scan(&t.ID, &t.MACAddress, &t.Source, &t.FromState, &t.ToState, &t.Severity, &t.Reason, &t.TransitionedAt); err != nil {
+			return nil, fmt.Errorf("危険判定の遷移読み込みエラー: %v", err)
+		}
+		transitions = append(transitions, t)
+	}
+	return transitions, rows.Err()
+}
+
+// clearUnreportedKernLogDangers function: 今回の /status で報告されなかった機器の kern.log 由来の危険判定を解除
+func clearUnreportedKernLogDangers(tx *sql.Tx, reported map[string]bool, at string) (int, error) {
+	rows, err := tx.Query("SELECT mac_address FROM device_danger WHERE source = ? AND state = ?", DangerSourceKernLog, DangerStateActive)
+	if err != nil {
+		return 0, fmt.Errorf("危険判定取得エラー: %v", err)
+	}
+	var targets []string
+	for rows.Next() {
+		var mac string
+		if err := rows.Scan(&mac); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("危険判定読み込みエラー: %v", err)
+		}
+		if !reported[mac] {
+			targets = append(targets, mac)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, mac := range targets {
+		if err := clearDanger(tx, mac, DangerSourceKernLog, at); err != nil {
+			return 0, err
+		}
+	}
+	return len(targets), nil
+}
+
+// refreshDangerFlag function: 有効な危険判定の有無を device.is_dangerous に反映（手動で信頼済みに設定された機器は危険にしない）
+// 安全→危険でインシデントを作成し、危険→安全で未解決のインシデントを自動解決する
+func refreshDangerFlag(tx *sql.Tx, macAddress, at string) error {
+	var wasDangerous, isDangerous bool
+	err := tx.QueryRow(`SELECT COALESCE(is_dangerous, FALSE), EXISTS(
+		SELECT 1 FROM device_danger WHERE mac_address = ? AND state = ?
+	) AND NOT EXISTS(
+		SELECT 1 FROM device_override WHERE mac_address = ? AND mode = ? AND (expires_at IS NULL OR expires_at > ?)
+	) FROM device WHERE mac_address = ?`, macAddress, DangerStateActive, macAddress, OverrideTrusted, at, macAddress).Scan(&wasDangerous, &isDangerous)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("危険フラグ取得エラー (MAC: %s): %v", macAddress, err)
+	}
+	if wasDangerous == isDangerous {
+		return nil
+	}
+
+	if _, err := tx.Exec("UPDATE device SET is_dangerous = ? WHERE mac_address = ?", isDangerous, macAddress); err != nil {
+		return fmt.Errorf("危険フラグ更新エラー (MAC: %s): %v", macAddress, err)
+	}
+	if isDangerous {
+		return openIncident(tx, macAddress, at)
+	}
+	return autoResolveIncidents(tx, macAddress, at)
+}
+
+// appendEvidence function: 証跡行を追加し、上限を超えた分は古いものから削除
+func appendEvidence(evidence, lines []string) []string {
+	for _, line := range lines {
+		if line != "" {
+			evidence = append(evidence, line)
+		}
+	}
+	if len(evidence) > maxEvidenceLines {
+		evidence = evidence[len(evidence)-maxEvidenceLines:]
+	}
+	return evidence
+}
+
+// encodeEvidence function: 証跡行をDB保存用のJSON配列文字列に変換
+func encodeEvidence(evidence []string) string {
+	if evidence == nil {
+		evidence = []string{}
+	}
+	data, _ := json.Marshal(evidence)
+	return string(data)
+}
+
+// queryDangers function: 条件に一致する危険判定を取得
+func queryDangers(where string, args ...interface{}) ([]DangerRecord, error) {
+	query := `SELECT mac_address, source, severity, COALESCE(reason, ''), hit_count, COALESCE(evidence, '[]'), state,
+		flagged_at, last_hit_at, COALESCE(cleared_at, '') FROM device_danger`
+	if where != "" {
+		query += " WHERE " + where
+	}
+	query += " ORDER BY last_hit_at DESC, mac_address, source"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("危険判定取得エラー: %v", err)
+	}
+	defer rows.Close()
+
+	dangers := []DangerRecord{}
+	for rows.Next() {
+		var d DangerRecord
+		var evidenceJSON string
+		if err := rows.Scan(&d.MACAddress, &d.Source, &d.Severity, &d.Reason, &d.HitCount, &evidenceJSON, &d.State,
+			&d.FlaggedAt, &d.LastHitAt, &d.ClearedAt); err != nil {
+			return nil, fmt.Errorf("危険判定読み込みエラー: %v", err)
+		}
+		d.Evidence = []string{}
+		json.Unmarshal([]byte(evidenceJSON), &d.Evidence)
+		dangers = append(dangers, d)
+	}
+	return dangers, rows.Err()
+}
+
+// ActiveDangers function: 有効な危険判定をMACアドレスごとにまとめて返す（ダッシュボード表示用）
+func ActiveDangers() (map[string][]DangerRecord, error) {
+	dangers, err := queryDangers("state = ?", DangerStateActive)
+	if err != nil {
+		return nil, err
+	}
+	byMAC := map[string][]DangerRecord{}
+	for _, d := range dangers {
+		byMAC[d.MACAddress] = append(byMAC[d.MACAddress], d)
+	}
+	return byMAC, nil
+}
+
+// dangersHandler function: 危険判定の一覧を返す（既定は有効なもののみ）
+func dangersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeRequest(w, r) || !databaseReady(w) {
+		return
+	}
+
+	where := "1 = 1"
+	var args []interface{}
+	switch state := r.URL.Query().Get("state"); state {
+	case "", DangerStateActive:
+		where += " AND state = ?"
+		args = append(args, DangerStateActive)
+	case DangerStatePending, DangerStateCleared:
+		where += " AND state = ?"
+		args = append(args, state)
+	case "all":
+	default:
+		http.Error(w, "state must be active, pending, cleared or all", http.StatusBadRequest)
+		return
+	}
+	if mac := r.URL.Query().Get("mac"); mac != "" {
+		where += " AND mac_address = ?"
+		args = append(args, macFilter(mac))
+	}
+	if source := r.URL.Query().Get("source"); source != "" {
+		where += " AND source = ?"
+		args = append(args, source)
+	}
+
+	dangers, err := queryDangers(where, args...)
+	if err != nil {
+		log.Printf("❌ %v", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":    "success",
+		"count":     len(dangers),
+		"dangers":   dangers,
+		"timestamp": time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
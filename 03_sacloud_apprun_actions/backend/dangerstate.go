@@ -0,0 +1,191 @@
+package backend
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// /status の危険判定モード
+const (
+	// DangerModeIncremental: K回以上のヒットで危険とし、TTLの間ヒットがなければ解除する
+	DangerModeIncremental = "incremental"
+	// DangerModeReplace: 毎回の /status の内容で kern.log 由来の危険判定を置き換える（従来の動作）
+	DangerModeReplace = "replace"
+)
+
+// incremental モードのデフォルト値
+const (
+	defaultDangerTTLMinutes         = 15
+	defaultDangerRaiseHits          = 3
+	defaultDangerRaiseWindowMinutes = 5
+)
+
+// defaultARPDangerTTLMinutes: ARPバインディング監視由来の危険判定を、同じイベントが再発しなければ解除するまでの時間のデフォルト値
+const defaultARPDangerTTLMinutes = 24 * 60
+
+// dangerExpiryInterval: 期限切れの危険判定を解除するバックグラウンド処理の実行間隔
+const dangerExpiryInterval = time.Minute
+
+// dangerPolicy type: /status で報告されたヒットから危険判定を決める設定
+type dangerPolicy struct {
+	Mode        string
+	TTL         time.Duration // 最後のヒットからこの期間報告がなければ解除
+	RaiseHits   int           // RaiseWindow 内にこの回数以上ヒットしたら危険とする
+	RaiseWindow time.Duration
+	ARPTTL      time.Duration // ARPバインディング監視由来の危険判定は、最後のイベントからこの期間で解除
+}
+
+// loadDangerPolicy function: 環境変数 DANGER_MODE / DANGER_TTL_MINUTES / DANGER_RAISE_HITS / DANGER_RAISE_WINDOW_MINUTES / ARP_DANGER_TTL_MINUTES から設定を読み込む
+// DANGER_MODE の未設定時は従来どおり replace モードとし、incremental モードは明示した場合のみ使う
+func loadDangerPolicy() dangerPolicy {
+	mode := os.Getenv("DANGER_MODE")
+	switch mode {
+	case DangerModeIncremental, DangerModeReplace:
+	case "":
+		mode = DangerModeReplace
+	default:
+		log.Printf("警告: DANGER_MODE の値が不正です (%q)。%s モードを使用します", mode, DangerModeReplace)
+		mode = DangerModeReplace
+	}
+	return dangerPolicy{
+		Mode:        mode,
+		TTL:         time.Duration(envInt("DANGER_TTL_MINUTES", defaultDangerTTLMinutes)) * time.Minute,
+		RaiseHits:   envInt("DANGER_RAISE_HITS", defaultDangerRaiseHits),
+		RaiseWindow: time.Duration(envInt("DANGER_RAISE_WINDOW_MINUTES", defaultDangerRaiseWindowMinutes)) * time.Minute,
+		ARPTTL:      time.Duration(envInt("ARP_DANGER_TTL_MINUTES", defaultARPDangerTTLMinutes)) * time.Minute,
+	}
+}
+
+// applyHit function: ヒット1件をモードに従って危険判定に反映し、反映後の状態を返す
+func (p dangerPolicy) applyHit(tx *sql.Tx, macAddress string, hit dangerHit, at string) (string, error) {
+	if p.Mode == DangerModeReplace {
+		return DangerStateActive, raiseDanger(tx, macAddress, hit, at)
+	}
+
+	_, err := tx.Exec("INSERT INTO danger_hit (mac_address, source, hit_at) VALUES (?, ?, ?)", macAddress, hit.Source, at)
+	if err != nil {
+		return "", fmt.Errorf("ヒット記録エラー (MAC: %s): %v", macAddress, err)
+	}
+
+	// 既に危険と判定されている場合はヒットを積み上げるだけ
+	var state string
+	err = tx.QueryRow("SELECT state FROM device_danger WHERE mac_address = ? AND source = ?", macAddress, hit.Source).Scan(&state)
+	if err != nil && err != sql.ErrNoRows {
+		return "", fmt.Errorf("危険判定取得エラー (MAC: %s): %v", macAddress, err)
+	}
+	if state == DangerStateActive {
+		return DangerStateActive, raiseDanger(tx, macAddress, hit, at)
+	}
+
+	// ウィンドウ内のヒット数が閾値に達したら危険とする
+	windowStart := parseTimestamp(at).Add(-p.RaiseWindow).Format(timestampLayout)
+	var hits int
+	err = tx.QueryRow("SELECT COUNT(*) FROM danger_hit WHERE mac_address = ? AND source = ? AND hit_at > ?",
+		macAddress, hit.Source, windowStart).Scan(&hits)
+	if err != nil {
+		return "", fmt.Errorf("ヒット数取得エラー (MAC: %s): %v", macAddress, err)
+	}
+	if hits >= p.RaiseHits {
+		return DangerStateActive, raiseDanger(tx, macAddress, hit, at)
+	}
+	return DangerStatePending, upsertDanger(tx, macAddress, hit, at, DangerStatePending)
+}
+
+// expireDangers function: TTLの間ヒットがない kern.log・検知ルール由来の危険判定と、ウィンドウ外になった保留中の判定を解除
+// ARPバインディング監視由来の危険判定は ARPTTL の間イベントが再発しなければ解除する。
+// replace モードでは kern.log 由来の判定は /status ごとに置き換えるため対象外（検知ルール・ARP由来の判定はモードによらず解除する）
+func (p dangerPolicy) expireDangers(tx *sql.Tx, at string) (int, error) {
+	now := parseTimestamp(at)
+	activeCutoff := now.Add(-p.TTL).Format(timestampLayout)
+	pendingCutoff := now.Add(-p.RaiseWindow).Format(timestampLayout)
+	arpCutoff := now.Add(-p.ARPTTL).Format(timestampLayout)
+	ttlSources := [2]string{DangerSourceKernLog, DangerSourceRule}
+	if p.Mode == DangerModeReplace {
+		ttlSources[0] = DangerSourceRule
+	}
+
+	rows, err := tx.Query(`SELECT mac_address, source FROM device_danger WHERE
+		(source IN (?, ?) AND ((state = ? AND last_hit_at < ?) OR (state = ? AND last_hit_at <= ?)))
+		OR (source = ? AND state = ? AND last_hit_at < ?)`,
+		ttlSources[0], ttlSources[1], DangerStateActive, activeCutoff, DangerStatePending, pendingCutoff,
+		DangerSourceARP, DangerStateActive, arpCutoff)
+	if err != nil {
+		return 0, fmt.Errorf("期限切れ危険判定取得エラー: %v", err)
+	}
+	var targets [][2]string
+	for rows.Next() {
+		var mac, source string
+		if err := rows.Scan(&mac, &source); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("期限切れ危険判定読み込みエラー: %v", err)
+		}
+		targets = append(targets, [2]string{mac, source})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, target := range targets {
+		if err := clearDanger(tx, target[0], target[1], at); err != nil {
+			return 0, err
+		}
+	}
+
+	// ウィンドウ判定に使わなくなったヒットを削除
+	if _, err := tx.Exec("DELETE FROM danger_hit WHERE hit_at <= ?", pendingCutoff); err != nil {
+		return 0, fmt.Errorf("ヒット削除エラー: %v", err)
+	}
+	return len(targets), nil
+}
+
+// runDangerExpiry function: 期限切れの危険判定を1回解除
+func runDangerExpiry(p dangerPolicy) {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("❌ 危険判定の期限切れ処理: トランザクション開始エラー: %v", err)
+		return
+	}
+	defer tx.Rollback()
+
+	expired, err := p.expireDangers(tx, nowTimestamp())
+	if err != nil {
+		log.Printf("❌ 危険判定の期限切れ処理エラー: %v", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("❌ 危険判定の期限切れ処理: コミットエラー: %v", err)
+		return
+	}
+	if expired > 0 {
+		log.Printf("✅ 期限切れの危険判定を解除しました (%d件)", expired)
+	}
+}
+
+// startDangerExpiry function: 期限切れの危険判定を定期的に解除
+// センサーからの /status が止まっても危険判定が残り続けないようにする（replace モードでも検知ルール・ARP由来の判定は解除する）
+func startDangerExpiry() {
+	p := loadDangerPolicy()
+	log.Printf("危険判定モード: %s (TTL: %v, %v 以内に %d 回で危険, ARP: %v)", p.Mode, p.TTL, p.RaiseWindow, p.RaiseHits, p.ARPTTL)
+	go func() {
+		ticker := time.NewTicker(dangerExpiryInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if db != nil {
+				runDangerExpiry(p)
+			}
+		}
+	}()
+}
+
+// parseTimestamp function: DB保存用の日時文字列を time.Time に変換
+func parseTimestamp(value string) time.Time {
+	t, err := time.Parse(timestampLayout, value)
+	if err != nil {
+		return time.Now().UTC()
+	}
+	return t
+}
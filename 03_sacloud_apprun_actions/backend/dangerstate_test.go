@@ -0,0 +1,134 @@
+package backend
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// openTestDatabase function: 一時ディレクトリにマイグレーション済みのデータベースを作成
+func openTestDatabase(t *testing.T) *sql.DB {
+	t.Helper()
+	database, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	if _, err := Migrate(database); err != nil {
+		t.Fatal(err)
+	}
+	return database
+}
+
+// useTestDatabase function: ハンドラーが使うデータベースをテスト用のものに差し替える
+func useTestDatabase(t *testing.T) *sql.DB {
+	t.Helper()
+	database := openTestDatabase(t)
+	previous := db
+	db = database
+	t.Cleanup(func() { db = previous })
+	return database
+}
+
+func TestExpireDangers(t *testing.T) {
+	const at = "2026-10-15 12:00:00"
+	base := parseTimestamp(at)
+	ago := func(d time.Duration) string { return base.Add(-d).Format(timestampLayout) }
+
+	incremental := dangerPolicy{Mode: DangerModeIncremental, TTL: time.Hour, RaiseHits: 3, RaiseWindow: 10 * time.Minute, ARPTTL: 24 * time.Hour}
+	replace := incremental
+	replace.Mode = DangerModeReplace
+
+	tests := []struct {
+		name      string
+		policy    dangerPolicy
+		source    string
+		state     string
+		lastHitAt string
+		cleared   bool
+	}{
+		{name: "recent kernlog danger stays", policy: incremental, source: DangerSourceKernLog, state: DangerStateActive, lastHitAt: ago(30 * time.Minute)},
+		{name: "stale kernlog danger expires", policy: incremental, source: DangerSourceKernLog, state: DangerStateActive, lastHitAt: ago(2 * time.Hour), cleared: true},
+		{name: "stale kernlog danger stays in replace mode", policy: replace, source: DangerSourceKernLog, state: DangerStateActive, lastHitAt: ago(2 * time.Hour)},
+		{name: "stale rule danger expires", policy: incremental, source: DangerSourceRule, state: DangerStateActive, lastHitAt: ago(2 * time.Hour), cleared: true},
+		{name: "stale rule danger expires in replace mode", policy: replace, source: DangerSourceRule, state: DangerStateActive, lastHitAt: ago(2 * time.Hour), cleared: true},
+		{name: "recent pending hit stays", policy: incremental, source: DangerSourceKernLog, state: DangerStatePending, lastHitAt: ago(5 * time.Minute)},
+		{name: "pending hit outside the window expires", policy: incremental, source: DangerSourceRule, state: DangerStatePending, lastHitAt: ago(10 * time.Minute), cleared: true},
+		{name: "ARP danger within ARP TTL stays", policy: incremental, source: DangerSourceARP, state: DangerStateActive, lastHitAt: ago(2 * time.Hour)},
+		{name: "stale ARP danger expires", policy: incremental, source: DangerSourceARP, state: DangerStateActive, lastHitAt: ago(25 * time.Hour), cleared: true},
+		{name: "stale ARP danger expires in replace mode", policy: replace, source: DangerSourceARP, state: DangerStateActive, lastHitAt: ago(25 * time.Hour), cleared: true},
+		{name: "manual danger never expires", policy: incremental, source: DangerSourceManual, state: DangerStateActive, lastHitAt: ago(48 * time.Hour)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			database := openTestDatabase(t)
+			const mac = "aa:bb:cc:00:00:01"
+			if _, err := database.Exec(`INSERT INTO device (mac_address, ip_address, is_dangerous) VALUES (?, '192.168.1.10', ?)`,
+				mac, tt.state == DangerStateActive); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := database.Exec(`INSERT INTO device_danger (mac_address, source, severity, reason, state, flagged_at, last_hit_at)
+				VALUES (?, ?, 'high', 'test', ?, ?, ?)`, mac, tt.source, tt.state, tt.lastHitAt, tt.lastHitAt); err != nil {
+				t.Fatal(err)
+			}
+
+			tx, err := database.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			expired, err := tt.policy.expireDangers(tx, at)
+			if err != nil {
+				tx.Rollback()
+				t.Fatalf("expireDangers error: %v", err)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+
+			wantExpired, wantState, wantDangerous := 0, tt.state, tt.state == DangerStateActive
+			if tt.cleared {
+				wantExpired, wantState, wantDangerous = 1, DangerStateCleared, false
+			}
+			if expired != wantExpired {
+				t.Errorf("expired = %d, want %d", expired, wantExpired)
+			}
+			var state string
+			if err := database.QueryRow(`SELECT state FROM device_danger WHERE mac_address = ?`, mac).Scan(&state); err != nil {
+				t.Fatal(err)
+			}
+			if state != wantState {
+				t.Errorf("state = %q, want %q", state, wantState)
+			}
+			var dangerous bool
+			if err := database.QueryRow(`SELECT is_dangerous FROM device WHERE mac_address = ?`, mac).Scan(&dangerous); err != nil {
+				t.Fatal(err)
+			}
+			if dangerous != wantDangerous {
+				t.Errorf("is_dangerous = %v, want %v", dangerous, wantDangerous)
+			}
+		})
+	}
+}
+
+func TestLoadDangerPolicyMode(t *testing.T) {
+	tests := []struct {
+		env  string
+		want string
+	}{
+		{env: "", want: DangerModeReplace},
+		{env: "replace", want: DangerModeReplace},
+		{env: "incremental", want: DangerModeIncremental},
+		{env: "bogus", want: DangerModeReplace},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			t.Setenv("DANGER_MODE", tt.env)
+			if got := loadDangerPolicy().Mode; got != tt.want {
+				t.Errorf("loadDangerPolicy().Mode = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,417 @@
+package backend
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// リースファイルの形式
+const (
+	LeaseFormatDnsmasq = "dnsmasq" // dnsmasq.leases（1行1リース）
+	LeaseFormatISC     = "isc"     // ISC dhcpd の dhcpd.leases（lease { ... } ブロック）
+)
+
+// maxLeaseFileSize: 1リクエストで受け付けるリースファイルの上限
+const maxLeaseFileSize = 16 << 20
+
+// DHCPLease type: dhcp_lease テーブルの1行（MACアドレスとIPアドレスごとの最新のリース）
+type DHCPLease struct {
+	MACAddress string `json:"mac_address"`
+	IPAddress  string `json:"ip_address"`
+	Hostname   string `json:"hostname"`
+	ClientID   string `json:"client_id"`
+	ExpiresAt  string `json:"expires_at"` // 空は無期限
+	Source     string `json:"source"`
+	SensorID   string `json:"sensor_id"`
+	UpdatedAt  string `json:"updated_at"`
+}
+
+// leaseIngestRequest type: JSON で送る場合のリクエスト（text/plain の場合は本文がリースファイル、形式は ?format=）
+type leaseIngestRequest struct {
+	Format  string `json:"format"` // 省略時は内容から判定
+	Content string `json:"content"`
+}
+
+var (
+	// iscLeasePattern: ISC dhcpd の "lease 192.168.1.10 {"
+	iscLeasePattern = regexp.MustCompile(`^lease\s+(\S+)\s*\{`)
+	// iscTimePattern: "ends 4 2026/10/15 13:00:00;" / "ends epoch 1760533200;" / "ends never;"
+	iscTimePattern = regexp.MustCompile(`^(?:\d\s+(\d{4}/\d{2}/\d{2}\s+\d{2}:\d{2}:\d{2})|epoch\s+(\d+)|never)`)
+)
+
+// detectLeaseFormat function: リースファイルの内容から形式を判定
+func detectLeaseFormat(content string) string {
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if iscLeasePattern.MatchString(line) || strings.HasPrefix(line, "authoring-byte-order") || strings.HasPrefix(line, "server-duid") {
+			return LeaseFormatISC
+		}
+		return LeaseFormatDnsmasq
+	}
+	return LeaseFormatDnsmasq
+}
+
+// parseLeases function: リースファイルを形式に応じて解析（解析できない行・ブロックは errors に入れて読み飛ばす）
+func parseLeases(format, content string) ([]DHCPLease, []ingestError, error) {
+	switch format {
+	case LeaseFormatDnsmasq:
+		leases, errors := parseDnsmasqLeases(content)
+		return leases, errors, nil
+	case LeaseFormatISC:
+		leases, errors := parseISCLeases(content)
+		return leases, errors, nil
+	}
+	return nil, nil, fmt.Errorf("format must be %s or %s", LeaseFormatDnsmasq, LeaseFormatISC)
+}
+
+// parseDnsmasqLeases function: dnsmasq.leases を解析
+// 各行は "<期限(UNIX時刻, 0は無期限)> <MAC> <IP> <ホスト名|*> <client-id|*>"。
+// "duid" 行以降は MACアドレスを含まない DHCPv6 のリースのため読まない
+func parseDnsmasqLeases(content string) ([]DHCPLease, []ingestError) {
+	var leases []DHCPLease
+	errors := []ingestError{}
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "duid" {
+			break
+		}
+		if len(fields) < 4 {
+			errors = append(errors, ingestError{Line: lineNo, Error: "expected <expiry> <mac> <ip> <hostname> [<client-id>]"})
+			continue
+		}
+
+		lease := DHCPLease{Source: LeaseFormatDnsmasq}
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			errors = append(errors, ingestError{Line: lineNo, Error: fmt.Sprintf("invalid expiry: %q", fields[0])})
+			continue
+		}
+		if expiry > 0 {
+			lease.ExpiresAt = time.Unix(expiry, 0).UTC().Format(timestampLayout)
+		}
+		if lease.MACAddress, err = normalizeMAC(fields[1]); err != nil {
+			errors = append(errors, ingestError{Line: lineNo, Error: err.Error()})
+			continue
+		}
+		if lease.IPAddress, err = normalizeIP(fields[2]); err != nil {
+			errors = append(errors, ingestError{Line: lineNo, Error: err.Error()})
+			continue
+		}
+		if fields[3] != "*" {
+			lease.Hostname = fields[3]
+		}
+		if len(fields) > 4 && fields[4] != "*" {
+			lease.ClientID = strings.ToLower(fields[4])
+		}
+		leases = append(leases, lease)
+	}
+	return leases, errors
+}
+
+// parseISCLeases function: ISC dhcpd の dhcpd.leases を解析
+// 同じIPアドレスのブロックは追記順に並ぶため後のものを採用し、binding state が active でないリースは除く
+func parseISCLeases(content string) ([]DHCPLease, []ingestError) {
+	errors := []ingestError{}
+	byIP := map[string]int{}
+	var leases []DHCPLease
+
+	var current *DHCPLease
+	var startLine int
+	active := true
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), maxLeaseFileSize)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if current == nil {
+			if m := iscLeasePattern.FindStringSubmatch(line); m != nil {
+				current = &DHCPLease{Source: LeaseFormatISC, IPAddress: m[1]}
+				startLine = lineNo
+				active = true
+			}
+			continue
+		}
+
+		if line == "}" {
+			lease := *current
+			current = nil
+			ip, err := normalizeIP(lease.IPAddress)
+			if err != nil {
+				errors = append(errors, ingestError{Line: startLine, Error: err.Error()})
+				continue
+			}
+			lease.IPAddress = ip
+			if i, ok := byIP[ip]; ok {
+				// 古いブロックを取り除いて最新のブロックを採用する
+				leases[i] = DHCPLease{}
+			}
+			if !active {
+				delete(byIP, ip)
+				continue
+			}
+			if lease.MACAddress == "" {
+				errors = append(errors, ingestError{Line: startLine, Error: "hardware ethernet is missing"})
+				continue
+			}
+			byIP[ip] = len(leases)
+			leases = append(leases, lease)
+			continue
+		}
+
+		statement := strings.TrimSuffix(line, ";")
+		switch {
+		case strings.HasPrefix(statement, "binding state "):
+			active = strings.TrimPrefix(statement, "binding state ") == "active"
+		case strings.HasPrefix(statement, "hardware ethernet "):
+			mac, err := normalizeMAC(strings.TrimPrefix(statement, "hardware ethernet "))
+			if err != nil {
+				errors = append(errors, ingestError{Line: lineNo, Error: err.Error()})
+				continue
+			}
+			current.MACAddress = mac
+		case strings.HasPrefix(statement, "client-hostname "):
+			current.Hostname = unquoteISC(strings.TrimPrefix(statement, "client-hostname "))
+		case strings.HasPrefix(statement, "uid "):
+			current.ClientID = iscClientID(strings.TrimPrefix(statement, "uid "))
+		case strings.HasPrefix(statement, "ends "):
+			expiresAt, err := parseISCTime(strings.TrimPrefix(statement, "ends "))
+			if err != nil {
+				errors = append(errors, ingestError{Line: lineNo, Error: err.Error()})
+				continue
+			}
+			current.ExpiresAt = expiresAt
+		}
+	}
+	if current != nil {
+		errors = append(errors, ingestError{Line: startLine, Error: "lease block is not closed"})
+	}
+
+	result := make([]DHCPLease, 0, len(byIP))
+	for _, lease := range leases {
+		if lease.IPAddress != "" {
+			result = append(result, lease)
+		}
+	}
+	return result, errors
+}
+
+// parseISCTime function: ISC dhcpd の日時（UTC）を DB保存用の書式に変換（never は空 = 無期限）
+func parseISCTime(value string) (string, error) {
+	m := iscTimePattern.FindStringSubmatch(value)
+	switch {
+	case m == nil:
+		return "", fmt.Errorf("invalid lease time: %q", value)
+	case m[1] != "":
+		t, err := time.Parse("2006/01/02 15:04:05", strings.Join(strings.Fields(m[1]), " "))
+		if err != nil {
+			return "", fmt.Errorf("invalid lease time: %q", value)
+		}
+		return t.UTC().Format(timestampLayout), nil
+	case m[2] != "":
+		epoch, _ := strconv.ParseInt(m[2], 10, 64)
+		return time.Unix(epoch, 0).UTC().Format(timestampLayout), nil
+	}
+	return "", nil
+}
+
+// unquoteISC function: ISC dhcpd の引用符付き文字列を取り出す
+func unquoteISC(value string) string {
+	if s, err := strconv.Unquote(value); err == nil {
+		return s
+	}
+	return strings.Trim(value, `"`)
+}
+
+// iscClientID function: uid（"\001\252..." の8進エスケープ文字列、または "01:aa:..." の16進表記）を
+// dnsmasq と同じ小文字・コロン区切りの16進表記にそろえる
+func iscClientID(value string) string {
+	if !strings.HasPrefix(value, `"`) {
+		return strings.ToLower(value)
+	}
+	raw := unquoteISC(value)
+	octets := make([]string, 0, len(raw))
+	for i := 0; i < len(raw); i++ {
+		octets = append(octets, fmt.Sprintf("%02x", raw[i]))
+	}
+	return strings.Join(octets, ":")
+}
+
+// readLeaseRequest function: リクエストからリースファイルの形式と内容を取り出す
+func readLeaseRequest(r *http.Request) (string, string, error) {
+	format := r.URL.Query().Get("format")
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxLeaseFileSize+1))
+	if err != nil {
+		return "", "", fmt.Errorf("Invalid request body: %v", err)
+	}
+	if len(body) > maxLeaseFileSize {
+		return "", "", fmt.Errorf("lease file is too large (max %d bytes)", maxLeaseFileSize)
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var req leaseIngestRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			return "", "", fmt.Errorf("Invalid JSON data: %v", err)
+		}
+		if req.Format != "" {
+			format = req.Format
+		}
+		return format, req.Content, nil
+	}
+	return format, string(body), nil
+}
+
+// saveLease function: リースを保存し、登録済みの機器ならホスト名を反映する（機器があれば true）
+func saveLease(tx *sql.Tx, lease DHCPLease) (bool, error) {
+	_, err := tx.Exec(`INSERT INTO dhcp_lease (mac_address, ip_address, hostname, client_id, expires_at, source, sensor_id, updated_at)
+		VALUES (?, ?, NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''), ?, ?, ?)
+		ON CONFLICT (mac_address, ip_address) DO UPDATE SET
+			hostname = excluded.hostname, client_id = excluded.client_id, expires_at = excluded.expires_at,
+			source = excluded.source, sensor_id = excluded.sensor_id, updated_at = excluded.updated_at`,
+		lease.MACAddress, lease.IPAddress, lease.Hostname, lease.ClientID, lease.ExpiresAt, lease.Source, lease.SensorID, lease.UpdatedAt)
+	if err != nil {
+		return false, fmt.Errorf("リース保存エラー (MAC: %s): %v", lease.MACAddress, err)
+	}
+	if lease.Hostname == "" {
+		var exists bool
+		err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM device WHERE mac_address = ?)", lease.MACAddress).Scan(&exists)
+		return exists, err
+	}
+	result, err := tx.Exec("UPDATE device SET hostname = ? WHERE mac_address = ?", lease.Hostname, lease.MACAddress)
+	if err != nil {
+		return false, fmt.Errorf("ホスト名更新エラー (MAC: %s): %v", lease.MACAddress, err)
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// dhcpLeasesHandler function: GET でリース一覧（?mac= で絞り込み）、POST でリースファイルを取り込む
+func dhcpLeasesHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorizeRequest(w, r) || !databaseReady(w) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		leases, err := queryLeases(r.URL.Query().Get("mac"))
+		if err != nil {
+			log.Printf("❌ %v", err)
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status":    "success",
+			"count":     len(leases),
+			"leases":    leases,
+			"timestamp": time.Now().Format("2006-01-02 15:04:05"),
+		})
+	case http.MethodPost:
+		ingestLeases(w, r)
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// ingestLeases function: dnsmasq / ISC dhcpd のリースファイルを取り込み、MACアドレスが一致する機器にホスト名を付ける
+func ingestLeases(w http.ResponseWriter, r *http.Request) {
+	format, content, err := readLeaseRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if format == "" {
+		format = detectLeaseFormat(content)
+	}
+	leases, parseErrors, err := parseLeases(format, content)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(parseErrors) > maxIngestErrors {
+		parseErrors = parseErrors[:maxIngestErrors]
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("❌ トランザクション開始エラー: %v", err)
+		http.Error(w, "Database update failed", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	now := nowTimestamp()
+	sensorID := sensorIDFromRequest(r)
+	matched := 0
+	for _, lease := range leases {
+		lease.SensorID = sensorID
+		lease.UpdatedAt = now
+		found, err := saveLease(tx, lease)
+		if err != nil {
+			log.Printf("❌ %v", err)
+			http.Error(w, "Database update failed", http.StatusInternalServerError)
+			return
+		}
+		if found {
+			matched++
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("❌ コミットエラー: %v", err)
+		http.Error(w, "Database update failed", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("✅ DHCPリースを取り込みました (形式: %s, リース: %d件, 一致した機器: %d台, 不正: %d件)", format, len(leases), matched, len(parseErrors))
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":        "success",
+		"format":        format,
+		"count":         len(leases),
+		"matched_count": matched,
+		"errors":        parseErrors,
+		"timestamp":     time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
+
+// queryLeases function: 保存済みのリースを取得（mac が空なら全件）
+func queryLeases(mac string) ([]DHCPLease, error) {
+	query := `SELECT mac_address, ip_address, COALESCE(hostname, ''), COALESCE(client_id, ''), COALESCE(expires_at, ''),
+		source, COALESCE(sensor_id, ''), updated_at FROM dhcp_lease`
+	var args []interface{}
+	if mac != "" {
+		query += " WHERE mac_address = ?"
+		args = append(args, macFilter(mac))
+	}
+	query += " ORDER BY mac_address, updated_at DESC, ip_address"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("リース取得エラー: %v", err)
+	}
+	defer rows.Close()
+
+	leases := []DHCPLease{}
+	for rows.Next() {
+		var l DHCPLease
+		if err := rows.Scan(&l.MACAddress, &l.IPAddress, &l.Hostname, &l.ClientID, &l.ExpiresAt, &l.Source, &l.SensorID, &l.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("リース読み込みエラー: %v", err)
+		}
+		leases = append(leases, l)
+	}
+	return leases, rows.Err()
+}
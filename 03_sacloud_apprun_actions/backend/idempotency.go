@@ -0,0 +1,222 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaultIdempotencyTTLHours: Idempotency-Key とレスポンスを保持する時間のデフォルト値
+const defaultIdempotencyTTLHours = 24
+
+// defaultIdempotencyLeaseSeconds: 処理中として予約したキーを有効とみなす時間のデフォルト値
+// 処理中のリクエストは予約を定期的に延長するため、これを過ぎても処理中のままのキーは
+// 処理中にプロセスが終了したものとして再送したリクエストが引き継ぐ
+const defaultIdempotencyLeaseSeconds = 60
+
+// maxIdempotencyKeyLength: Idempotency-Key の最大長
+const maxIdempotencyKeyLength = 255
+
+// idempotencyRecorder type: ハンドラーのレスポンスを書き込みながら記録する
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+// WriteHeader function: ステータスコードを記録して書き込む
+func (rec *idempotencyRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// Write function: レスポンス本文を記録して書き込む
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// idempotencyTTL function: 環境変数 IDEMPOTENCY_TTL_HOURS から保持時間を取得
+func idempotencyTTL() time.Duration {
+	return time.Duration(envInt("IDEMPOTENCY_TTL_HOURS", defaultIdempotencyTTLHours)) * time.Hour
+}
+
+// idempotencyLease function: 環境変数 IDEMPOTENCY_LEASE_SECONDS から処理中の予約の有効時間を取得
+func idempotencyLease() time.Duration {
+	return time.Duration(envInt("IDEMPOTENCY_LEASE_SECONDS", defaultIdempotencyLeaseSeconds)) * time.Second
+}
+
+// beginIdempotent function: Idempotency-Key ヘッダーのあるリクエストの重複を判定する
+// 保持期間内に同じキーで処理済みなら保存済みのレスポンスを返して done = true（ハンドラーは何もせず戻る）。
+// 初めてのキーなら予約して、レスポンスを記録する ResponseWriter と、ハンドラーの終了時に呼ぶ finish を返す。
+// ヘッダーがなければ w をそのまま返す
+func beginIdempotent(w http.ResponseWriter, r *http.Request, endpoint string) (http.ResponseWriter, func(), bool) {
+	key := strings.TrimSpace(r.Header.Get("Idempotency-Key"))
+	if key == "" {
+		return w, func() {}, false
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		http.Error(w, fmt.Sprintf("Idempotency-Key must be at most %d characters", maxIdempotencyKeyLength), http.StatusBadRequest)
+		return w, nil, true
+	}
+
+	// 同じキーで内容の異なるリクエストを検出するため本文のハッシュを記録する
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return w, nil, true
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	sum := sha256.Sum256(body)
+	requestHash := hex.EncodeToString(sum[:])
+
+	reserved, stored, err := reserveIdempotencyKey(endpoint, key, requestHash)
+	if err != nil {
+		log.Printf("❌ %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return w, nil, true
+	}
+	if !reserved {
+		switch {
+		case stored.requestHash != requestHash:
+			log.Printf("⚠️ Idempotency-Key %q は別の内容のリクエストで使用済みです", key)
+			http.Error(w, "Idempotency-Key was already used with a different request body", http.StatusUnprocessableEntity)
+		case stored.status == 0:
+			log.Printf("⚠️ Idempotency-Key %q のリクエストは処理中です", key)
+			http.Error(w, "A request with this Idempotency-Key is still being processed", http.StatusConflict)
+		default:
+			log.Printf("♻️ Idempotency-Key %q は処理済みのため保存済みのレスポンスを返します（%s 処理）", key, stored.createdAt)
+			if stored.contentType != "" {
+				w.Header().Set("Content-Type", stored.contentType)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.status)
+			w.Write(stored.body)
+		}
+		return w, nil, true
+	}
+
+	rec := &idempotencyRecorder{ResponseWriter: w}
+	stopRefresh := refreshIdempotencyLease(endpoint, key, idempotencyLease())
+	finish := func() {
+		stopRefresh()
+		if err := completeIdempotencyKey(endpoint, key, rec); err != nil {
+			log.Printf("❌ %v", err)
+		}
+	}
+	return rec, finish, false
+}
+
+// storedResponse type: idempotency_key テーブルに保存したレスポンス
+type storedResponse struct {
+	requestHash string
+	status      int // 0 は処理中
+	contentType string
+	body        []byte
+	createdAt   string
+	reservedAt  string
+}
+
+// reserveIdempotencyKey function: キーを処理中として登録する（期限切れのキーは先に削除）
+// 既に登録済みなら reserved = false と保存済みのレスポンスを返す。
+// ただし同じ内容のリクエストで、予約の有効時間を過ぎても処理中のままのキーは予約し直す
+func reserveIdempotencyKey(endpoint, key, requestHash string) (bool, storedResponse, error) {
+	var stored storedResponse
+	tx, err := db.Begin()
+	if err != nil {
+		return false, stored, fmt.Errorf("トランザクション開始エラー: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM idempotency_key WHERE created_at < ?", cutoffTimestamp(idempotencyTTL())); err != nil {
+		return false, stored, fmt.Errorf("期限切れの Idempotency-Key の削除エラー: %v", err)
+	}
+
+	var contentType sql.NullString
+	err = tx.QueryRow(`SELECT request_hash, status_code, content_type, response_body, created_at, COALESCE(reserved_at, created_at)
+		FROM idempotency_key WHERE endpoint = ? AND idempotency_key = ?`, endpoint, key).
+		Scan(&stored.requestHash, &stored.status, &contentType, &stored.body, &stored.createdAt, &stored.reservedAt)
+	now := nowTimestamp()
+	if err == nil {
+		stored.contentType = contentType.String
+		if stored.status != 0 || stored.requestHash != requestHash || stored.reservedAt >= cutoffTimestamp(idempotencyLease()) {
+			return false, stored, nil
+		}
+		log.Printf("⚠️ Idempotency-Key %q は %s から処理中のままのため、再送されたリクエストで処理し直します", key, stored.reservedAt)
+		if _, err := tx.Exec("UPDATE idempotency_key SET created_at = ?, reserved_at = ? WHERE endpoint = ? AND idempotency_key = ?",
+			now, now, endpoint, key); err != nil {
+			return false, stored, fmt.Errorf("Idempotency-Key の再予約エラー: %v", err)
+		}
+	} else if err != sql.ErrNoRows {
+		return false, stored, fmt.Errorf("Idempotency-Key の取得エラー: %v", err)
+	} else if _, err := tx.Exec(`INSERT INTO idempotency_key (endpoint, idempotency_key, request_hash, status_code, created_at, reserved_at)
+		VALUES (?, ?, ?, 0, ?, ?)`, endpoint, key, requestHash, now, now); err != nil {
+		return false, stored, fmt.Errorf("Idempotency-Key の登録エラー: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, stored, fmt.Errorf("Idempotency-Key のコミットエラー: %v", err)
+	}
+	return true, stored, nil
+}
+
+// refreshIdempotencyLease function: ハンドラーの処理中、予約の有効時間の3分の1ごとに予約日時を更新する
+// 有効時間より長くかかる処理でも、処理中の予約を再送されたリクエストに引き継がれないようにするため。
+// 返り値の stop で更新を止める（stop は更新処理の終了を待ってから戻る）
+func refreshIdempotencyLease(endpoint, key string, lease time.Duration) (stop func()) {
+	interval := lease / 3
+	if interval <= 0 {
+		return func() {}
+	}
+	quit := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+				if _, err := db.Exec("UPDATE idempotency_key SET reserved_at = ? WHERE endpoint = ? AND idempotency_key = ? AND status_code = 0",
+					nowTimestamp(), endpoint, key); err != nil {
+					log.Printf("⚠️ Idempotency-Key %q の予約の延長に失敗: %v", key, err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-stopped
+	}
+}
+
+// completeIdempotencyKey function: 処理結果のレスポンスを保存する
+// 5xx（およびレスポンスを書かずに終わった場合）は再送で成功しうるため、予約を取り消して同じキーで再処理できるようにする
+func completeIdempotencyKey(endpoint, key string, rec *idempotencyRecorder) error {
+	if rec.status == 0 || rec.status >= 500 {
+		if _, err := db.Exec("DELETE FROM idempotency_key WHERE endpoint = ? AND idempotency_key = ?", endpoint, key); err != nil {
+			return fmt.Errorf("Idempotency-Key の予約取り消しエラー: %v", err)
+		}
+		return nil
+	}
+	_, err := db.Exec(`UPDATE idempotency_key SET status_code = ?, content_type = ?, response_body = ?
+		WHERE endpoint = ? AND idempotency_key = ?`,
+		rec.status, rec.Header().Get("Content-Type"), rec.body.Bytes(), endpoint, key)
+	if err != nil {
+		return fmt.Errorf("Idempotency-Key のレスポンス保存エラー: %v", err)
+	}
+	return nil
+}
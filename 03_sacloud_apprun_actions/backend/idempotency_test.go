@@ -0,0 +1,109 @@
+package backend
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBeginIdempotent(t *testing.T) {
+	database := useTestDatabase(t)
+	t.Setenv("IDEMPOTENCY_LEASE_SECONDS", "60")
+
+	calls := 0
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w, finish, replayed := beginIdempotent(w, r, "/status")
+		if replayed {
+			return
+		}
+		defer finish()
+		calls++
+		writeJSON(w, http.StatusOK, map[string]int{"calls": calls})
+	}
+
+	const body = `{"observations":[]}`
+	sum := sha256.Sum256([]byte(body))
+	hash := hex.EncodeToString(sum[:])
+	now := time.Now().UTC()
+	reserve := func(key string, reservedAt time.Time) {
+		t.Helper()
+		at := reservedAt.Format(timestampLayout)
+		if _, err := database.Exec(`INSERT INTO idempotency_key (endpoint, idempotency_key, request_hash, status_code, created_at, reserved_at)
+			VALUES ('/status', ?, ?, 0, ?, ?)`, key, hash, at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reserve("in-flight", now)
+	reserve("abandoned", now.Add(-2*time.Minute))
+
+	// 順に実行する（前の手順の結果を引き継ぐ）
+	steps := []struct {
+		name         string
+		key          string
+		body         string
+		wantStatus   int
+		wantReplayed bool
+		wantCalls    int
+	}{
+		{name: "first request is processed", key: "k1", body: body, wantStatus: http.StatusOK, wantCalls: 1},
+		{name: "retry replays the stored response", key: "k1", body: body, wantStatus: http.StatusOK, wantReplayed: true, wantCalls: 1},
+		{name: "same key with a different body", key: "k1", body: `{"observations":null}`, wantStatus: http.StatusUnprocessableEntity, wantCalls: 1},
+		{name: "request still in flight within the lease", key: "in-flight", body: body, wantStatus: http.StatusConflict, wantCalls: 1},
+		{name: "in-flight key with a different body", key: "abandoned", body: `{}`, wantStatus: http.StatusUnprocessableEntity, wantCalls: 1},
+		{name: "expired lease is taken over", key: "abandoned", body: body, wantStatus: http.StatusOK, wantCalls: 2},
+		{name: "taken over key replays", key: "abandoned", body: body, wantStatus: http.StatusOK, wantReplayed: true, wantCalls: 2},
+		{name: "no key is always processed", body: body, wantStatus: http.StatusOK, wantCalls: 3},
+		{name: "key too long", key: strings.Repeat("k", maxIdempotencyKeyLength+1), body: body, wantStatus: http.StatusBadRequest, wantCalls: 3},
+	}
+	var firstBody string
+	for _, s := range steps {
+		req := httptest.NewRequest(http.MethodPost, "/status", strings.NewReader(s.body))
+		if s.key != "" {
+			req.Header.Set("Idempotency-Key", s.key)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+
+		if rec.Code != s.wantStatus {
+			t.Errorf("%s: status = %d, want %d (%s)", s.name, rec.Code, s.wantStatus, rec.Body.String())
+		}
+		if replayed := rec.Header().Get("Idempotent-Replayed") == "true"; replayed != s.wantReplayed {
+			t.Errorf("%s: replayed = %v, want %v", s.name, replayed, s.wantReplayed)
+		}
+		if calls != s.wantCalls {
+			t.Errorf("%s: handler calls = %d, want %d", s.name, calls, s.wantCalls)
+		}
+		if s.key == "k1" && s.wantStatus == http.StatusOK {
+			if firstBody == "" {
+				firstBody = rec.Body.String()
+			} else if rec.Body.String() != firstBody {
+				t.Errorf("%s: body = %q, want the stored %q", s.name, rec.Body.String(), firstBody)
+			}
+		}
+	}
+}
+
+func TestRefreshIdempotencyLease(t *testing.T) {
+	database := useTestDatabase(t)
+	const stale = "2026-01-01 00:00:00"
+	if _, err := database.Exec(`INSERT INTO idempotency_key (endpoint, idempotency_key, request_hash, status_code, created_at, reserved_at)
+		VALUES ('/status', 'slow', 'hash', 0, ?, ?)`, stale, stale); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := refreshIdempotencyLease("/status", "slow", 30*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	stop()
+
+	var reservedAt string
+	if err := database.QueryRow("SELECT reserved_at FROM idempotency_key WHERE idempotency_key = 'slow'").Scan(&reservedAt); err != nil {
+		t.Fatal(err)
+	}
+	if reservedAt <= stale {
+		t.Errorf("reserved_at = %q, want it extended past %q", reservedAt, stale)
+	}
+}
@@ -0,0 +1,530 @@
+package backend
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// インシデントの状態 (incident.status)
+const (
+	IncidentOpen         = "open"
+	IncidentAcknowledged = "acknowledged"
+	IncidentResolved     = "resolved"
+)
+
+// インシデントの記録の種類 (incident_note.kind)
+const (
+	noteOpen    = "open"
+	noteHit     = "hit"
+	noteAck     = "ack"
+	noteResolve = "resolve"
+	noteComment = "comment"
+)
+
+// systemActor: 自動で行われた操作の実行者
+const systemActor = "system"
+
+// Incident type: incident テーブルの1行を表す
+type Incident struct {
+	ID             int64  `json:"id"`
+	MACAddress     string `json:"mac_address"`
+	Status         string `json:"status"`
+	Severity       string `json:"severity"`
+	Summary        string `json:"summary"`
+	HitCount       int    `json:"hit_count"`
+	OpenedAt       string `json:"opened_at"`
+	LastHitAt      string `json:"last_hit_at"`
+	AcknowledgedAt string `json:"acknowledged_at,omitempty"`
+	AcknowledgedBy string `json:"acknowledged_by,omitempty"`
+	ResolvedAt     string `json:"resolved_at,omitempty"`
+	ResolvedBy     string `json:"resolved_by,omitempty"`
+}
+
+// IncidentNote type: インシデントへのヒット・確認・解決・コメントの記録
+type IncidentNote struct {
+	ID        int64  `json:"id"`
+	Kind      string `json:"kind"`
+	Actor     string `json:"actor"`
+	Body      string `json:"body"`
+	CreatedAt string `json:"created_at"`
+}
+
+// IncidentMetrics type: 確認・解決までにかかった時間の集計（秒）
+type IncidentMetrics struct {
+	Total               int     `json:"total"`
+	Unresolved          int     `json:"unresolved"`
+	Acknowledged        int     `json:"acknowledged"`
+	Resolved            int     `json:"resolved"`
+	MeanTimeToAck       float64 `json:"mean_time_to_acknowledge_seconds"`
+	MedianTimeToAck     float64 `json:"median_time_to_acknowledge_seconds"`
+	MeanTimeToResolve   float64 `json:"mean_time_to_resolve_seconds"`
+	MedianTimeToResolve float64 `json:"median_time_to_resolve_seconds"`
+}
+
+// incidentActionRequest type: 確認・解決APIのリクエスト（オペレーターは管理トークンから決める）
+type incidentActionRequest struct {
+	Comment string `json:"comment"`
+}
+
+// openIncident function: 機器が危険になった時点でインシデントを作成
+func openIncident(tx *sql.Tx, macAddress, at string) error {
+	summary, severity, err := activeDangerSummary(tx, macAddress)
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec(`INSERT INTO incident (mac_address, status, severity, summary, hit_count, opened_at, last_hit_at)
+		VALUES (?, ?, ?, ?, 0, ?, ?)`, macAddress, IncidentOpen, severity, summary, at, at)
+	if err != nil {
+		return fmt.Errorf("インシデント作成エラー (MAC: %s): %v", macAddress, err)
+	}
+	id, _ := result.LastInsertId()
+	log.Printf("  🚨 インシデント #%d を作成しました (MAC: %s)", id, macAddress)
+	return addIncidentNote(tx, id, noteOpen, systemActor, summary, at)
+}
+
+// recordIncidentHit function: 未解決のインシデントにヒットを追加（なければ作成）
+func recordIncidentHit(tx *sql.Tx, macAddress string, hit dangerHit, at string) error {
+	id, severity, err := unresolvedIncident(tx, macAddress)
+	if err == sql.ErrNoRows {
+		// 手動で解決された後も危険な状態が続いている場合は新しいインシデントとする
+		if err := openIncident(tx, macAddress, at); err != nil {
+			return err
+		}
+		id, severity, err = unresolvedIncident(tx, macAddress)
+	}
+	if err != nil {
+		return fmt.Errorf("インシデント取得エラー (MAC: %s): %v", macAddress, err)
+	}
+
+	if severityRank[hit.Severity] > severityRank[severity] {
+		severity = hit.Severity
+	}
+	_, err = tx.Exec("UPDATE incident SET hit_count = hit_count + 1, last_hit_at = ?, severity = ? WHERE id = ?", at, severity, id)
+	if err != nil {
+		return fmt.Errorf("インシデント更新エラー (ID: %d): %v", id, err)
+	}
+
+	body := fmt.Sprintf("[%s] %s", hit.Source, hit.Reason)
+	if len(hit.Evidence) > 0 && hit.Evidence[0] != "" {
+		body += "\n" + strings.Join(hit.Evidence, "\n")
+	}
+	return addIncidentNote(tx, id, noteHit, systemActor, body, at)
+}
+
+// autoResolveIncidents function: 機器の危険判定が全て解除された時点で未解決のインシデントを自動解決
+func autoResolveIncidents(tx *sql.Tx, macAddress, at string) error {
+	rows, err := tx.Query("SELECT id FROM incident WHERE mac_address = ? AND status != ?", macAddress, IncidentResolved)
+	if err != nil {
+		return fmt.Errorf("インシデント取得エラー (MAC: %s): %v", macAddress, err)
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return fmt.Errorf("インシデント読み込みエラー (MAC: %s): %v", macAddress, err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if err := resolveIncident(tx, id, systemActor, "危険判定が全て解除されたため自動解決しました", at); err != nil {
+			return err
+		}
+		log.Printf("  ✅ インシデント #%d を自動解決しました (MAC: %s)", id, macAddress)
+	}
+	return nil
+}
+
+// resolveIncident function: インシデントを解決済みにする
+func resolveIncident(tx *sql.Tx, id int64, operator, comment, at string) error {
+	_, err := tx.Exec("UPDATE incident SET status = ?, resolved_at = ?, resolved_by = ? WHERE id = ?", IncidentResolved, at, operator, id)
+	if err != nil {
+		return fmt.Errorf("インシデント解決エラー (ID: %d): %v", id, err)
+	}
+	return addIncidentNote(tx, id, noteResolve, operator, comment, at)
+}
+
+// unresolvedIncident function: 機器の未解決のインシデントのIDと危険度を取得
+func unresolvedIncident(tx *sql.Tx, macAddress string) (int64, string, error) {
+	var id int64
+	var severity string
+	err := tx.QueryRow("SELECT id, severity FROM incident WHERE mac_address = ? AND status != ? ORDER BY id DESC LIMIT 1",
+		macAddress, IncidentResolved).Scan(&id, &severity)
+	return id, severity, err
+}
+
+// activeDangerSummary function: 有効な危険判定の理由をまとめた文字列と最大の危険度を返す
+func activeDangerSummary(tx *sql.Tx, macAddress string) (string, string, error) {
+	rows, err := tx.Query("SELECT source, severity, COALESCE(reason, '') FROM device_danger WHERE mac_address = ? AND state = ? ORDER BY source",
+		macAddress, DangerStateActive)
+	if err != nil {
+		return "", "", fmt.Errorf("危険判定取得エラー (MAC: %s): %v", macAddress, err)
+	}
+	defer rows.Close()
+
+	var reasons []string
+	severity := SeverityLow
+	for rows.Next() {
+		var source, s, reason string
+		if err := rows.Scan(&source, &s, &reason); err != nil {
+			return "", "", fmt.Errorf("危険判定読み込みエラー (MAC: %s): %v", macAddress, err)
+		}
+		reasons = append(reasons, fmt.Sprintf("[%s] %s", source, reason))
+		if severityRank[s] > severityRank[severity] {
+			severity = s
+		}
+	}
+	return strings.Join(reasons, " / "), severity, rows.Err()
+}
+
+// addIncidentNote function: インシデントに記録を追加
+func addIncidentNote(tx *sql.Tx, incidentID int64, kind, actor, body, at string) error {
+	_, err := tx.Exec("INSERT INTO incident_note (incident_id, kind, actor, body, created_at) VALUES (?, ?, ?, ?, ?)",
+		incidentID, kind, actor, body, at)
+	if err != nil {
+		return fmt.Errorf("インシデント記録追加エラー (ID: %d): %v", incidentID, err)
+	}
+	return nil
+}
+
+// queryIncidents function: 条件に一致するインシデントを新しい順に取得
+func queryIncidents(where string, args ...interface{}) ([]Incident, error) {
+	query := `SELECT id, mac_address, status, severity, COALESCE(summary, ''), hit_count, opened_at, last_hit_at,
+		COALESCE(acknowledged_at, ''), COALESCE(acknowledged_by, ''), COALESCE(resolved_at, ''), COALESCE(resolved_by, '')
+		FROM incident`
+	if where != "" {
+		query += " WHERE " + where
+	}
+	query += " ORDER BY id DESC"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("インシデント取得エラー: %v", err)
+	}
+	defer rows.Close()
+
+	incidents := []Incident{}
+	for rows.Next() {
+		var i Incident
+		if err := rows.Scan(&i.ID, &i.MACAddress, &i.Status, &i.Severity, &i.Summary, &i.HitCount, &i.OpenedAt, &i.LastHitAt,
+			&i.AcknowledgedAt, &i.AcknowledgedBy, &i.ResolvedAt, &i.ResolvedBy); err != nil {
+			return nil, fmt.Errorf("インシデント読み込みエラー: %v", err)
+		}
+		incidents = append(incidents, i)
+	}
+	return incidents, rows.Err()
+}
+
+// queryIncidentNotes function: インシデントの記録を古い順に取得
+func queryIncidentNotes(incidentID int64) ([]IncidentNote, error) {
+	rows, err := db.Query("SELECT id, kind, actor, COALESCE(body, ''), created_at FROM incident_note WHERE incident_id = ? ORDER BY id", incidentID)
+	if err != nil {
+		return nil, fmt.Errorf("インシデント記録取得エラー (ID: %d): %v", incidentID, err)
+	}
+	defer rows.Close()
+
+	notes := []IncidentNote{}
+	for rows.Next() {
+		var n IncidentNote
+		if err := rows.Scan(&n.ID, &n.Kind, &n.Actor, &n.Body, &n.CreatedAt); err != nil {
+			return nil, fmt.Errorf("インシデント記録読み込みエラー (ID: %d): %v", incidentID, err)
+		}
+		notes = append(notes, n)
+	}
+	return notes, rows.Err()
+}
+
+// UnresolvedIncidents function: 未解決のインシデント一覧（ダッシュボード表示用）
+func UnresolvedIncidents() ([]Incident, error) {
+	return queryIncidents("status != ?", IncidentResolved)
+}
+
+// ComputeIncidentMetrics function: 直近 window の間に作成されたインシデントの確認・解決までの時間を集計
+func ComputeIncidentMetrics(window time.Duration) (IncidentMetrics, error) {
+	incidents, err := queryIncidents("opened_at >= ?", cutoffTimestamp(window))
+	if err != nil {
+		return IncidentMetrics{}, err
+	}
+
+	var m IncidentMetrics
+	var toAck, toResolve []float64
+	for _, i := range incidents {
+		m.Total++
+		opened := parseTimestamp(i.OpenedAt)
+		if i.AcknowledgedAt != "" {
+			m.Acknowledged++
+			toAck = append(toAck, parseTimestamp(i.AcknowledgedAt).Sub(opened).Seconds())
+		}
+		if i.Status == IncidentResolved {
+			m.Resolved++
+			toResolve = append(toResolve, parseTimestamp(i.ResolvedAt).Sub(opened).Seconds())
+		} else {
+			m.Unresolved++
+		}
+	}
+	m.MeanTimeToAck, m.MedianTimeToAck = meanAndMedian(toAck)
+	m.MeanTimeToResolve, m.MedianTimeToResolve = meanAndMedian(toResolve)
+	return m, nil
+}
+
+// FormatDuration function: 秒数を「1時間5分」のような表示用文字列に変換
+func FormatDuration(seconds float64) string {
+	d := time.Duration(seconds) * time.Second
+	switch {
+	case d <= 0:
+		return "-"
+	case d < time.Minute:
+		return fmt.Sprintf("%d秒", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%d分", int(d.Minutes()))
+	default:
+		return fmt.Sprintf("%d時間%d分", int(d.Hours()), int(d.Minutes())%60)
+	}
+}
+
+// meanAndMedian function: 平均値と中央値を返す（空の場合は0）
+func meanAndMedian(values []float64) (float64, float64) {
+	if len(values) == 0 {
+		return 0, 0
+	}
+	sort.Float64s(values)
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	median := values[len(values)/2]
+	if len(values)%2 == 0 {
+		median = (values[len(values)/2-1] + values[len(values)/2]) / 2
+	}
+	return sum / float64(len(values)), median
+}
+
+// incidentIDFromPath function: パスの {id} をインシデントIDとして取得
+func incidentIDFromPath(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "Invalid incident id", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// incidentsHandler function: インシデント一覧を返す
+func incidentsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeRequest(w, r) || !databaseReady(w) {
+		return
+	}
+
+	where := "1 = 1"
+	var args []interface{}
+	switch status := r.URL.Query().Get("status"); status {
+	case "":
+	case "unresolved":
+		where += " AND status != ?"
+		args = append(args, IncidentResolved)
+	case IncidentOpen, IncidentAcknowledged, IncidentResolved:
+		where += " AND status = ?"
+		args = append(args, status)
+	default:
+		http.Error(w, "status must be open, acknowledged, resolved or unresolved", http.StatusBadRequest)
+		return
+	}
+	if mac := r.URL.Query().Get("mac"); mac != "" {
+		where += " AND mac_address = ?"
+		args = append(args, macFilter(mac))
+	}
+
+	incidents, err := queryIncidents(where, args...)
+	if err != nil {
+		log.Printf("❌ %v", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":    "success",
+		"count":     len(incidents),
+		"incidents": incidents,
+		"timestamp": time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
+
+// incidentDetailHandler function: インシデントの詳細と記録を返す
+func incidentDetailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeRequest(w, r) || !databaseReady(w) {
+		return
+	}
+	id, ok := incidentIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	incidents, err := queryIncidents("id = ?", id)
+	if err != nil {
+		log.Printf("❌ %v", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	if len(incidents) == 0 {
+		http.Error(w, "Incident not found", http.StatusNotFound)
+		return
+	}
+	notes, err := queryIncidentNotes(id)
+	if err != nil {
+		log.Printf("❌ %v", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":    "success",
+		"incident":  incidents[0],
+		"notes":     notes,
+		"timestamp": time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
+
+// incidentAckHandler function: オペレーターがインシデントを確認済みにする
+func incidentAckHandler(w http.ResponseWriter, r *http.Request) {
+	incidentActionHandler(w, r, noteAck)
+}
+
+// incidentResolveHandler function: オペレーターがインシデントを手動で解決する
+func incidentResolveHandler(w http.ResponseWriter, r *http.Request) {
+	incidentActionHandler(w, r, noteResolve)
+}
+
+// incidentActionHandler function: インシデントの確認・解決の共通処理（管理トークン（ADMIN_TOKENS）が必要）
+func incidentActionHandler(w http.ResponseWriter, r *http.Request, action string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	operator, ok := authorizeAdmin(w, r)
+	if !ok || !databaseReady(w) {
+		return
+	}
+	id, ok := incidentIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	// 本文（コメント）は省略できる
+	var req incidentActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, fmt.Sprintf("Invalid JSON data: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("❌ トランザクション開始エラー: %v", err)
+		http.Error(w, "Database update failed", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var status string
+	if err := tx.QueryRow("SELECT status FROM incident WHERE id = ?", id).Scan(&status); err == sql.ErrNoRows {
+		http.Error(w, "Incident not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("❌ インシデント取得エラー: %v", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+
+	now := nowTimestamp()
+	switch {
+	case status == IncidentResolved:
+		http.Error(w, "Incident is already resolved", http.StatusConflict)
+		return
+	case action == noteAck && status == IncidentAcknowledged:
+		// 確認済みの場合はコメントのみ追加
+		err = addIncidentNote(tx, id, noteComment, operator, req.Comment, now)
+	case action == noteAck:
+		_, err = tx.Exec("UPDATE incident SET status = ?, acknowledged_at = ?, acknowledged_by = ? WHERE id = ?",
+			IncidentAcknowledged, now, operator, id)
+		if err == nil {
+			err = addIncidentNote(tx, id, noteAck, operator, req.Comment, now)
+		}
+	default:
+		err = resolveIncident(tx, id, operator, req.Comment, now)
+	}
+	if err != nil {
+		log.Printf("❌ %v", err)
+		http.Error(w, "Database update failed", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("❌ コミットエラー: %v", err)
+		http.Error(w, "Database update failed", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("✅ インシデント #%d: %s by %s", id, action, operator)
+
+	incidents, err := queryIncidents("id = ?", id)
+	if err != nil || len(incidents) == 0 {
+		log.Printf("❌ インシデント取得エラー: %v", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":    "success",
+		"incident":  incidents[0],
+		"timestamp": time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
+
+// incidentMetricsHandler function: 確認・解決までにかかった時間を返す（既定は直近30日）
+func incidentMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeRequest(w, r) || !databaseReady(w) {
+		return
+	}
+
+	days := 30
+	if value := r.URL.Query().Get("days"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, "days must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+
+	metrics, err := ComputeIncidentMetrics(time.Duration(days) * 24 * time.Hour)
+	if err != nil {
+		log.Printf("❌ %v", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":    "success",
+		"days":      days,
+		"metrics":   metrics,
+		"timestamp": time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
@@ -0,0 +1,477 @@
+package backend
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 機器一覧の1ページあたりの件数
+const (
+	defaultDeviceLimit = 100
+	maxDeviceLimit     = 1000
+)
+
+// deviceSortColumns: ?sort= で指定できる並び順と対応する列（同じ値の機器はMACアドレス順）
+var deviceSortColumns = map[string]string{
+	"last_seen":  "COALESCE(last_seen, '')",
+	"first_seen": "COALESCE(first_seen, '')",
+	"mac":        "mac_address",
+	"vendor":     "COALESCE(vendor, '')",
+	"hostname":   "COALESCE(hostname, '')",
+	"seen_count": "COALESCE(seen_count, 0)",
+	"danger":     "COALESCE(is_dangerous, FALSE)",
+}
+
+// deviceSortNumeric: 数値で比較する並び順（カーソルの値を整数として扱う）
+var deviceSortNumeric = map[string]bool{"seen_count": true, "danger": true}
+
+// deviceCursor type: 次のページの開始位置（前のページの最後の機器の並び順の値とMACアドレス）
+type deviceCursor struct {
+	Sort  string `json:"s"`
+	Order string `json:"o"`
+	Value string `json:"v"`
+	MAC   string `json:"m"`
+}
+
+// DeviceSummary type: ダッシュボードのステータスバーと同じ集計
+type DeviceSummary struct {
+	Total     int `json:"total"`
+	Dangerous int `json:"dangerous"`
+	Unknown   int `json:"unknown"`
+	New       int `json:"new"`
+	Stale     int `json:"stale"`
+	StaleDays int `json:"stale_days"`
+}
+
+// deviceSummary function: ダッシュボードのステータスバーと同じ集計を取得
+func deviceSummary() DeviceSummary {
+	return DeviceSummary{
+		Total:     CountDevices(),
+		Dangerous: CountDangerousDevices(),
+		Unknown:   CountUnknownDevices(),
+		New:       CountNewDevices(),
+		Stale:     CountStaleDevices(),
+		StaleDays: StaleDays(),
+	}
+}
+
+// encodeDeviceCursor function: カーソルを URL に載せられる文字列にする
+func encodeDeviceCursor(c deviceCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeDeviceCursor function: ?cursor= の値を読み込む（並び順が異なるカーソルはエラー）
+func decodeDeviceCursor(value, sortKey, order string) (deviceCursor, error) {
+	var c deviceCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || json.Unmarshal(data, &c) != nil {
+		return c, fmt.Errorf("invalid cursor")
+	}
+	if c.Sort != sortKey || c.Order != order {
+		return c, fmt.Errorf("cursor was issued for sort=%s&order=%s", c.Sort, c.Order)
+	}
+	if deviceSortNumeric[sortKey] {
+		if _, err := strconv.Atoi(c.Value); err != nil {
+			return c, fmt.Errorf("invalid cursor")
+		}
+	}
+	return c, nil
+}
+
+// deviceSortValue function: 機器の並び順の値（カーソルに保存する値）
+func deviceSortValue(d DeviceRecord, sortKey string) string {
+	switch sortKey {
+	case "first_seen":
+		return d.FirstSeen
+	case "mac":
+		return d.MACAddress
+	case "vendor":
+		return d.Vendor
+	case "hostname":
+		return d.Hostname
+	case "seen_count":
+		return strconv.Itoa(d.SeenCount)
+	case "danger":
+		if d.IsDangerous {
+			return "1"
+		}
+		return "0"
+	default:
+		return d.LastSeen
+	}
+}
+
+// parseSeenSince function: ?seen_since= を DB保存用の書式に変換（RFC3339・DB保存用の書式、または "24h" のような現在からの期間）
+func parseSeenSince(value string) (string, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		if d <= 0 {
+			return "", fmt.Errorf("seen_since must be a positive duration")
+		}
+		return cutoffTimestamp(d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC().Format(timestampLayout), nil
+	}
+	if t, err := time.Parse(timestampLayout, value); err == nil {
+		return t.Format(timestampLayout), nil
+	}
+	return "", fmt.Errorf("seen_since must be RFC3339, %q or a duration such as 24h", timestampLayout)
+}
+
+// parseIPFilter function: ?ip= をCIDRとして読み込む（IPアドレスは /32・/128 とする）
+func parseIPFilter(value string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(value); err == nil {
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("ip must be an IP address or CIDR: %q", value)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// devicesMatchingIP function: prefix に含まれるアドレス（現在のアドレスと代表のIPアドレス）を持つ機器のMACアドレス
+func devicesMatchingIP(prefix netip.Prefix) ([]string, error) {
+	addresses, err := CurrentDeviceAddresses()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT mac_address, ip_address FROM device WHERE ip_address IS NOT NULL AND ip_address != ''")
+	if err != nil {
+		return nil, fmt.Errorf("機器一覧取得エラー: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var mac, ip string
+		if err := rows.Scan(&mac, &ip); err != nil {
+			return nil, fmt.Errorf("機器一覧読み込みエラー: %v", err)
+		}
+		addresses[mac] = append(addresses[mac], DeviceAddress{IPAddress: ip})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	macs := []string{}
+	for mac, list := range addresses {
+		for _, a := range list {
+			if addr, err := netip.ParseAddr(a.IPAddress); err == nil && prefix.Contains(addr.Unmap()) {
+				macs = append(macs, mac)
+				break
+			}
+		}
+	}
+	return macs, nil
+}
+
+// devicesHandler function: 機器一覧を返す（絞り込み・並び替え・カーソルによるページング）
+//
+//	?danger=true|false  危険判定の有無
+//	?vendor=            ベンダー名（申告・OUI）の部分一致（大文字小文字を区別しない）
+//	?ip=                IPアドレスまたはCIDR（現在のアドレスのいずれかが含まれる機器）
+//	?tag=               注釈のタグ
+//	?seen_since=        この日時以降に検出された機器（RFC3339 または 24h のような期間）
+//	?sort=              last_seen（デフォルト）| first_seen | mac | vendor | hostname | seen_count | danger
+//	?order=asc|desc     デフォルトは last_seen・first_seen・seen_count・danger が desc、それ以外は asc
+//	?limit= / ?cursor=  1ページの件数と、前のページの next_cursor
+func devicesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeRequest(w, r) || !databaseReady(w) {
+		return
+	}
+
+	q := r.URL.Query()
+	var conditions []string
+	var args []interface{}
+
+	if value := q.Get("danger"); value != "" {
+		dangerous, err := strconv.ParseBool(value)
+		if err != nil {
+			http.Error(w, "danger must be true or false", http.StatusBadRequest)
+			return
+		}
+		if dangerous {
+			conditions = append(conditions, "is_dangerous = TRUE")
+		} else {
+			conditions = append(conditions, "COALESCE(is_dangerous, FALSE) = FALSE")
+		}
+	}
+	if vendor := strings.TrimSpace(q.Get("vendor")); vendor != "" {
+		conditions = append(conditions, "(instr(LOWER(COALESCE(vendor, '')), ?) > 0 OR instr(LOWER(COALESCE(oui_vendor, '')), ?) > 0)")
+		args = append(args, strings.ToLower(vendor), strings.ToLower(vendor))
+	}
+	if tag := strings.TrimSpace(q.Get("tag")); tag != "" {
+		conditions = append(conditions, "mac_address IN (SELECT mac_address FROM device_tag WHERE tag = ?)")
+		args = append(args, tag)
+	}
+	if value := strings.TrimSpace(q.Get("seen_since")); value != "" {
+		since, err := parseSeenSince(value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		conditions = append(conditions, "last_seen >= ?")
+		args = append(args, since)
+	}
+	if value := strings.TrimSpace(q.Get("ip")); value != "" {
+		prefix, err := parseIPFilter(value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		macs, err := devicesMatchingIP(prefix)
+		if err != nil {
+			log.Printf("❌ %v", err)
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			return
+		}
+		if len(macs) == 0 {
+			conditions = append(conditions, "1 = 0")
+		} else {
+			conditions = append(conditions, "mac_address IN (?"+strings.Repeat(", ?", len(macs)-1)+")")
+			for _, mac := range macs {
+				args = append(args, mac)
+			}
+		}
+	}
+
+	sortKey := q.Get("sort")
+	if sortKey == "" {
+		sortKey = "last_seen"
+	}
+	column, ok := deviceSortColumns[sortKey]
+	if !ok {
+		http.Error(w, "sort must be one of last_seen, first_seen, mac, vendor, hostname, seen_count, danger", http.StatusBadRequest)
+		return
+	}
+	order := q.Get("order")
+	if order == "" {
+		order = "asc"
+		if sortKey == "last_seen" || sortKey == "first_seen" || deviceSortNumeric[sortKey] {
+			order = "desc"
+		}
+	}
+	if order != "asc" && order != "desc" {
+		http.Error(w, "order must be asc or desc", http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultDeviceLimit
+	if value := q.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		if n > maxDeviceLimit {
+			n = maxDeviceLimit
+		}
+		limit = n
+	}
+
+	// 絞り込みに一致する件数（ページングとは関係なく数える）
+	where := strings.Join(conditions, " AND ")
+	countQuery := "SELECT COUNT(*) FROM device"
+	if where != "" {
+		countQuery += " WHERE " + where
+	}
+	var total int
+	if err := db.QueryRow(countQuery, args...).Scan(&total); err != nil {
+		log.Printf("❌ 機器数取得エラー: %v", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+
+	cmp := ">"
+	if order == "desc" {
+		cmp = "<"
+	}
+	if value := q.Get("cursor"); value != "" {
+		cursor, err := decodeDeviceCursor(value, sortKey, order)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var sortValue interface{} = cursor.Value
+		if deviceSortNumeric[sortKey] {
+			sortValue, _ = strconv.Atoi(cursor.Value)
+		}
+		if sortKey == "mac" {
+			conditions = append(conditions, "mac_address "+cmp+" ?")
+			args = append(args, cursor.MAC)
+		} else {
+			conditions = append(conditions, fmt.Sprintf("(%s %s ? OR (%s = ? AND mac_address %s ?))", column, cmp, column, cmp))
+			args = append(args, sortValue, sortValue, cursor.MAC)
+		}
+	}
+
+	orderBy := column + " " + strings.ToUpper(order)
+	if sortKey != "mac" {
+		orderBy += ", mac_address " + strings.ToUpper(order)
+	}
+	// 次のページがあるかを判定するため1件多く取得する
+	devices, err := queryDevicesOrdered(strings.Join(conditions, " AND "), orderBy, limit+1, args...)
+	if err != nil {
+		log.Printf("❌ %v", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	nextCursor := ""
+	if len(devices) > limit {
+		devices = devices[:limit]
+		last := devices[len(devices)-1]
+		nextCursor = encodeDeviceCursor(deviceCursor{Sort: sortKey, Order: order, Value: deviceSortValue(last, sortKey), MAC: last.MACAddress})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":      "success",
+		"count":       len(devices),
+		"total_count": total,
+		"sort":        sortKey,
+		"order":       order,
+		"next_cursor": nextCursor,
+		"devices":     devices,
+		"summary":     deviceSummary(),
+		"timestamp":   time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
+
+// DeviceObservation type: device_observation テーブルの1行（機器の1回分の観測）
+type DeviceObservation struct {
+	IPAddress  string `json:"ip_address"`
+	Vendor     string `json:"vendor"`
+	Hostname   string `json:"hostname,omitempty"`
+	Interface  string `json:"interface,omitempty"`
+	ObservedAt string `json:"observed_at"`
+	ScanID     int64  `json:"scan_id,omitempty"`
+}
+
+// queryObservations function: 機器の観測履歴を新しい順に最大 limit 件取得
+func queryObservations(macAddress string, limit int) ([]DeviceObservation, error) {
+	rows, err := db.Query(`SELECT COALESCE(ip_address, ''), COALESCE(vendor, ''), COALESCE(hostname, ''), COALESCE(interface, ''), observed_at, COALESCE(scan_id, 0)
+		FROM device_observation WHERE mac_address = ? ORDER BY observed_at DESC, id DESC LIMIT ?`, macAddress, limit)
+	if err != nil {
+		return nil, fmt.Errorf("観測履歴取得エラー: %v", err)
+	}
+	defer rows.Close()
+
+	observations := []DeviceObservation{}
+	for rows.Next() {
+		var o DeviceObservation
+		if err := rows.Scan(&o.IPAddress, &o.Vendor, &o.Hostname, &o.Interface, &o.ObservedAt, &o.ScanID); err != nil {
+			return nil, fmt.Errorf("観測履歴読み込みエラー: %v", err)
+		}
+		observations = append(observations, o)
+	}
+	return observations, rows.Err()
+}
+
+// deviceDetailHandler function: 1台の機器の現在の状態と、IPアドレスの履歴・危険判定の遷移と証跡・注釈・インシデント・手動判定の記録をまとめて返す
+// ?observations= で返す観測履歴の件数を指定（デフォルト 50）
+func deviceDetailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeRequest(w, r) || !databaseReady(w) {
+		return
+	}
+	mac, ok := annotationMACFromPath(w, r)
+	if !ok {
+		return
+	}
+	observationLimit := 50
+	if value := r.URL.Query().Get("observations"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, "observations must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		observationLimit = n
+	}
+
+	devices, err := queryDevices("mac_address = ?", mac)
+	if err != nil {
+		log.Printf("❌ %v", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	if len(devices) == 0 {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	var annotation *Annotation
+	annotations, err := queryAnnotations("mac_address = ?", mac)
+	if err == nil && len(annotations) > 0 {
+		annotation = &annotations[0]
+	}
+	var addresses map[string][]DeviceAddress
+	if err == nil {
+		addresses, err = queryAddresses("a.mac_address = ?", mac)
+	}
+	var observations []DeviceObservation
+	if err == nil {
+		observations, err = queryObservations(mac, observationLimit)
+	}
+	var dangers []DangerRecord
+	if err == nil {
+		dangers, err = queryDangers("mac_address = ?", mac)
+	}
+	var transitions []DangerTransition
+	if err == nil {
+		transitions, err = queryDangerTransitions(mac)
+	}
+	var events []SecurityEvent
+	if err == nil {
+		events, err = querySecurityEvents("mac_address = ? OR related_mac = ?", 100, mac, mac)
+	}
+	var leases []DHCPLease
+	if err == nil {
+		leases, err = queryLeases(mac)
+	}
+	var incidents []Incident
+	if err == nil {
+		incidents, err = queryIncidents("mac_address = ?", mac)
+	}
+	var overrideEvents []OverrideEvent
+	if err == nil {
+		overrideEvents, err = queryOverrideEvents(mac)
+	}
+	if err != nil {
+		log.Printf("❌ %v", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	addressHistory := addresses[mac]
+	if addressHistory == nil {
+		addressHistory = []DeviceAddress{}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":             "success",
+		"device":             devices[0],
+		"annotation":         annotation,
+		"address_history":    addressHistory,
+		"observations":       observations,
+		"dangers":            dangers,
+		"danger_transitions": transitions,
+		"security_events":    events,
+		"dhcp_leases":        leases,
+		"incidents":          incidents,
+		"override_history":   overrideEvents,
+		"timestamp":          time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
@@ -0,0 +1,630 @@
+package backend
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 機器台帳のエクスポート・インポートの形式
+const (
+	InventoryFormatCSV  = "csv"
+	InventoryFormatJSON = "json"
+)
+
+// inventoryListSeparator: CSV の1つのセルに複数の値（IPアドレス・タグなど）を入れる場合の区切り文字
+const inventoryListSeparator = ";"
+
+// inventoryCSVColumns: CSV の列（is_dangerous・danger_sources・override・is_unknown はエクスポートのみで、インポートでは無視する）
+var inventoryCSVColumns = []string{
+	"mac_address", "ip_addresses", "vendor", "hostname", "first_seen", "last_seen", "seen_count",
+	"is_dangerous", "danger_sources", "override", "is_unknown", "allowlisted", "allowlist_label",
+	"name", "owner", "location", "notes", "tags",
+}
+
+// inventoryCSVAliases: インポートで受け付ける列名の別名
+var inventoryCSVAliases = map[string]string{
+	"mac":        "mac_address",
+	"ip":         "ip_addresses",
+	"ip_address": "ip_addresses",
+}
+
+// InventoryRecord type: 機器台帳の1台分（機器・危険判定・注釈・登録済み機器をまとめたもの）
+type InventoryRecord struct {
+	MACAddress     string   `json:"mac_address"`
+	IPAddresses    []string `json:"ip_addresses"`
+	Vendor         string   `json:"vendor"`
+	Hostname       string   `json:"hostname"`
+	FirstSeen      string   `json:"first_seen"`
+	LastSeen       string   `json:"last_seen"`
+	SeenCount      int      `json:"seen_count"`
+	IsDangerous    bool     `json:"is_dangerous"`
+	DangerSources  []string `json:"danger_sources"`
+	Override       string   `json:"override"`
+	IsUnknown      bool     `json:"is_unknown"`
+	Allowlisted    bool     `json:"allowlisted"` // MACアドレス単位で登録済み機器一覧にあるか（OUI単位の登録は含めない）
+	AllowlistLabel string   `json:"allowlist_label"`
+	Name           string   `json:"name"`
+	Owner          string   `json:"owner"`
+	Location       string   `json:"location"`
+	Notes          string   `json:"notes"`
+	Tags           []string `json:"tags"`
+}
+
+// inventoryImportRecord type: インポートする1台分。注釈・登録済み機器の項目は指定されたものだけ反映する
+type inventoryImportRecord struct {
+	Key            string    `json:"-"` // エラー表示用（CSV は行番号、JSON は配列の位置）
+	MACAddress     string    `json:"mac_address"`
+	IPAddresses    []string  `json:"ip_addresses"`
+	Vendor         string    `json:"vendor"`
+	Hostname       string    `json:"hostname"`
+	FirstSeen      string    `json:"first_seen"`
+	LastSeen       string    `json:"last_seen"`
+	SeenCount      int       `json:"seen_count"`
+	Allowlisted    *bool     `json:"allowlisted"`
+	AllowlistLabel *string   `json:"allowlist_label"`
+	Name           *string   `json:"name"`
+	Owner          *string   `json:"owner"`
+	Location       *string   `json:"location"`
+	Notes          *string   `json:"notes"`
+	Tags           *[]string `json:"tags"`
+}
+
+// inventoryChange type: インポートで1台の機器に加えた（dry-run では加える予定の）変更
+type inventoryChange struct {
+	Key        string   `json:"key"`
+	MACAddress string   `json:"mac_address"`
+	Changes    []string `json:"changes"`
+}
+
+// exportInventory function: 機器・注釈・MACアドレス単位の登録済み機器をMACアドレス順にまとめる（注釈・登録だけの機器も含める）
+func exportInventory() ([]InventoryRecord, error) {
+	devices, err := queryDevicesOrdered("", "mac_address", 0)
+	if err != nil {
+		return nil, err
+	}
+	annotations, err := DeviceAnnotations()
+	if err != nil {
+		return nil, err
+	}
+	known, err := queryKnownDevices("kind = ?", KnownKindMAC)
+	if err != nil {
+		return nil, err
+	}
+
+	byMAC := map[string]*InventoryRecord{}
+	record := func(mac string) *InventoryRecord {
+		if rec, ok := byMAC[mac]; ok {
+			return rec
+		}
+		rec := &InventoryRecord{MACAddress: mac, IPAddresses: []string{}, DangerSources: []string{}, Tags: []string{}}
+		byMAC[mac] = rec
+		return rec
+	}
+	for _, d := range devices {
+		rec := record(d.MACAddress)
+		for _, a := range d.Addresses {
+			rec.IPAddresses = append(rec.IPAddresses, a.IPAddress)
+		}
+		if len(rec.IPAddresses) == 0 && d.IPAddress != "" {
+			rec.IPAddresses = []string{d.IPAddress}
+		}
+		rec.Vendor, rec.Hostname = d.Vendor, d.Hostname
+		rec.FirstSeen, rec.LastSeen, rec.SeenCount = d.FirstSeen, d.LastSeen, d.SeenCount
+		rec.IsDangerous, rec.IsUnknown = d.IsDangerous, d.IsUnknown
+		for _, danger := range d.Dangers {
+			rec.DangerSources = append(rec.DangerSources, danger.Source)
+		}
+		if d.Override != nil {
+			rec.Override = d.Override.Mode
+		}
+	}
+	for mac, a := range annotations {
+		rec := record(mac)
+		rec.Name, rec.Owner, rec.Location, rec.Notes, rec.Tags = a.Name, a.Owner, a.Location, a.Notes, a.Tags
+	}
+	for _, k := range known {
+		rec := record(k.Pattern)
+		rec.Allowlisted, rec.AllowlistLabel = true, k.Label
+	}
+
+	records := make([]InventoryRecord, 0, len(byMAC))
+	for _, mac := range sortedKeys(byMAC) {
+		records = append(records, *byMAC[mac])
+	}
+	return records, nil
+}
+
+// csvRow function: CSV の1行（inventoryCSVColumns の順）
+func (rec InventoryRecord) csvRow() []string {
+	return []string{
+		rec.MACAddress, strings.Join(rec.IPAddresses, inventoryListSeparator), rec.Vendor, rec.Hostname,
+		rec.FirstSeen, rec.LastSeen, strconv.Itoa(rec.SeenCount),
+		strconv.FormatBool(rec.IsDangerous), strings.Join(rec.DangerSources, inventoryListSeparator), rec.Override,
+		strconv.FormatBool(rec.IsUnknown), strconv.FormatBool(rec.Allowlisted), rec.AllowlistLabel,
+		rec.Name, rec.Owner, rec.Location, rec.Notes, strings.Join(rec.Tags, inventoryListSeparator),
+	}
+}
+
+// splitInventoryList function: CSV のセルの複数の値を区切り文字で分割（空の値は除く）
+func splitInventoryList(value string) []string {
+	values := []string{}
+	for _, v := range strings.Split(value, inventoryListSeparator) {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// parseInventoryCSV function: ヘッダー行のある CSV を読み込む。列がない項目は変更しない
+// 値が不正な行は読み込まずにエラーの一覧に入れる
+func parseInventoryCSV(r io.Reader) ([]inventoryImportRecord, []itemError, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil, fmt.Errorf("CSV is empty")
+	} else if err != nil {
+		return nil, nil, err
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if alias, ok := inventoryCSVAliases[name]; ok {
+			name = alias
+		}
+		columns[name] = i
+	}
+	if _, ok := columns["mac_address"]; !ok {
+		return nil, nil, fmt.Errorf("CSV header must include mac_address (columns: %s)", strings.Join(inventoryCSVColumns, ","))
+	}
+
+	var records []inventoryImportRecord
+	itemErrors := []itemError{}
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		cell := func(name string) (string, bool) {
+			i, ok := columns[name]
+			if !ok || i >= len(row) {
+				return "", ok
+			}
+			return strings.TrimSpace(row[i]), true
+		}
+		optional := func(name string) *string {
+			if value, ok := cell(name); ok {
+				return &value
+			}
+			return nil
+		}
+
+		rec := inventoryImportRecord{Key: fmt.Sprintf("line %d", line)}
+		rec.MACAddress, _ = cell("mac_address")
+		if rec.MACAddress == "" && len(row) <= 1 {
+			continue
+		}
+		if value, _ := cell("ip_addresses"); value != "" {
+			rec.IPAddresses = splitInventoryList(value)
+		}
+		rec.Vendor, _ = cell("vendor")
+		rec.Hostname, _ = cell("hostname")
+		rec.FirstSeen, _ = cell("first_seen")
+		rec.LastSeen, _ = cell("last_seen")
+		if value, _ := cell("seen_count"); value != "" {
+			if rec.SeenCount, err = strconv.Atoi(value); err != nil {
+				itemErrors = append(itemErrors, itemError{Key: rec.Key, Error: fmt.Sprintf("seen_count must be an integer: %q", value)})
+				continue
+			}
+		}
+		if value, ok := cell("allowlisted"); ok && value != "" {
+			allowlisted, err := strconv.ParseBool(value)
+			if err != nil {
+				itemErrors = append(itemErrors, itemError{Key: rec.Key, Error: fmt.Sprintf("allowlisted must be true or false: %q", value)})
+				continue
+			}
+			rec.Allowlisted = &allowlisted
+		}
+		rec.AllowlistLabel = optional("allowlist_label")
+		rec.Name = optional("name")
+		rec.Owner = optional("owner")
+		rec.Location = optional("location")
+		rec.Notes = optional("notes")
+		if value, ok := cell("tags"); ok {
+			tags := splitInventoryList(value)
+			rec.Tags = &tags
+		}
+		records = append(records, rec)
+	}
+	return records, itemErrors, nil
+}
+
+// parseInventoryJSON function: エクスポートした JSON（{"devices": [...]}）または機器の配列を読み込む
+func parseInventoryJSON(r io.Reader) ([]inventoryImportRecord, error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var records []inventoryImportRecord
+	if trimmed := strings.TrimSpace(string(body)); strings.HasPrefix(trimmed, "[") {
+		err = json.Unmarshal(body, &records)
+	} else {
+		var doc struct {
+			Devices []inventoryImportRecord `json:"devices"`
+		}
+		err = json.Unmarshal(body, &doc)
+		records = doc.Devices
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := range records {
+		records[i].Key = fmt.Sprintf("devices[%d]", i)
+	}
+	return records, nil
+}
+
+// inventoryImport type: 検証・正規化済みのインポートする1台分
+type inventoryImport struct {
+	Key            string
+	Obs            observation
+	FirstSeen      string
+	LastSeen       string
+	SeenCount      int
+	HasSighting    bool // IPアドレスまたは last_seen があり、未登録なら機器を作成する
+	Annotation     annotationRequest
+	Allowlisted    *bool
+	AllowlistLabel *string
+}
+
+// validateInventoryRecord function: 1台分を /upload と同じ正規化（MACアドレス・IPアドレス・ホスト名・日時）で検証
+func validateInventoryRecord(rec inventoryImportRecord, at string) (inventoryImport, error) {
+	v := inventoryImport{
+		Key:            rec.Key,
+		Obs:            observation{Key: rec.Key, MAC: rec.MACAddress, IPs: rec.IPAddresses, Vendor: strings.TrimSpace(rec.Vendor), Hostname: strings.TrimSpace(rec.Hostname)},
+		SeenCount:      rec.SeenCount,
+		Annotation:     annotationRequest{Name: rec.Name, Owner: rec.Owner, Location: rec.Location, Notes: rec.Notes, Tags: rec.Tags},
+		Allowlisted:    rec.Allowlisted,
+		AllowlistLabel: rec.AllowlistLabel,
+	}
+	if err := normalizeObservation(&v.Obs); err != nil {
+		return v, err
+	}
+	var err error
+	if v.LastSeen, err = parseObservedAt(strings.TrimSpace(rec.LastSeen), at); err != nil {
+		return v, fmt.Errorf("last_seen: %v", err)
+	}
+	if v.FirstSeen, err = parseObservedAt(strings.TrimSpace(rec.FirstSeen), v.LastSeen); err != nil {
+		return v, fmt.Errorf("first_seen: %v", err)
+	}
+	if v.FirstSeen > v.LastSeen {
+		return v, fmt.Errorf("first_seen is after last_seen")
+	}
+	if v.SeenCount < 0 {
+		return v, fmt.Errorf("seen_count must not be negative")
+	}
+	if v.SeenCount == 0 {
+		v.SeenCount = 1
+	}
+	v.HasSighting = len(v.Obs.IPs) > 0 || strings.TrimSpace(rec.LastSeen) != ""
+	if rec.Tags != nil {
+		if _, err := normalizeTags(*rec.Tags); err != nil {
+			return v, err
+		}
+	}
+	return v, nil
+}
+
+// importInventoryRecord function: 検証済みの1台分を反映し、加えた変更と機器を作成したかを返す
+// 機器は未登録の場合のみ作成し、既存の機器の検出情報はセンサーの報告を優先して変更しない
+func importInventoryRecord(tx *sql.Tx, v inventoryImport, operator, at string) ([]string, bool, error) {
+	mac := v.Obs.MAC
+	var changes []string
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM device WHERE mac_address = ?)", mac).Scan(&exists); err != nil {
+		return nil, false, fmt.Errorf("機器取得エラー (MAC: %s): %v", mac, err)
+	}
+	created := !exists && v.HasSighting
+	if created {
+		check, err := checkVendor(tx, mac, v.Obs.Vendor)
+		if err != nil {
+			return nil, false, err
+		}
+		_, err = tx.Exec(`INSERT INTO device (mac_address, ip_address, vendor, hostname, is_dangerous, first_seen, last_seen, seen_count)
+			VALUES (?, ?, ?, COALESCE(NULLIF(?, ''), (SELECT hostname FROM dhcp_lease WHERE mac_address = ? AND hostname IS NOT NULL
+				ORDER BY updated_at DESC LIMIT 1)), FALSE, ?, ?, ?)`,
+			mac, v.Obs.IP(), check.Vendor, v.Obs.Hostname, mac, v.FirstSeen, v.LastSeen, v.SeenCount)
+		if err != nil {
+			return nil, false, fmt.Errorf("機器作成エラー (MAC: %s): %v", mac, err)
+		}
+		if err := recordAddresses(tx, mac, v.Obs.IPs, v.LastSeen); err != nil {
+			return nil, false, err
+		}
+		if err := recordVendorCheck(tx, mac, v.Obs.IP(), v.Obs.Vendor, check, at); err != nil {
+			return nil, false, err
+		}
+		changes = append(changes, fmt.Sprintf("device: created (ips: %v, last_seen: %s)", v.Obs.IPs, v.LastSeen))
+	}
+
+	// 注釈（指定された項目のみ更新）
+	req := v.Annotation
+	if req.Name != nil || req.Owner != nil || req.Location != nil || req.Notes != nil || req.Tags != nil {
+		before := Annotation{MACAddress: mac, Tags: []string{}}
+		current, err := loadAnnotation(tx, mac)
+		if err != nil {
+			return nil, false, err
+		}
+		found := current != nil
+		if found {
+			before = *current
+		}
+		after := before
+		if err := req.apply(&after, false); err != nil {
+			return nil, false, err
+		}
+		empty := after.Name == "" && after.Owner == "" && after.Location == "" && after.Notes == "" && len(after.Tags) == 0
+		if diff := diffAnnotation(before, after); len(diff) > 0 && (found || !empty) {
+			after.UpdatedAt, after.UpdatedBy = at, operator
+			if err := saveAnnotation(tx, after); err != nil {
+				return nil, false, err
+			}
+			changes = append(changes, diff...)
+		}
+	}
+
+	// MACアドレス単位の登録済み機器
+	if v.Allowlisted != nil {
+		var label string
+		err := tx.QueryRow("SELECT COALESCE(label, '') FROM known_device WHERE pattern = ? AND kind = ?", mac, KnownKindMAC).Scan(&label)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, false, fmt.Errorf("登録済み機器取得エラー (MAC: %s): %v", mac, err)
+		}
+		listed := err == nil
+		newLabel := label
+		if v.AllowlistLabel != nil {
+			newLabel = strings.TrimSpace(*v.AllowlistLabel)
+		}
+		switch {
+		case *v.Allowlisted && (!listed || newLabel != label):
+			if err := addKnownDevice(tx, mac, KnownKindMAC, newLabel, operator, at); err != nil {
+				return nil, false, err
+			}
+			if listed {
+				changes = append(changes, fmt.Sprintf("allowlist.label: %q → %q", label, newLabel))
+			} else {
+				changes = append(changes, fmt.Sprintf("allowlist: added (label: %q)", newLabel))
+			}
+		case !*v.Allowlisted && listed:
+			if _, err := tx.Exec("DELETE FROM known_device WHERE pattern = ? AND kind = ?", mac, KnownKindMAC); err != nil {
+				return nil, false, fmt.Errorf("登録済み機器削除エラー (%s): %v", mac, err)
+			}
+			changes = append(changes, "allowlist: removed")
+		}
+	}
+	return changes, created, nil
+}
+
+// loadAnnotation function: トランザクション内で1台分の注釈をタグ付きで取得（未登録なら nil）
+func loadAnnotation(tx *sql.Tx, mac string) (*Annotation, error) {
+	a := Annotation{MACAddress: mac, Tags: []string{}}
+	err := tx.QueryRow(`SELECT COALESCE(name, ''), COALESCE(owner, ''), COALESCE(location, ''), COALESCE(notes, '')
+		FROM device_annotation WHERE mac_address = ?`, mac).Scan(&a.Name, &a.Owner, &a.Location, &a.Notes)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("注釈取得エラー (MAC: %s): %v", mac, err)
+	}
+	rows, err := tx.Query("SELECT tag FROM device_tag WHERE mac_address = ? ORDER BY tag", mac)
+	if err != nil {
+		return nil, fmt.Errorf("タグ取得エラー (MAC: %s): %v", mac, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, fmt.Errorf("タグ読み込みエラー (MAC: %s): %v", mac, err)
+		}
+		a.Tags = append(a.Tags, tag)
+	}
+	return &a, rows.Err()
+}
+
+// diffAnnotation function: 注釈の変更を "name: "a" → "b"" の形式で返す
+func diffAnnotation(before, after Annotation) []string {
+	var changes []string
+	for _, f := range []struct {
+		name          string
+		before, after string
+	}{
+		{"name", before.Name, after.Name},
+		{"owner", before.Owner, after.Owner},
+		{"location", before.Location, after.Location},
+		{"notes", before.Notes, after.Notes},
+	} {
+		if f.before != f.after {
+			changes = append(changes, fmt.Sprintf("annotation.%s: %q → %q", f.name, f.before, f.after))
+		}
+	}
+	if !reflect.DeepEqual(before.Tags, after.Tags) {
+		changes = append(changes, fmt.Sprintf("annotation.tags: %v → %v", before.Tags, after.Tags))
+	}
+	return changes
+}
+
+// inventoryImportFormat function: ?format= または Content-Type からインポートの形式を判定（既定は JSON）
+func inventoryImportFormat(r *http.Request) (string, error) {
+	switch format := strings.ToLower(r.URL.Query().Get("format")); format {
+	case InventoryFormatCSV, InventoryFormatJSON:
+		return format, nil
+	case "":
+	default:
+		return "", fmt.Errorf("format must be csv or json")
+	}
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil && strings.HasSuffix(mediaType, "csv") {
+		return InventoryFormatCSV, nil
+	}
+	return InventoryFormatJSON, nil
+}
+
+// inventoryExportHandler function: 機器台帳（MACアドレス・IPアドレス・ベンダー・危険判定・注釈・登録済み機器）を CSV または JSON で返す
+func inventoryExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeRequest(w, r) || !databaseReady(w) {
+		return
+	}
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	if format == "" {
+		format = InventoryFormatJSON
+	}
+	if format != InventoryFormatCSV && format != InventoryFormatJSON {
+		http.Error(w, "format must be csv or json", http.StatusBadRequest)
+		return
+	}
+
+	records, err := exportInventory()
+	if err != nil {
+		log.Printf("❌ %v", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+
+	if format == InventoryFormatJSON {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status":    "success",
+			"count":     len(records),
+			"devices":   records,
+			"timestamp": time.Now().Format("2006-01-02 15:04:05"),
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="nethygiene-inventory-%s.csv"`, time.Now().Format("20060102")))
+	writer := csv.NewWriter(w)
+	writer.Write(inventoryCSVColumns)
+	for _, rec := range records {
+		writer.Write(rec.csvRow())
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Printf("❌ CSV出力エラー: %v", err)
+	}
+}
+
+// inventoryImportHandler function: CSV または JSON の機器台帳を取り込む（?dry_run=true なら変更内容だけを返して保存しない）
+// 注釈・登録済み機器の一括登録にも使える（mac_address と必要な列だけの CSV でよい）。
+// 管理トークン（ADMIN_TOKENS）が必要で、更新者・登録者はトークンから決める
+func inventoryImportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	operator, ok := authorizeAdmin(w, r)
+	if !ok || !databaseReady(w) {
+		return
+	}
+	format, err := inventoryImportFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+
+	var records []inventoryImportRecord
+	itemErrors := []itemError{}
+	if format == InventoryFormatCSV {
+		records, itemErrors, err = parseInventoryCSV(r.Body)
+	} else {
+		records, err = parseInventoryJSON(r.Body)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid %s data: %v", strings.ToUpper(format), err), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("❌ トランザクション開始エラー: %v", err)
+		http.Error(w, "Database update failed", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	now := nowTimestamp()
+	count := len(records) + len(itemErrors)
+	changes := []inventoryChange{}
+	createdCount, unchangedCount := 0, 0
+	for _, rec := range records {
+		v, err := validateInventoryRecord(rec, now)
+		if err != nil {
+			itemErrors = append(itemErrors, itemError{Key: rec.Key, Error: err.Error()})
+			continue
+		}
+		recordChanges, created, err := importInventoryRecord(tx, v, operator, now)
+		if err != nil {
+			log.Printf("❌ %v", err)
+			http.Error(w, "Database update failed", http.StatusInternalServerError)
+			return
+		}
+		if created {
+			createdCount++
+		}
+		if len(recordChanges) == 0 {
+			unchangedCount++
+			continue
+		}
+		changes = append(changes, inventoryChange{Key: rec.Key, MACAddress: v.Obs.MAC, Changes: recordChanges})
+	}
+
+	// 作成した機器と登録済み機器の変更を未登録フラグに反映
+	if len(changes) > 0 {
+		if err := refreshAllUnknownFlags(tx, now); err != nil {
+			log.Printf("❌ %v", err)
+			http.Error(w, "Database update failed", http.StatusInternalServerError)
+			return
+		}
+	}
+	if !dryRun {
+		if err := tx.Commit(); err != nil {
+			log.Printf("❌ コミットエラー: %v", err)
+			http.Error(w, "Database update failed", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("✅ 機器台帳をインポートしました (%s, %d件, 変更: %d件, エラー: %d件, by %s)", format, count, len(changes), len(itemErrors), operator)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":          "success",
+		"dry_run":         dryRun,
+		"format":          format,
+		"count":           count,
+		"changed_count":   len(changes),
+		"created_count":   createdCount,
+		"unchanged_count": unchangedCount,
+		"changes":         changes,
+		"error_count":     len(itemErrors),
+		"errors":          itemErrors,
+		"timestamp":       time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
@@ -0,0 +1,195 @@
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseInventoryCSV(t *testing.T) {
+	tests := []struct {
+		name       string
+		csv        string
+		wantMACs   []string
+		wantErrors []string // 読み込まなかった行のキー
+		wantErr    bool
+	}{
+		{
+			name:     "header aliases and BOM",
+			csv:      "\ufeffMAC,ip,name\naa:bb:cc:00:00:01,192.168.1.10;192.168.1.11,pc\n",
+			wantMACs: []string{"aa:bb:cc:00:00:01"},
+		},
+		{
+			name:     "comments and empty lines are skipped",
+			csv:      "mac_address,tags\n# comment\n\naa:bb:cc:00:00:01,a;b\n",
+			wantMACs: []string{"aa:bb:cc:00:00:01"},
+		},
+		{
+			name:       "invalid values are reported per line",
+			csv:        "mac_address,seen_count,allowlisted\naa:bb:cc:00:00:01,x,\naa:bb:cc:00:00:02,1,maybe\naa:bb:cc:00:00:03,2,true\n",
+			wantMACs:   []string{"aa:bb:cc:00:00:03"},
+			wantErrors: []string{"line 2", "line 3"},
+		},
+		{name: "missing mac_address column", csv: "name,owner\npc,alice\n", wantErr: true},
+		{name: "empty", csv: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, itemErrors, err := parseInventoryCSV(strings.NewReader(tt.csv))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseInventoryCSV = %+v, want error", records)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseInventoryCSV error: %v", err)
+			}
+			var macs, errorKeys []string
+			for _, rec := range records {
+				macs = append(macs, rec.MACAddress)
+			}
+			for _, e := range itemErrors {
+				errorKeys = append(errorKeys, e.Key)
+			}
+			if !reflect.DeepEqual(macs, tt.wantMACs) {
+				t.Errorf("records = %v, want %v", macs, tt.wantMACs)
+			}
+			if !reflect.DeepEqual(errorKeys, tt.wantErrors) {
+				t.Errorf("errors = %v, want %v (%+v)", errorKeys, tt.wantErrors, itemErrors)
+			}
+		})
+	}
+}
+
+func TestParseInventoryCSVOptionalColumns(t *testing.T) {
+	records, _, err := parseInventoryCSV(strings.NewReader("mac_address,name,tags,allowlisted\naa:bb:cc:00:00:01,,x; y ;x,false\n"))
+	if err != nil || len(records) != 1 {
+		t.Fatalf("parseInventoryCSV = %+v, %v", records, err)
+	}
+	rec := records[0]
+	// 列がある項目は空でも指定されたものとして扱い、列がない項目は変更しない
+	if rec.Name == nil || *rec.Name != "" {
+		t.Errorf("name = %v, want empty string", rec.Name)
+	}
+	if rec.Owner != nil {
+		t.Errorf("owner = %q, want nil", *rec.Owner)
+	}
+	if rec.Tags == nil || !reflect.DeepEqual(*rec.Tags, []string{"x", "y", "x"}) {
+		t.Errorf("tags = %v, want [x y x]", rec.Tags)
+	}
+	if rec.Allowlisted == nil || *rec.Allowlisted {
+		t.Errorf("allowlisted = %v, want false", rec.Allowlisted)
+	}
+}
+
+func TestValidateInventoryRecord(t *testing.T) {
+	const at = "2026-10-15 12:00:00"
+	str := func(s string) *string { return &s }
+	tests := []struct {
+		name         string
+		rec          inventoryImportRecord
+		wantMAC      string
+		wantSeen     [2]string
+		wantSighting bool
+		wantErr      bool
+		wantCount    int
+	}{
+		{
+			name:      "annotation only",
+			rec:       inventoryImportRecord{MACAddress: "AA-BB-CC-00-00-01", Name: str("pc")},
+			wantMAC:   "aa:bb:cc:00:00:01",
+			wantSeen:  [2]string{at, at},
+			wantCount: 1,
+		},
+		{
+			name:         "sighting with timestamps",
+			rec:          inventoryImportRecord{MACAddress: "aa:bb:cc:00:00:01", IPAddresses: []string{"192.168.1.10"}, FirstSeen: "2026-10-01T00:00:00Z", LastSeen: "2026-10-10 00:00:00", SeenCount: 5},
+			wantMAC:      "aa:bb:cc:00:00:01",
+			wantSeen:     [2]string{"2026-10-01 00:00:00", "2026-10-10 00:00:00"},
+			wantSighting: true,
+			wantCount:    5,
+		},
+		{name: "invalid MAC", rec: inventoryImportRecord{MACAddress: "zz"}, wantErr: true},
+		{name: "invalid IP", rec: inventoryImportRecord{MACAddress: "aa:bb:cc:00:00:01", IPAddresses: []string{"999.1.1.1"}}, wantErr: true},
+		{name: "first_seen after last_seen", rec: inventoryImportRecord{MACAddress: "aa:bb:cc:00:00:01", FirstSeen: "2026-10-10 00:00:00", LastSeen: "2026-10-01 00:00:00"}, wantErr: true},
+		{name: "negative seen_count", rec: inventoryImportRecord{MACAddress: "aa:bb:cc:00:00:01", SeenCount: -1}, wantErr: true},
+		{name: "invalid last_seen", rec: inventoryImportRecord{MACAddress: "aa:bb:cc:00:00:01", LastSeen: "yesterday"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := validateInventoryRecord(tt.rec, at)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("validateInventoryRecord = %+v, want error", v)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("validateInventoryRecord error: %v", err)
+			}
+			if v.Obs.MAC != tt.wantMAC || v.FirstSeen != tt.wantSeen[0] || v.LastSeen != tt.wantSeen[1] ||
+				v.HasSighting != tt.wantSighting || v.SeenCount != tt.wantCount {
+				t.Errorf("validateInventoryRecord = %+v", v)
+			}
+		})
+	}
+}
+
+func TestInventoryImportHandler(t *testing.T) {
+	t.Setenv("NET_TOKEN", "sensor-token")
+	t.Setenv("ADMIN_TOKENS", "alice:admin-token")
+	const body = "mac_address,ip_addresses,name,allowlisted\naa:bb:cc:00:00:01,192.168.1.10,pc,true\nzz,,x,\n"
+
+	tests := []struct {
+		name       string
+		token      string
+		query      string
+		wantStatus int
+		wantSaved  bool
+	}{
+		{name: "sensor token is rejected", token: "sensor-token", wantStatus: http.StatusUnauthorized},
+		{name: "dry run does not save", token: "admin-token", query: "?dry_run=true", wantStatus: http.StatusOK},
+		{name: "operator comes from the admin token", token: "admin-token", query: "?operator=mallory", wantStatus: http.StatusOK, wantSaved: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			database := useTestDatabase(t)
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/inventory/import"+tt.query, strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			req.Header.Set("Content-Type", "text/csv")
+			rec := httptest.NewRecorder()
+			inventoryImportHandler(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if rec.Code == http.StatusOK {
+				var resp struct {
+					ChangedCount int `json:"changed_count"`
+					ErrorCount   int `json:"error_count"`
+				}
+				if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+					t.Fatal(err)
+				}
+				if resp.ChangedCount != 1 || resp.ErrorCount != 1 {
+					t.Errorf("changed_count = %d, error_count = %d, want 1, 1", resp.ChangedCount, resp.ErrorCount)
+				}
+			}
+
+			var devices, annotations int
+			var updatedBy, addedBy string
+			database.QueryRow("SELECT COUNT(*) FROM device").Scan(&devices)
+			database.QueryRow("SELECT COUNT(*), COALESCE(MAX(updated_by), '') FROM device_annotation").Scan(&annotations, &updatedBy)
+			database.QueryRow("SELECT COALESCE(MAX(added_by), '') FROM known_device").Scan(&addedBy)
+			if saved := devices == 1 && annotations == 1; saved != tt.wantSaved {
+				t.Fatalf("saved = %v (devices: %d, annotations: %d), want %v", saved, devices, annotations, tt.wantSaved)
+			}
+			if tt.wantSaved && (updatedBy != "alice" || addedBy != "alice") {
+				t.Errorf("updated_by = %q, added_by = %q, want alice", updatedBy, addedBy)
+			}
+		})
+	}
+}
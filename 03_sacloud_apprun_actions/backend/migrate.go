@@ -0,0 +1,608 @@
+package backend
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+)
+
+// migration type: スキーマ変更の1ステップ
+// up はトランザクション内で実行され、schema_migrations への記録と同時にコミットされる。
+// Litestream でレプリケーションしている既存DBにも適用するため、テーブルの作り直しは行わず
+// CREATE TABLE IF NOT EXISTS / ADD COLUMN など既存データを残す変更のみを記述する
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+// MigrationState type: マイグレーションの適用状況
+type MigrationState struct {
+	Version   int    `json:"version"`
+	Name      string `json:"name"`
+	Applied   bool   `json:"applied"`
+	AppliedAt string `json:"applied_at,omitempty"`
+}
+
+// migrations: 適用順に並べたマイグレーション一覧。追加のみ行い、適用済みのステップは変更しない
+var migrations = []migration{
+	{1, "create device table", migrateCreateDevice},
+	{2, "add device sighting history", migrateSightingHistory},
+	{3, "add arp binding security events", migrateSecurityEvents},
+	{4, "add scan sessions", migrateScanSessions},
+	{5, "replace danger reason columns with device_danger", migrateDangerRecords},
+	{6, "add danger hits for incremental status mode", migrateDangerHits},
+	{7, "add incidents", migrateIncidents},
+	{8, "add device annotations and tags", migrateAnnotations},
+	{9, "add known device allowlist", migrateAllowlist},
+	{10, "add oui vendor table and vendor check columns", migrateOUIVendors},
+	{11, "add netfilter flow records", migrateFlows},
+	{12, "add idempotency keys for ingestion", migrateIdempotencyKeys},
+	{13, "add v2 payload fields (hostname, interface, sensor scan id)", migrateObservationDetails},
+	{14, "add device addresses for multiple ips and ipv6", migrateDeviceAddresses},
+	{15, "add dhcp leases", migrateDHCPLeases},
+	{16, "add danger state transitions", migrateDangerTransitions},
+	{17, "add manual danger overrides", migrateOverrides},
+	{18, "add indexes for retention purge", migrateRetentionIndexes},
+	{19, "add processing lease to idempotency keys", migrateIdempotencyLease},
+	{20, "add last scan detections", migrateScanDetections},
+	{21, "add ip index on observations for retention", migrateObservationIPIndex},
+}
+
+// migrateCreateDevice function: device テーブルを作成（is_dangerous がない古いDBにはカラムを追加）
+func migrateCreateDevice(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS device (
+		mac_address VARCHAR(50) PRIMARY KEY,
+		ip_address VARCHAR(50),
+		vendor VARCHAR(50),
+		is_dangerous BOOLEAN DEFAULT FALSE
+	)`)
+	if err != nil {
+		return err
+	}
+	return addColumnIfMissing(tx, "device", "is_dangerous", "BOOLEAN DEFAULT FALSE")
+}
+
+// migrateSightingHistory function: 検出日時・検出回数のカラムと観測履歴テーブルを追加
+func migrateSightingHistory(tx *sql.Tx) error {
+	for _, c := range [][2]string{
+		{"first_seen", "TEXT"},
+		{"last_seen", "TEXT"},
+		{"seen_count", "INTEGER DEFAULT 0"},
+	} {
+		if err := addColumnIfMissing(tx, "device", c[0], c[1]); err != nil {
+			return err
+		}
+	}
+	return execAll(tx,
+		`CREATE TABLE IF NOT EXISTS device_observation (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			mac_address VARCHAR(50) NOT NULL,
+			ip_address VARCHAR(50),
+			vendor VARCHAR(50),
+			observed_at TEXT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_device_observation_mac ON device_observation (mac_address, observed_at)`,
+	)
+}
+
+// migrateSecurityEvents function: 危険理由のカラムとセキュリティイベントテーブルを追加
+func migrateSecurityEvents(tx *sql.Tx) error {
+	for _, c := range [][2]string{
+		{"danger_source", "TEXT"},
+		{"danger_reason", "TEXT"},
+	} {
+		if err := addColumnIfMissing(tx, "device", c[0], c[1]); err != nil {
+			return err
+		}
+	}
+	return execAll(tx,
+		`CREATE TABLE IF NOT EXISTS security_event (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			event_type VARCHAR(50) NOT NULL,
+			mac_address VARCHAR(50) NOT NULL,
+			ip_address VARCHAR(50),
+			previous_value VARCHAR(50),
+			related_mac VARCHAR(50),
+			reason TEXT,
+			marked_dangerous BOOLEAN DEFAULT FALSE,
+			detected_at TEXT NOT NULL
+		)`,
+	)
+}
+
+// migrateScanSessions function: スキャンセッションテーブルを追加し、観測履歴にスキャンIDを持たせる
+func migrateScanSessions(tx *sql.Tx) error {
+	err := execAll(tx,
+		`CREATE TABLE IF NOT EXISTS scan_session (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			sensor_id VARCHAR(100) NOT NULL,
+			started_at TEXT NOT NULL,
+			device_count INTEGER DEFAULT 0
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_scan_session_sensor ON scan_session (sensor_id, started_at)`,
+	)
+	if err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(tx, "device_observation", "scan_id", "INTEGER"); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`CREATE INDEX IF NOT EXISTS idx_device_observation_scan ON device_observation (scan_id)`)
+	return err
+}
+
+// migrateDangerRecords function: 危険判定を機器ごと・発生元ごとのレコードに移行し、device の危険理由カラムを削除
+func migrateDangerRecords(tx *sql.Tx) error {
+	now := nowTimestamp()
+	return execAll(tx,
+		`CREATE TABLE IF NOT EXISTS device_danger (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			mac_address VARCHAR(50) NOT NULL,
+			source VARCHAR(20) NOT NULL,
+			severity VARCHAR(20) NOT NULL,
+			reason TEXT,
+			hit_count INTEGER DEFAULT 0,
+			evidence TEXT,
+			state VARCHAR(20) NOT NULL,
+			flagged_at TEXT NOT NULL,
+			last_hit_at TEXT NOT NULL,
+			cleared_at TEXT,
+			UNIQUE (mac_address, source)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_device_danger_state ON device_danger (state, mac_address)`,
+		// 既存の危険フラグは理由が分かる範囲で引き継ぐ
+		`INSERT OR IGNORE INTO device_danger (mac_address, source, severity, reason, hit_count, evidence, state, flagged_at, last_hit_at)
+			SELECT mac_address, COALESCE(danger_source, 'kernlog'),
+				CASE WHEN danger_source = 'arp' THEN 'high' ELSE 'medium' END,
+				COALESCE(danger_reason, 'kern.log で不審な通信を検知しました'), 1, '[]', 'active', '`+now+`', '`+now+`'
+			FROM device WHERE is_dangerous = TRUE`,
+		`ALTER TABLE device DROP COLUMN danger_source`,
+		`ALTER TABLE device DROP COLUMN danger_reason`,
+	)
+}
+
+// migrateDangerHits function: incremental モードでウィンドウ内のヒット数を数えるためのテーブルを追加
+func migrateDangerHits(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE IF NOT EXISTS danger_hit (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			mac_address VARCHAR(50) NOT NULL,
+			source VARCHAR(20) NOT NULL,
+			hit_at TEXT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_danger_hit_mac ON danger_hit (mac_address, source, hit_at)`,
+	)
+}
+
+// migrateIncidents function: インシデントと記録のテーブルを追加し、現在危険な機器のインシデントを作成
+func migrateIncidents(tx *sql.Tx) error {
+	now := nowTimestamp()
+	return execAll(tx,
+		`CREATE TABLE IF NOT EXISTS incident (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			mac_address VARCHAR(50) NOT NULL,
+			status VARCHAR(20) NOT NULL,
+			severity VARCHAR(20) NOT NULL,
+			summary TEXT,
+			hit_count INTEGER DEFAULT 0,
+			opened_at TEXT NOT NULL,
+			last_hit_at TEXT NOT NULL,
+			acknowledged_at TEXT,
+			acknowledged_by VARCHAR(100),
+			resolved_at TEXT,
+			resolved_by VARCHAR(100)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_incident_mac ON incident (mac_address, status)`,
+		`CREATE TABLE IF NOT EXISTS incident_note (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			incident_id INTEGER NOT NULL,
+			kind VARCHAR(20) NOT NULL,
+			actor VARCHAR(100) NOT NULL,
+			body TEXT,
+			created_at TEXT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_incident_note_incident ON incident_note (incident_id)`,
+		`INSERT INTO incident (mac_address, status, severity, summary, hit_count, opened_at, last_hit_at)
+			SELECT d.mac_address, 'open', COALESCE((SELECT severity FROM device_danger WHERE mac_address = d.mac_address AND state = 'active'
+				ORDER BY CASE severity WHEN 'critical' THEN 4 WHEN 'high' THEN 3 WHEN 'medium' THEN 2 ELSE 1 END DESC LIMIT 1), 'medium'),
+				(SELECT group_concat('[' || source || '] ' || COALESCE(reason, ''), ' / ') FROM device_danger
+					WHERE mac_address = d.mac_address AND state = 'active'),
+				0, '`+now+`', '`+now+`'
+			FROM device d WHERE d.is_dangerous = TRUE`,
+	)
+}
+
+// migrateAnnotations function: 機器の名前・所有者・設置場所・メモとタグを追加
+// /upload で更新される device テーブルとは別テーブルにし、スキャン結果で上書きされないようにする
+func migrateAnnotations(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE IF NOT EXISTS device_annotation (
+			mac_address VARCHAR(50) PRIMARY KEY,
+			name VARCHAR(100),
+			owner VARCHAR(100),
+			location VARCHAR(100),
+			notes TEXT,
+			updated_at TEXT NOT NULL,
+			updated_by VARCHAR(100)
+		)`,
+		`CREATE TABLE IF NOT EXISTS device_tag (
+			mac_address VARCHAR(50) NOT NULL,
+			tag VARCHAR(50) NOT NULL,
+			PRIMARY KEY (mac_address, tag)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_device_tag_tag ON device_tag (tag)`,
+	)
+}
+
+// migrateAllowlist function: 登録済み機器（MACアドレスまたはOUI）の一覧と未登録フラグを追加
+// 未登録フラグは kern.log 由来の危険判定 (is_dangerous) とは別に管理する
+func migrateAllowlist(tx *sql.Tx) error {
+	if err := addColumnIfMissing(tx, "device", "is_unknown", "BOOLEAN DEFAULT FALSE"); err != nil {
+		return err
+	}
+	return execAll(tx,
+		`CREATE TABLE IF NOT EXISTS known_device (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			pattern VARCHAR(50) NOT NULL UNIQUE,
+			kind VARCHAR(10) NOT NULL,
+			label VARCHAR(100),
+			added_at TEXT NOT NULL,
+			added_by VARCHAR(100)
+		)`,
+	)
+}
+
+// migrateOUIVendors function: `oui update` で取り込むOUI一覧と、機器ごとのOUI照合結果の列を追加
+func migrateOUIVendors(tx *sql.Tx) error {
+	for _, col := range []struct{ name, definition string }{
+		{"oui_vendor", "VARCHAR(255)"},
+		{"is_randomized", "BOOLEAN DEFAULT FALSE"},
+		{"vendor_mismatch", "BOOLEAN DEFAULT FALSE"},
+	} {
+		if err := addColumnIfMissing(tx, "device", col.name, col.definition); err != nil {
+			return err
+		}
+	}
+	return execAll(tx,
+		`CREATE TABLE IF NOT EXISTS oui_vendor (
+			prefix VARCHAR(8) PRIMARY KEY,
+			organization VARCHAR(255) NOT NULL,
+			imported_at TEXT NOT NULL
+		)`,
+	)
+}
+
+// migrateFlows function: netfilter の LOG 行から取り込んだ通信記録を追加
+func migrateFlows(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE IF NOT EXISTS flow (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			mac_address VARCHAR(50) NOT NULL,
+			prefix VARCHAR(50) NOT NULL,
+			in_interface VARCHAR(50),
+			src_ip VARCHAR(50) NOT NULL,
+			dst_ip VARCHAR(50) NOT NULL,
+			protocol VARCHAR(10),
+			src_port INTEGER,
+			dst_port INTEGER,
+			observed_at TEXT NOT NULL,
+			received_at TEXT NOT NULL,
+			sensor_id VARCHAR(100),
+			raw TEXT
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_flow_mac ON flow (mac_address, observed_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_flow_observed ON flow (observed_at)`,
+	)
+}
+
+// migrateIdempotencyKeys function: /upload・/status の Idempotency-Key と処理結果のレスポンスを保存するテーブルを追加
+func migrateIdempotencyKeys(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE IF NOT EXISTS idempotency_key (
+			endpoint VARCHAR(100) NOT NULL,
+			idempotency_key VARCHAR(255) NOT NULL,
+			request_hash VARCHAR(64) NOT NULL,
+			status_code INTEGER NOT NULL DEFAULT 0,
+			content_type VARCHAR(100),
+			response_body BLOB,
+			created_at TEXT NOT NULL,
+			PRIMARY KEY (endpoint, idempotency_key)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_idempotency_key_created ON idempotency_key (created_at)`,
+	)
+}
+
+// migrateObservationDetails function: v2 形式で報告されるホスト名・インターフェース・センサー側のスキャンIDのカラムを追加
+func migrateObservationDetails(tx *sql.Tx) error {
+	for _, c := range [][3]string{
+		{"device", "hostname", "TEXT"},
+		{"device_observation", "hostname", "TEXT"},
+		{"device_observation", "interface", "VARCHAR(50)"},
+		{"scan_session", "sensor_scan_id", "VARCHAR(100)"},
+	} {
+		if err := addColumnIfMissing(tx, c[0], c[1], c[2]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateDeviceAddresses function: 機器ごとの複数のIPアドレス（IPv6 を含む）と検出日時のテーブルを追加
+// 既存の観測履歴と device.ip_address から初期データを作成する
+func migrateDeviceAddresses(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE IF NOT EXISTS device_address (
+			mac_address VARCHAR(50) NOT NULL,
+			ip_address VARCHAR(50) NOT NULL,
+			family VARCHAR(10),
+			first_seen TEXT NOT NULL,
+			last_seen TEXT NOT NULL,
+			seen_count INTEGER DEFAULT 0,
+			PRIMARY KEY (mac_address, ip_address)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_device_address_ip ON device_address (ip_address)`,
+		`INSERT OR IGNORE INTO device_address (mac_address, ip_address, family, first_seen, last_seen, seen_count)
+			SELECT mac_address, ip_address, CASE WHEN ip_address LIKE '%:%' THEN 'ipv6' ELSE 'ipv4' END,
+				MIN(observed_at), MAX(observed_at), COUNT(*)
+			FROM device_observation WHERE COALESCE(ip_address, '') != ''
+			GROUP BY mac_address, ip_address`,
+		`INSERT OR IGNORE INTO device_address (mac_address, ip_address, family, first_seen, last_seen, seen_count)
+			SELECT mac_address, ip_address, CASE WHEN ip_address LIKE '%:%' THEN 'ipv6' ELSE 'ipv4' END,
+				COALESCE(first_seen, last_seen, ''), COALESCE(last_seen, first_seen, ''), COALESCE(seen_count, 1)
+			FROM device WHERE COALESCE(ip_address, '') != ''`,
+	)
+}
+
+// migrateDHCPLeases function: DHCPリース（ホスト名・client-id・期限）のテーブルを追加
+func migrateDHCPLeases(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE IF NOT EXISTS dhcp_lease (
+			mac_address VARCHAR(50) NOT NULL,
+			ip_address VARCHAR(50) NOT NULL,
+			hostname VARCHAR(255),
+			client_id VARCHAR(255),
+			expires_at TEXT,
+			source VARCHAR(20) NOT NULL,
+			sensor_id VARCHAR(100),
+			updated_at TEXT NOT NULL,
+			PRIMARY KEY (mac_address, ip_address)
+		)`,
+	)
+}
+
+// migrateDangerTransitions function: 危険判定の状態の遷移履歴のテーブルを追加し、既存の判定から分かる範囲で履歴を作成
+func migrateDangerTransitions(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE IF NOT EXISTS danger_transition (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			mac_address VARCHAR(50) NOT NULL,
+			source VARCHAR(20) NOT NULL,
+			from_state VARCHAR(20),
+			to_state VARCHAR(20) NOT NULL,
+			severity VARCHAR(20),
+			reason TEXT,
+			transitioned_at TEXT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_danger_transition_mac ON danger_transition (mac_address, transitioned_at)`,
+		// 解除済みの判定は、解除前の状態が分からないため有効だったものとみなす
+		`INSERT INTO danger_transition (mac_address, source, from_state, to_state, severity, reason, transitioned_at)
+			SELECT mac_address, source, NULL, CASE WHEN state = 'cleared' THEN 'active' ELSE state END, severity, reason, flagged_at
+			FROM device_danger`,
+		`INSERT INTO danger_transition (mac_address, source, from_state, to_state, severity, reason, transitioned_at)
+			SELECT mac_address, source, 'active', 'cleared', severity, reason, cleared_at
+			FROM device_danger WHERE state = 'cleared' AND cleared_at IS NOT NULL`,
+	)
+}
+
+// migrateOverrides function: オペレーターによる手動判定と、その設定・解除の記録のテーブルを追加
+func migrateOverrides(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE IF NOT EXISTS device_override (
+			mac_address VARCHAR(50) PRIMARY KEY,
+			mode VARCHAR(20) NOT NULL,
+			reason TEXT,
+			operator VARCHAR(100) NOT NULL,
+			created_at TEXT NOT NULL,
+			expires_at TEXT
+		)`,
+		`CREATE TABLE IF NOT EXISTS device_override_event (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			mac_address VARCHAR(50) NOT NULL,
+			action VARCHAR(20) NOT NULL,
+			mode VARCHAR(20) NOT NULL,
+			reason TEXT,
+			operator VARCHAR(100) NOT NULL,
+			expires_at TEXT,
+			created_at TEXT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_device_override_event_mac ON device_override_event (mac_address, created_at)`,
+	)
+}
+
+// migrateRetentionIndexes function: 保持期間を過ぎたデータの削除で使う日時のインデックスを追加
+func migrateRetentionIndexes(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE INDEX IF NOT EXISTS idx_device_observation_observed ON device_observation (observed_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_incident_resolved ON incident (status, resolved_at)`,
+	)
+}
+
+// migrateIdempotencyLease function: 処理中の Idempotency-Key の予約日時のカラムを追加（処理中に終了したリクエストの予約を引き継ぐため）
+func migrateIdempotencyLease(tx *sql.Tx) error {
+	return addColumnIfMissing(tx, "idempotency_key", "reserved_at", "TEXT")
+}
+
+// migrateScanDetections function: 機器・検知の種類ごとの最後のスキャン検知を追加（同じウィンドウ内で重複して検知しないため）
+func migrateScanDetections(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE IF NOT EXISTS scan_detection (
+			mac_address VARCHAR(50) NOT NULL,
+			kind VARCHAR(20) NOT NULL,
+			window_end TEXT NOT NULL,
+			detected_at TEXT NOT NULL,
+			PRIMARY KEY (mac_address, kind)
+		)`,
+	)
+}
+
+// migrateObservationIPIndex function: IPアドレスごとの最新の観測を残して削除するためのインデックスを追加
+func migrateObservationIPIndex(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE INDEX IF NOT EXISTS idx_device_observation_ip ON device_observation (ip_address, observed_at)`,
+	)
+}
+
+// execAll function: 複数のSQL文を順に実行
+func execAll(tx *sql.Tx, statements ...string) error {
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumnIfMissing function: カラムが存在しない場合のみ追加
+// マイグレーション導入前の起動時 ALTER TABLE で既に追加済みのDBに対応するため
+func addColumnIfMissing(tx *sql.Tx, table, column, definition string) error {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// ensureMigrationTable function: schema_migrations テーブルを作成
+func ensureMigrationTable(database *sql.DB) error {
+	_, err := database.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TEXT NOT NULL
+	)`)
+	return err
+}
+
+// MigrationStatus function: 各マイグレーションの適用状況を返す
+func MigrationStatus(database *sql.DB) ([]MigrationState, error) {
+	if err := ensureMigrationTable(database); err != nil {
+		return nil, fmt.Errorf("schema_migrations 作成エラー: %v", err)
+	}
+
+	applied := map[int]string{}
+	rows, err := database.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("schema_migrations 取得エラー: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		var appliedAt string
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("schema_migrations 読み込みエラー: %v", err)
+		}
+		applied[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	states := make([]MigrationState, 0, len(migrations))
+	for _, m := range migrations {
+		appliedAt, ok := applied[m.version]
+		states = append(states, MigrationState{Version: m.version, Name: m.name, Applied: ok, AppliedAt: appliedAt})
+	}
+	return states, nil
+}
+
+// Migrate function: 未適用のマイグレーションを順に適用し、適用した件数を返す
+func Migrate(database *sql.DB) (int, error) {
+	states, err := MigrationStatus(database)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for i, m := range migrations {
+		if states[i].Applied {
+			continue
+		}
+		if err := applyMigration(database, m); err != nil {
+			return count, fmt.Errorf("マイグレーション %d (%s) の適用に失敗: %v", m.version, m.name, err)
+		}
+		log.Printf("✅ マイグレーション適用: %d %s", m.version, m.name)
+		count++
+	}
+	return count, nil
+}
+
+// applyMigration function: 1つのマイグレーションをトランザクション内で適用
+func applyMigration(database *sql.DB, m migration) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.up(tx); err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)", m.version, m.name, nowTimestamp())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RunMigrateCommand function: migrate サブコマンド (status / up) を実行
+func RunMigrateCommand(database *sql.DB, args []string, out io.Writer) error {
+	action := "status"
+	if len(args) > 0 {
+		action = args[0]
+	}
+
+	switch action {
+	case "status":
+		states, err := MigrationStatus(database)
+		if err != nil {
+			return err
+		}
+		for _, s := range states {
+			if s.Applied {
+				fmt.Fprintf(out, "%4d  applied  %s  %s\n", s.Version, s.AppliedAt, s.Name)
+			} else {
+				fmt.Fprintf(out, "%4d  pending  %-19s  %s\n", s.Version, "-", s.Name)
+			}
+		}
+		return nil
+	case "up":
+		count, err := Migrate(database)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%d migration(s) applied\n", count)
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command %q (usage: migrate [status|up])", action)
+	}
+}
@@ -0,0 +1,486 @@
+package backend
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // SENSOR_TIMEZONE の解釈用（コンテナにタイムゾーンデータがない場合のため埋め込む）
+)
+
+// maxIngestLines: 1リクエストで受け付けるログ行数の上限
+const maxIngestLines = 5000
+
+// maxIngestErrors: レスポンスに含める解析エラーの上限
+const maxIngestErrors = 20
+
+// Flow type: flow テーブルの1行（netfilter の LOG 1行分の通信）を表す
+type Flow struct {
+	ID         int64  `json:"id"`
+	MACAddress string `json:"mac_address"`
+	Prefix     string `json:"prefix"`
+	InIface    string `json:"in_interface"`
+	SrcIP      string `json:"src_ip"`
+	DstIP      string `json:"dst_ip"`
+	Protocol   string `json:"protocol"`
+	SrcPort    int    `json:"src_port"`
+	DstPort    int    `json:"dst_port"`
+	ObservedAt string `json:"observed_at"`
+	ReceivedAt string `json:"received_at"`
+	SensorID   string `json:"sensor_id"`
+	Raw        string `json:"raw,omitempty"`
+}
+
+// netfilterIngestRequest type: JSON で送る場合のリクエスト（text/plain の場合は1行1ログ）
+type netfilterIngestRequest struct {
+	Lines []string `json:"lines"`
+}
+
+// ingestError type: 解析できなかったログ行
+type ingestError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+var (
+	// netfilterPrefixPattern: --log-prefix で付けた "[LAN_TCP_SYN]" などのタグ
+	netfilterPrefixPattern = regexp.MustCompile(`\[([A-Za-z0-9_:-]+)\]\s+IN=`)
+	// netfilterFieldPattern: KEY=VALUE 形式のフィールド（値なしの "OUT=" も含む）
+	netfilterFieldPattern = regexp.MustCompile(`\b([A-Z]+)=(\S*)`)
+)
+
+// netfilterDangerPrefixes function: 危険とみなすログのタグを環境変数 NETFILTER_DANGER_PREFIXES から取得
+// 既定はセンサーエージェントが /status に送るものと同じ LAN_TCP_SYN, LAN_UDP
+func netfilterDangerPrefixes() map[string]bool {
+	value := os.Getenv("NETFILTER_DANGER_PREFIXES")
+	if value == "" {
+		value = "LAN_TCP_SYN,LAN_UDP"
+	}
+	prefixes := map[string]bool{}
+	for _, p := range strings.Split(value, ",") {
+		if p = strings.Trim(strings.TrimSpace(p), "[]"); p != "" {
+			prefixes[p] = true
+		}
+	}
+	return prefixes
+}
+
+// ParseNetfilterLine function: netfilter の LOG 1行を Flow に変換（センサーエージェントからも使用）
+// MAC= は <宛先MAC>:<送信元MAC>:<EtherType> の14オクテットで、送信元MACを機器のMACアドレスとする。
+// タイムゾーンのない syslog の日時はセンサーのタイムゾーン loc の時刻として解釈する
+func ParseNetfilterLine(line string, receivedAt string, loc *time.Location) (Flow, error) {
+	flow := Flow{Raw: line, ReceivedAt: receivedAt}
+
+	match := netfilterPrefixPattern.FindStringSubmatchIndex(line)
+	if match == nil {
+		return flow, fmt.Errorf("netfilter のログ行ではありません（[PREFIX] IN= が見つかりません）")
+	}
+	flow.Prefix = line[match[2]:match[3]]
+	flow.ObservedAt = parseSyslogTimestamp(line[:match[0]], receivedAt, loc)
+
+	fields := map[string]string{}
+	for _, m := range netfilterFieldPattern.FindAllStringSubmatch(line[match[0]:], -1) {
+		if _, ok := fields[m[1]]; !ok {
+			fields[m[1]] = m[2]
+		}
+	}
+
+	octets := strings.Split(fields["MAC"], ":")
+	if len(octets) < 12 {
+		return flow, fmt.Errorf("MAC= から送信元MACアドレスを取得できません: %q", fields["MAC"])
+	}
+	mac, kind, err := parseKnownPattern(strings.Join(octets[6:12], ":"))
+	if err != nil || kind != KnownKindMAC {
+		return flow, fmt.Errorf("送信元MACアドレスが不正です: %q", fields["MAC"])
+	}
+	flow.MACAddress = mac
+
+	flow.SrcIP = fields["SRC"]
+	flow.DstIP = fields["DST"]
+	if flow.SrcIP == "" || flow.DstIP == "" {
+		return flow, fmt.Errorf("SRC= / DST= がありません")
+	}
+	flow.InIface = fields["IN"]
+	flow.Protocol = fields["PROTO"]
+	flow.SrcPort, _ = strconv.Atoi(fields["SPT"])
+	flow.DstPort, _ = strconv.Atoi(fields["DPT"])
+	return flow, nil
+}
+
+// parseSyslogTimestamp function: ログ行先頭の日時をDB保存用の文字列に変換
+// RFC3339 形式（rsyslog の高精度タイムスタンプ）と "Oct 18 10:00:00" 形式（loc の時刻）に対応し、解析できなければ受信日時を使う
+func parseSyslogTimestamp(header, receivedAt string, loc *time.Location) string {
+	fields := strings.Fields(header)
+	if len(fields) == 0 {
+		return receivedAt
+	}
+	if t, err := time.Parse(time.RFC3339Nano, fields[0]); err == nil {
+		return t.UTC().Format(timestampLayout)
+	}
+	if len(fields) >= 3 {
+		t, err := time.ParseInLocation("Jan 2 15:04:05", strings.Join(fields[:3], " "), loc)
+		if err == nil {
+			// 年はログに含まれないため受信日時の年とし、未来になる場合は前年とする（年末年始の跨ぎ）
+			received := parseTimestamp(receivedAt)
+			t = t.AddDate(received.In(loc).Year(), 0, 0)
+			if t.After(received.Add(24 * time.Hour)) {
+				t = t.AddDate(-1, 0, 0)
+			}
+			return t.UTC().Format(timestampLayout)
+		}
+	}
+	return receivedAt
+}
+
+// sensorLocation function: センサーのタイムゾーン（X-Sensor-Timezone ヘッダー、未指定時は環境変数 SENSOR_TIMEZONE）を取得
+// "Asia/Tokyo" などの IANA タイムゾーン名で指定する。どちらもなければサーバーのタイムゾーンとする
+func sensorLocation(r *http.Request) (*time.Location, error) {
+	name := strings.TrimSpace(r.Header.Get("X-Sensor-Timezone"))
+	if name == "" {
+		name = strings.TrimSpace(os.Getenv("SENSOR_TIMEZONE"))
+	}
+	if name == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sensor time zone: %q", name)
+	}
+	return loc, nil
+}
+
+// readIngestLines function: リクエストボディからログ行を取り出す（JSON の lines 配列または1行1ログのテキスト）
+func readIngestLines(r *http.Request) ([]string, error) {
+	var lines []string
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var req netfilterIngestRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return nil, fmt.Errorf("Invalid JSON data: %v", err)
+		}
+		lines = req.Lines
+	} else {
+		scanner := bufio.NewScanner(io.LimitReader(r.Body, 16<<20))
+		scanner.Buffer(make([]byte, 64*1024), 64*1024)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("Invalid request body: %v", err)
+		}
+	}
+	if len(lines) > maxIngestLines {
+		return nil, fmt.Errorf("too many lines (max %d)", maxIngestLines)
+	}
+	return lines, nil
+}
+
+// netfilterIngestHandler function: netfilter の LOG 行を受け取り、通信記録として保存して危険判定を行う
+// 危険とみなすタグの行があった機器は、1リクエスト = 1ヒットとして /status と同じ判定ポリシーで扱う
+func netfilterIngestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeRequest(w, r) || !databaseReady(w) {
+		return
+	}
+
+	lines, err := readIngestLines(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	loc, err := sensorLocation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := nowTimestamp()
+	sensorID := sensorIDFromRequest(r)
+	dangerPrefixes := netfilterDangerPrefixes()
+
+	var flows []Flow
+	parseErrors := []ingestError{}
+	rejected := 0
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		flow, err := ParseNetfilterLine(line, now, loc)
+		if err != nil {
+			rejected++
+			if len(parseErrors) < maxIngestErrors {
+				parseErrors = append(parseErrors, ingestError{Line: i + 1, Error: err.Error()})
+			}
+			continue
+		}
+		flow.SensorID = sensorID
+		flows = append(flows, flow)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("❌ トランザクション開始エラー: %v", err)
+		http.Error(w, "Database update failed", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	latestByMAC, err := insertFlows(tx, flows)
+	if err != nil {
+		log.Printf("❌ %v", err)
+		http.Error(w, "Database update failed", http.StatusInternalServerError)
+		return
+	}
+	flowsByMAC := map[string][]Flow{}
+	for _, f := range flows {
+		if dangerPrefixes[f.Prefix] {
+			flowsByMAC[f.MACAddress] = append(flowsByMAC[f.MACAddress], f)
+		}
+	}
+
+	// サーバー側で危険判定（期限切れの判定も解除）
+	policy := loadDangerPolicy()
+	clearedCount, err := policy.expireDangers(tx, now)
+	if err != nil {
+		log.Printf("❌ %v", err)
+		http.Error(w, "Database update failed", http.StatusInternalServerError)
+		return
+	}
+
+	scanConfig := loadScanDetectConfig()
+
+	macs := make([]string, 0, len(latestByMAC))
+	for mac := range latestByMAC {
+		macs = append(macs, mac)
+	}
+	sort.Strings(macs)
+
+	dangerousCount, pendingCount, notFoundCount := 0, 0, 0
+	detections := []ScanDetection{}
+	for _, mac := range macs {
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM device WHERE mac_address = ?)", mac).Scan(&exists); err != nil {
+			log.Printf("  ❌ 機器存在確認エラー: %v", err)
+			continue
+		}
+		if !exists {
+			log.Printf("  ⚠️ 機器が見つかりません (MAC: %s)", mac)
+			notFoundCount++
+			continue
+		}
+
+		// 1台の失敗で他の機器の判定を止めないよう、失敗した機器の変更だけを取り消して続行する
+		state := ""
+		var found []ScanDetection
+		itemErr, err := inSavepoint(tx, func() error {
+			var err error
+			if len(flowsByMAC[mac]) > 0 {
+				if state, err = policy.applyHit(tx, mac, netfilterHit(flowsByMAC[mac]), now); err != nil {
+					return fmt.Errorf("危険フラグ設定エラー: %v", err)
+				}
+			}
+			var scanState string
+			if found, scanState, err = scanConfig.raiseScans(tx, policy, mac, latestByMAC[mac], now); err != nil {
+				return err
+			}
+			if len(found) > 0 {
+				state = scanState
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("❌ %v", err)
+			http.Error(w, "Database update failed", http.StatusInternalServerError)
+			return
+		}
+		if itemErr != nil {
+			log.Printf("  ❌ %v", itemErr)
+			continue
+		}
+		detections = append(detections, found...)
+
+		switch state {
+		case DangerStateActive:
+			dangerousCount++
+		case DangerStatePending:
+			pendingCount++
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("❌ コミットエラー: %v", err)
+		http.Error(w, "Database update failed", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("✅ netfilter ログを取り込みました (通信: %d件, 不正な行: %d件, 危険: %d台, 保留: %d台)",
+		len(flows), rejected, dangerousCount, pendingCount)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":          "success",
+		"received":        len(lines),
+		"stored":          len(flows),
+		"rejected":        rejected,
+		"errors":          parseErrors,
+		"dangerous_count": dangerousCount,
+		"pending_count":   pendingCount,
+		"not_found_count": notFoundCount,
+		"cleared_count":   clearedCount,
+		"scan_detections": detections,
+		"mode":            policy.Mode,
+		"timestamp":       time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
+
+// insertFlows function: 通信記録を保存し、機器ごとの最新の通信日時を返す
+func insertFlows(tx *sql.Tx, flows []Flow) (map[string]string, error) {
+	latestByMAC := map[string]string{}
+	if len(flows) == 0 {
+		return latestByMAC, nil
+	}
+	stmt, err := tx.Prepare(`INSERT INTO flow (mac_address, prefix, in_interface, src_ip, dst_ip, protocol, src_port, dst_port,
+		observed_at, received_at, sensor_id, raw) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return nil, fmt.Errorf("通信記録の保存準備エラー: %v", err)
+	}
+	defer stmt.Close()
+
+	for _, f := range flows {
+		if _, err := stmt.Exec(f.MACAddress, f.Prefix, f.InIface, f.SrcIP, f.DstIP, f.Protocol, f.SrcPort, f.DstPort,
+			f.ObservedAt, f.ReceivedAt, f.SensorID, f.Raw); err != nil {
+			return nil, fmt.Errorf("通信記録の保存エラー: %v", err)
+		}
+		if f.ObservedAt > latestByMAC[f.MACAddress] {
+			latestByMAC[f.MACAddress] = f.ObservedAt
+		}
+	}
+	return latestByMAC, nil
+}
+
+// statusFlows function: /status の証跡のログ行のうち netfilter の LOG 行を通信記録にする
+// センサーエージェントは kern.log の行を /status に送るため、ここで保存してスキャン検知に使う。
+// 日時はログ行から読み直さず、センサーが UTC にそろえて送った観測の observed_at を使う（省略時は受信日時）
+func statusFlows(observations []observation, sensorID, receivedAt string) []Flow {
+	var flows []Flow
+	for _, o := range observations {
+		if o.Log == "" {
+			continue
+		}
+		flow, err := ParseNetfilterLine(o.Log, receivedAt, time.UTC)
+		if err != nil || flow.MACAddress != o.MAC {
+			continue
+		}
+		flow.ObservedAt = o.ObservedAt
+		if flow.ObservedAt == "" {
+			flow.ObservedAt = receivedAt
+		}
+		flow.SensorID = sensorID
+		flows = append(flows, flow)
+	}
+	return flows
+}
+
+// netfilterHit function: 1台分の通信記録から危険判定のヒットを作る
+func netfilterHit(flows []Flow) dangerHit {
+	first := flows[0]
+	target := first.DstIP
+	if first.DstPort > 0 {
+		target = fmt.Sprintf("%s:%d", first.DstIP, first.DstPort)
+	}
+	reason := fmt.Sprintf("[%s] %s から %s への %s 通信を検知しました", first.Prefix, first.SrcIP, target, first.Protocol)
+	if len(flows) > 1 {
+		reason += fmt.Sprintf("（他 %d 件）", len(flows)-1)
+	}
+
+	evidence := make([]string, 0, len(flows))
+	for _, f := range flows {
+		evidence = append(evidence, f.Raw)
+	}
+	return dangerHit{
+		Source:   DangerSourceKernLog,
+		Severity: SeverityMedium,
+		Reason:   reason,
+		Evidence: evidence,
+	}
+}
+
+// flowsHandler function: 保存された通信記録を新しい順に返す
+func flowsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeRequest(w, r) || !databaseReady(w) {
+		return
+	}
+
+	query := `SELECT id, mac_address, prefix, COALESCE(in_interface, ''), src_ip, dst_ip, COALESCE(protocol, ''),
+		COALESCE(src_port, 0), COALESCE(dst_port, 0), observed_at, received_at, COALESCE(sensor_id, ''), COALESCE(raw, '')
+		FROM flow WHERE 1 = 1`
+	var args []interface{}
+	if mac := r.URL.Query().Get("mac"); mac != "" {
+		query += " AND mac_address = ?"
+		args = append(args, macFilter(mac))
+	}
+	if prefix := r.URL.Query().Get("prefix"); prefix != "" {
+		query += " AND prefix = ?"
+		args = append(args, prefix)
+	}
+	if value := r.URL.Query().Get("since"); value != "" {
+		since, err := parseSinceParam(value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		query += " AND observed_at >= ?"
+		args = append(args, since)
+	}
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	query += " ORDER BY observed_at DESC, id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("❌ 通信記録取得エラー: %v", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	flows := []Flow{}
+	for rows.Next() {
+		var f Flow
+		if err := rows.Scan(&f.ID, &f.MACAddress, &f.Prefix, &f.InIface, &f.SrcIP, &f.DstIP, &f.Protocol,
+			&f.SrcPort, &f.DstPort, &f.ObservedAt, &f.ReceivedAt, &f.SensorID, &f.Raw); err != nil {
+			log.Printf("❌ 通信記録読み込みエラー: %v", err)
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			return
+		}
+		flows = append(flows, f)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":    "success",
+		"count":     len(flows),
+		"flows":     flows,
+		"timestamp": time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
@@ -0,0 +1,140 @@
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseNetfilterLine(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const receivedAt = "2026-10-18 01:05:00"
+	const fields = "IN=br0 OUT=eth0 MAC=00:11:22:33:44:55:aa:bb:cc:00:00:01:08:00 SRC=192.168.1.10 DST=192.168.1.20 LEN=60 TOS=0x00 PROTO=TCP SPT=51234 DPT=22 WINDOW=64240 SYN"
+
+	tests := []struct {
+		name    string
+		line    string
+		loc     *time.Location
+		want    Flow
+		wantErr bool
+	}{
+		{
+			name: "syslog time in the sensor's zone",
+			line: "Oct 18 10:00:00 gw kernel: [12345.678] [LAN_TCP_SYN] " + fields,
+			loc:  tokyo,
+			want: Flow{MACAddress: "aa:bb:cc:00:00:01", Prefix: "LAN_TCP_SYN", InIface: "br0", SrcIP: "192.168.1.10", DstIP: "192.168.1.20",
+				Protocol: "TCP", SrcPort: 51234, DstPort: 22, ObservedAt: "2026-10-18 01:00:00"},
+		},
+		{
+			name: "syslog time in UTC",
+			line: "Oct 18 01:00:00 gw kernel: [LAN_TCP_SYN] " + fields,
+			loc:  time.UTC,
+			want: Flow{MACAddress: "aa:bb:cc:00:00:01", Prefix: "LAN_TCP_SYN", InIface: "br0", SrcIP: "192.168.1.10", DstIP: "192.168.1.20",
+				Protocol: "TCP", SrcPort: 51234, DstPort: 22, ObservedAt: "2026-10-18 01:00:00"},
+		},
+		{
+			name: "RFC3339 time ignores the sensor's zone",
+			line: "2026-10-18T10:00:00.123456+09:00 gw kernel: [LAN_UDP] IN=br0 OUT= MAC=00:11:22:33:44:55:aa:bb:cc:00:00:01:08:00 SRC=192.168.1.10 DST=192.168.1.255 LEN=78 PROTO=UDP SPT=137 DPT=137 LEN=58",
+			loc:  time.UTC,
+			want: Flow{MACAddress: "aa:bb:cc:00:00:01", Prefix: "LAN_UDP", InIface: "br0", SrcIP: "192.168.1.10", DstIP: "192.168.1.255",
+				Protocol: "UDP", SrcPort: 137, DstPort: 137, ObservedAt: "2026-10-18 01:00:00"},
+		},
+		{
+			name: "no timestamp uses received_at",
+			line: "[LAN_TCP_SYN] " + fields,
+			loc:  tokyo,
+			want: Flow{MACAddress: "aa:bb:cc:00:00:01", Prefix: "LAN_TCP_SYN", InIface: "br0", SrcIP: "192.168.1.10", DstIP: "192.168.1.20",
+				Protocol: "TCP", SrcPort: 51234, DstPort: 22, ObservedAt: receivedAt},
+		},
+		{
+			name: "ICMP without ports",
+			line: "Oct 18 10:00:00 gw kernel: [LAN_ICMP] IN=br0 OUT= MAC=00:11:22:33:44:55:AA:BB:CC:00:00:01:08:00 SRC=192.168.1.10 DST=192.168.1.1 LEN=84 PROTO=ICMP TYPE=8 CODE=0",
+			loc:  tokyo,
+			want: Flow{MACAddress: "aa:bb:cc:00:00:01", Prefix: "LAN_ICMP", InIface: "br0", SrcIP: "192.168.1.10", DstIP: "192.168.1.1",
+				Protocol: "ICMP", ObservedAt: "2026-10-18 01:00:00"},
+		},
+		{name: "not a netfilter line", line: "Oct 18 10:00:00 gw sshd[123]: Accepted publickey", loc: tokyo, wantErr: true},
+		{name: "short MAC field", line: "[LAN_TCP_SYN] IN=br0 MAC=00:11:22 SRC=192.168.1.10 DST=192.168.1.20", loc: tokyo, wantErr: true},
+		{name: "invalid source MAC", line: "[LAN_TCP_SYN] IN=br0 MAC=00:11:22:33:44:55:zz:bb:cc:00:00:01:08:00 SRC=192.168.1.10 DST=192.168.1.20", loc: tokyo, wantErr: true},
+		{name: "missing addresses", line: "[LAN_TCP_SYN] IN=br0 MAC=00:11:22:33:44:55:aa:bb:cc:00:00:01:08:00 PROTO=TCP", loc: tokyo, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flow, err := ParseNetfilterLine(tt.line, receivedAt, tt.loc)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseNetfilterLine = %+v, want error", flow)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseNetfilterLine error: %v", err)
+			}
+			tt.want.Raw, tt.want.ReceivedAt = tt.line, receivedAt
+			if flow != tt.want {
+				t.Errorf("ParseNetfilterLine =\n  %+v\nwant\n  %+v", flow, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSyslogTimestampYear(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		header     string
+		receivedAt string
+		want       string
+	}{
+		{name: "same year", header: "Jun 1 09:00:00 gw kernel:", receivedAt: "2026-06-01 00:05:00", want: "2026-06-01 00:00:00"},
+		// 受信時はセンサーのタイムゾーンで既に 2027年
+		{name: "new year in the sensor's zone", header: "Jan 1 00:00:30 gw kernel:", receivedAt: "2026-12-31 15:01:00", want: "2026-12-31 15:00:30"},
+		{name: "log from the previous year", header: "Dec 31 23:59:59 gw kernel:", receivedAt: "2027-01-01 00:00:00", want: "2026-12-31 14:59:59"},
+		{name: "unparsable header", header: "gw kernel:", receivedAt: "2026-06-01 00:05:00", want: "2026-06-01 00:05:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseSyslogTimestamp(tt.header, tt.receivedAt, tokyo); got != tt.want {
+				t.Errorf("parseSyslogTimestamp(%q) = %q, want %q", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatusFlows(t *testing.T) {
+	const receivedAt = "2026-10-18 01:05:00"
+	const line = "Oct 18 10:00:00 gw kernel: [LAN_TCP_SYN] IN=br0 OUT= MAC=00:11:22:33:44:55:aa:bb:cc:00:00:01:08:00 SRC=192.168.1.10 DST=192.168.1.20 PROTO=TCP SPT=51234 DPT=22"
+	tests := []struct {
+		name string
+		obs  observation
+		want string // 保存する observed_at（空は通信記録にしない）
+	}{
+		{name: "uses the observation's observed_at", obs: observation{MAC: "aa:bb:cc:00:00:01", ObservedAt: "2026-10-18 01:00:00", Log: line}, want: "2026-10-18 01:00:00"},
+		{name: "falls back to received_at", obs: observation{MAC: "aa:bb:cc:00:00:01", Log: line}, want: receivedAt},
+		{name: "log for another device", obs: observation{MAC: "aa:bb:cc:00:00:02", ObservedAt: "2026-10-18 01:00:00", Log: line}},
+		{name: "not a netfilter line", obs: observation{MAC: "aa:bb:cc:00:00:01", Log: "line 0"}},
+		{name: "no log", obs: observation{MAC: "aa:bb:cc:00:00:01"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flows := statusFlows([]observation{tt.obs}, "sensor-1", receivedAt)
+			if tt.want == "" {
+				if len(flows) != 0 {
+					t.Fatalf("statusFlows = %+v, want none", flows)
+				}
+				return
+			}
+			if len(flows) != 1 {
+				t.Fatalf("statusFlows = %+v, want 1 flow", flows)
+			}
+			if f := flows[0]; f.ObservedAt != tt.want || f.ReceivedAt != receivedAt || f.SensorID != "sensor-1" {
+				t.Errorf("statusFlows = %+v, want observed_at %q", f, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package backend
+
+import (
+	"bytes"
+	"database/sql"
+	_ "embed"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// embeddedOUICSV: バイナリに埋め込む IEEE MA-L (OUI) の一覧（IEEE の oui.csv と同じ形式）
+// 同梱しているのは一般的な機器の一部のみのため、全件を使う場合は
+// https://standards-oui.ieee.org/oui/oui.csv を取得して `oui update` で取り込む
+//
+//go:embed oui.csv
+var embeddedOUICSV []byte
+
+// EventVendorMismatch: センサーが報告したベンダーとOUIのベンダーが一致しない（MACアドレス偽装の疑い）
+const EventVendorMismatch = "vendor_mismatch"
+
+var (
+	embeddedOUIOnce sync.Once
+	embeddedOUIs    map[string]string
+)
+
+// vendorCheck type: MACアドレスのOUIとセンサーが報告したベンダーの照合結果
+type vendorCheck struct {
+	OUIVendor  string // OUIから引いたベンダー（不明なら空）
+	Vendor     string // device.vendor に保存するベンダー（報告がなければOUIのベンダーで補完）
+	Randomized bool   // ローカル管理アドレス（スマートフォンのプライベートアドレスなど）
+	Mismatch   bool   // 報告されたベンダーとOUIのベンダーが一致しない
+}
+
+// parseOUICSV function: IEEE の oui.csv (Registry,Assignment,Organization Name,Organization Address) を読み込む
+// MA-L 以外の行（MA-M / MA-S など）は読み飛ばす
+func parseOUICSV(r io.Reader) (map[string]string, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	vendors := map[string]string{}
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("OUI CSV 読み込みエラー (%d行目): %v", line, err)
+		}
+		if line == 1 && len(record) > 1 && strings.EqualFold(strings.TrimSpace(record[1]), "Assignment") {
+			continue
+		}
+		if len(record) < 3 || strings.TrimSpace(record[0]) != "MA-L" {
+			continue
+		}
+		prefix, kind, err := parseKnownPattern(record[1])
+		if err != nil || kind != KnownKindOUI {
+			return nil, fmt.Errorf("OUI CSV の Assignment が不正です (%d行目): %q", line, record[1])
+		}
+		vendors[prefix] = strings.TrimSpace(record[2])
+	}
+	return vendors, nil
+}
+
+// builtinOUIs function: 埋め込みのOUI一覧を返す（初回のみ読み込む）
+func builtinOUIs() map[string]string {
+	embeddedOUIOnce.Do(func() {
+		vendors, err := parseOUICSV(bytes.NewReader(embeddedOUICSV))
+		if err != nil {
+			log.Printf("警告: 埋め込みOUI一覧の読み込みに失敗しました: %v", err)
+			vendors = map[string]string{}
+		}
+		embeddedOUIs = vendors
+	})
+	return embeddedOUIs
+}
+
+// lookupOUIVendor function: MACアドレスのOUIからベンダーを引く
+// `oui update` で取り込んだ oui_vendor テーブルを優先し、なければ埋め込みの一覧を使う
+func lookupOUIVendor(tx *sql.Tx, macAddress string) (string, error) {
+	pattern, _, err := parseKnownPattern(macAddress)
+	if err != nil {
+		return "", nil
+	}
+	prefix := pattern[:8]
+
+	var organization string
+	err = tx.QueryRow("SELECT organization FROM oui_vendor WHERE prefix = ?", prefix).Scan(&organization)
+	if err == nil {
+		return organization, nil
+	} else if err != sql.ErrNoRows {
+		return "", fmt.Errorf("OUI取得エラー (MAC: %s): %v", macAddress, err)
+	}
+	return builtinOUIs()[prefix], nil
+}
+
+// isLocallyAdministered function: 先頭オクテットのU/Lビットが立っている（ランダム化された）MACアドレスかどうか
+func isLocallyAdministered(macAddress string) bool {
+	mac := strings.TrimSpace(macAddress)
+	if len(mac) < 2 {
+		return false
+	}
+	first, err := strconv.ParseUint(mac[:2], 16, 8)
+	if err != nil {
+		return false
+	}
+	return first&0x02 != 0
+}
+
+// isUnknownVendor function: arp-scan がベンダーを特定できなかった場合の表記かどうか
+func isUnknownVendor(vendor string) bool {
+	v := strings.ToLower(strings.TrimSpace(vendor))
+	return v == "" || v == "unknown" || strings.HasPrefix(v, "(unknown")
+}
+
+// vendorKey function: ベンダー名の比較用に先頭の単語を英数字のみ・小文字にして返す
+// 例: "TP-LINK TECHNOLOGIES CO.,LTD." → "tplink", "Raspberry Pi Trading Ltd" → "raspberry"
+func vendorKey(vendor string) string {
+	for _, word := range strings.Fields(strings.ToLower(vendor)) {
+		key := strings.Map(func(r rune) rune {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				return r
+			}
+			return -1
+		}, word)
+		if key != "" {
+			return key
+		}
+	}
+	return ""
+}
+
+// checkVendor function: OUIと照合してベンダーの補完・ランダムMAC・ベンダー不一致を判定
+func checkVendor(tx *sql.Tx, macAddress, reportedVendor string) (vendorCheck, error) {
+	check := vendorCheck{Vendor: reportedVendor, Randomized: isLocallyAdministered(macAddress)}
+
+	ouiVendor, err := lookupOUIVendor(tx, macAddress)
+	if err != nil {
+		return check, err
+	}
+	check.OUIVendor = ouiVendor
+	if ouiVendor == "" || strings.EqualFold(ouiVendor, "Private") {
+		return check, nil
+	}
+
+	if isUnknownVendor(reportedVendor) {
+		check.Vendor = ouiVendor
+	} else if vendorKey(reportedVendor) != vendorKey(ouiVendor) {
+		check.Mismatch = true
+	}
+	return check, nil
+}
+
+// recordVendorCheck function: 照合結果を device に保存し、ベンダー不一致になった時点でセキュリティイベントを記録
+func recordVendorCheck(tx *sql.Tx, macAddress, ipAddress, reportedVendor string, check vendorCheck, at string) error {
+	var wasMismatch bool
+	err := tx.QueryRow("SELECT COALESCE(vendor_mismatch, FALSE) FROM device WHERE mac_address = ?", macAddress).Scan(&wasMismatch)
+	if err != nil {
+		return fmt.Errorf("ベンダー照合結果取得エラー (MAC: %s): %v", macAddress, err)
+	}
+
+	_, err = tx.Exec("UPDATE device SET oui_vendor = ?, is_randomized = ?, vendor_mismatch = ? WHERE mac_address = ?",
+		check.OUIVendor, check.Randomized, check.Mismatch, macAddress)
+	if err != nil {
+		return fmt.Errorf("ベンダー照合結果更新エラー (MAC: %s): %v", macAddress, err)
+	}
+
+	if !check.Mismatch || wasMismatch {
+		return nil
+	}
+	return recordSecurityEvent(tx, SecurityEvent{
+		EventType:     EventVendorMismatch,
+		MACAddress:    macAddress,
+		IPAddress:     ipAddress,
+		PreviousValue: check.OUIVendor,
+		Reason:        fmt.Sprintf("報告されたベンダー %q がOUIのベンダー %q と一致しません（MACアドレス偽装の疑い）", reportedVendor, check.OUIVendor),
+	}, at)
+}
+
+// ImportOUICSV function: IEEE の oui.csv を oui_vendor テーブルに取り込む（既存の内容は置き換える）
+func ImportOUICSV(database *sql.DB, r io.Reader) (int, error) {
+	vendors, err := parseOUICSV(r)
+	if err != nil {
+		return 0, err
+	}
+	if len(vendors) == 0 {
+		return 0, fmt.Errorf("OUI CSV に MA-L の行がありません")
+	}
+
+	tx, err := database.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("トランザクション開始エラー: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM oui_vendor"); err != nil {
+		return 0, fmt.Errorf("OUI削除エラー: %v", err)
+	}
+	stmt, err := tx.Prepare("INSERT INTO oui_vendor (prefix, organization, imported_at) VALUES (?, ?, ?)")
+	if err != nil {
+		return 0, fmt.Errorf("OUI登録エラー: %v", err)
+	}
+	defer stmt.Close()
+
+	now := nowTimestamp()
+	for prefix, organization := range vendors {
+		if _, err := stmt.Exec(prefix, organization, now); err != nil {
+			return 0, fmt.Errorf("OUI登録エラー (%s): %v", prefix, err)
+		}
+	}
+	return len(vendors), tx.Commit()
+}
+
+// RunOUICommand function: `oui` サブコマンドを実行する
+//
+//	oui update <oui.csv>  IEEE の oui.csv を取り込む
+//	oui lookup <MAC>      MACアドレスのベンダーを表示する
+func RunOUICommand(database *sql.DB, args []string, out io.Writer) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: oui update <oui.csv> | oui lookup <MAC>")
+	}
+
+	switch args[0] {
+	case "update":
+		file, err := os.Open(args[1])
+		if err != nil {
+			return fmt.Errorf("OUI CSV を開けません: %v", err)
+		}
+		defer file.Close()
+
+		count, err := ImportOUICSV(database, file)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%d OUI(s) imported from %s\n", count, args[1])
+		return nil
+	case "lookup":
+		tx, err := database.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		vendor, err := lookupOUIVendor(tx, args[1])
+		if err != nil {
+			return err
+		}
+		if vendor == "" {
+			vendor = "(not found)"
+		}
+		fmt.Fprintf(out, "%s  %s  locally_administered=%v\n", args[1], vendor, isLocallyAdministered(args[1]))
+		return nil
+	default:
+		return fmt.Errorf("unknown oui command %q (usage: oui update <oui.csv> | oui lookup <MAC>)", args[0])
+	}
+}
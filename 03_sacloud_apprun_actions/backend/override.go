@@ -0,0 +1,465 @@
+package backend
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// 手動判定の種類 (device_override.mode)
+const (
+	OverrideDangerous = "dangerous" // 自動判定に関係なく危険とする
+	OverrideTrusted   = "trusted"   // 自動判定（/status・ARP監視・検知ルール）で危険にしない
+)
+
+// 手動判定の記録の種類 (device_override_event.action)
+const (
+	overrideActionSet    = "set"
+	overrideActionClear  = "clear"
+	overrideActionExpire = "expire"
+)
+
+// overrideExpiryInterval: 期限切れの手動判定を解除するバックグラウンド処理の実行間隔
+const overrideExpiryInterval = time.Minute
+
+// DeviceOverride type: device_override テーブルの1行（オペレーターによる手動判定）を表す
+type DeviceOverride struct {
+	MACAddress string `json:"mac_address"`
+	Mode       string `json:"mode"`
+	Reason     string `json:"reason"`
+	Operator   string `json:"operator"`
+	CreatedAt  string `json:"created_at"`
+	ExpiresAt  string `json:"expires_at,omitempty"`
+}
+
+// OverrideEvent type: device_override_event テーブルの1行（手動判定の設定・解除・期限切れの記録）を表す
+type OverrideEvent struct {
+	ID         int64  `json:"id"`
+	MACAddress string `json:"mac_address"`
+	Action     string `json:"action"`
+	Mode       string `json:"mode"`
+	Reason     string `json:"reason"`
+	Operator   string `json:"operator"`
+	ExpiresAt  string `json:"expires_at,omitempty"`
+	CreatedAt  string `json:"created_at"`
+}
+
+// overrideRequest type: 手動判定APIのリクエスト（expires_at と expires_in_minutes はどちらか一方）
+// オペレーターは本文ではなく管理トークンから決める（authorizeAdmin）
+type overrideRequest struct {
+	Mode             string `json:"mode"`
+	Reason           string `json:"reason"`
+	Severity         string `json:"severity"` // mode が dangerous の場合の危険度（デフォルト high）
+	ExpiresAt        string `json:"expires_at"`
+	ExpiresInMinutes int    `json:"expires_in_minutes"`
+}
+
+// overrideClearRequest type: 手動判定の解除APIのリクエスト
+type overrideClearRequest struct {
+	Reason string `json:"reason"`
+}
+
+// validate function: リクエストを検証して保存する手動判定と危険度を返す
+func (req overrideRequest) validate(mac, operator, at string) (DeviceOverride, string, error) {
+	o := DeviceOverride{
+		MACAddress: mac,
+		Mode:       strings.TrimSpace(req.Mode),
+		Reason:     strings.TrimSpace(req.Reason),
+		Operator:   operator,
+		CreatedAt:  at,
+	}
+	if o.Mode != OverrideDangerous && o.Mode != OverrideTrusted {
+		return o, "", fmt.Errorf("mode must be %s or %s", OverrideDangerous, OverrideTrusted)
+	}
+	if o.Reason == "" {
+		return o, "", fmt.Errorf("reason is required")
+	}
+
+	severity := strings.TrimSpace(req.Severity)
+	if severity == "" {
+		severity = SeverityHigh
+	} else if _, ok := severityRank[severity]; !ok {
+		return o, "", fmt.Errorf("severity must be low, medium, high or critical")
+	}
+
+	switch {
+	case req.ExpiresAt != "" && req.ExpiresInMinutes != 0:
+		return o, "", fmt.Errorf("specify either expires_at or expires_in_minutes")
+	case req.ExpiresAt != "":
+		t, err := time.Parse(time.RFC3339, strings.TrimSpace(req.ExpiresAt))
+		if err != nil {
+			return o, "", fmt.Errorf("expires_at must be RFC3339: %q", req.ExpiresAt)
+		}
+		o.ExpiresAt = t.UTC().Format(timestampLayout)
+	case req.ExpiresInMinutes < 0:
+		return o, "", fmt.Errorf("expires_in_minutes must be a positive integer")
+	case req.ExpiresInMinutes > 0:
+		o.ExpiresAt = parseTimestamp(at).Add(time.Duration(req.ExpiresInMinutes) * time.Minute).Format(timestampLayout)
+	}
+	if o.ExpiresAt != "" && o.ExpiresAt <= at {
+		return o, "", fmt.Errorf("expires_at must be in the future")
+	}
+	return o, severity, nil
+}
+
+// deviceTrusted function: 機器が手動で信頼済みに設定されているか（期限切れのものは除く）
+func deviceTrusted(tx *sql.Tx, macAddress, at string) (bool, error) {
+	var trusted bool
+	err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM device_override WHERE mac_address = ? AND mode = ? AND (expires_at IS NULL OR expires_at > ?))`,
+		macAddress, OverrideTrusted, at).Scan(&trusted)
+	if err != nil {
+		return false, fmt.Errorf("手動判定取得エラー (MAC: %s): %v", macAddress, err)
+	}
+	return trusted, nil
+}
+
+// recordOverrideEvent function: 手動判定の設定・解除・期限切れを記録
+func recordOverrideEvent(tx *sql.Tx, o DeviceOverride, action, operator, reason, at string) error {
+	_, err := tx.Exec(`INSERT INTO device_override_event (mac_address, action, mode, reason, operator, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, NULLIF(?, ''), ?)`, o.MACAddress, action, o.Mode, reason, operator, o.ExpiresAt, at)
+	if err != nil {
+		return fmt.Errorf("手動判定の記録エラー (MAC: %s): %v", o.MACAddress, err)
+	}
+	return nil
+}
+
+// setOverride function: 手動判定を保存し、危険判定に反映する
+// dangerous は発生元 manual の危険判定として有効にし、trusted は manual の危険判定を解除して危険フラグを下ろす
+func setOverride(tx *sql.Tx, o DeviceOverride, severity string) error {
+	_, err := tx.Exec(`INSERT INTO device_override (mac_address, mode, reason, operator, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, NULLIF(?, ''))
+		ON CONFLICT (mac_address) DO UPDATE SET mode = excluded.mode, reason = excluded.reason, operator = excluded.operator,
+			created_at = excluded.created_at, expires_at = excluded.expires_at`,
+		o.MACAddress, o.Mode, o.Reason, o.Operator, o.CreatedAt, o.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("手動判定保存エラー (MAC: %s): %v", o.MACAddress, err)
+	}
+	if err := recordOverrideEvent(tx, o, overrideActionSet, o.Operator, o.Reason, o.CreatedAt); err != nil {
+		return err
+	}
+
+	if o.Mode == OverrideTrusted {
+		return clearDanger(tx, o.MACAddress, DangerSourceManual, o.CreatedAt)
+	}
+	return raiseDanger(tx, o.MACAddress, dangerHit{
+		Source:   DangerSourceManual,
+		Severity: severity,
+		Reason:   o.Reason,
+		Evidence: []string{fmt.Sprintf("%s が手動で危険に設定しました: %s", o.Operator, o.Reason)},
+	}, o.CreatedAt)
+}
+
+// removeOverride function: 手動判定を削除し、自動判定の状態に戻す（見つからなければ found = false）
+func removeOverride(tx *sql.Tx, macAddress, action, operator, reason, at string) (bool, error) {
+	var o DeviceOverride
+	err := tx.QueryRow(`SELECT mac_address, mode, COALESCE(reason, ''), operator, created_at, COALESCE(expires_at, '')
+		FROM device_override WHERE mac_address = ?`, macAddress).
+		Scan(&o.MACAddress, &o.Mode, &o.Reason, &o.Operator, &o.CreatedAt, &o.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("手動判定取得エラー (MAC: %s): %v", macAddress, err)
+	}
+
+	if _, err := tx.Exec("DELETE FROM device_override WHERE mac_address = ?", macAddress); err != nil {
+		return false, fmt.Errorf("手動判定削除エラー (MAC: %s): %v", macAddress, err)
+	}
+	if err := recordOverrideEvent(tx, o, action, operator, reason, at); err != nil {
+		return false, err
+	}
+	// trusted の解除では、有効な自動判定が残っていれば危険に戻る
+	return true, clearDanger(tx, macAddress, DangerSourceManual, at)
+}
+
+// expireOverrides function: 期限切れの手動判定を解除
+func expireOverrides(tx *sql.Tx, at string) (int, error) {
+	rows, err := tx.Query("SELECT mac_address FROM device_override WHERE expires_at IS NOT NULL AND expires_at <= ?", at)
+	if err != nil {
+		return 0, fmt.Errorf("期限切れ手動判定取得エラー: %v", err)
+	}
+	var targets []string
+	for rows.Next() {
+		var mac string
+		if err := rows.Scan(&mac); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("期限切れ手動判定読み込みエラー: %v", err)
+		}
+		targets = append(targets, mac)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, mac := range targets {
+		if _, err := removeOverride(tx, mac, overrideActionExpire, systemActor, "期限切れ", at); err != nil {
+			return 0, err
+		}
+	}
+	return len(targets), nil
+}
+
+// runOverrideExpiry function: 期限切れの手動判定を1回解除
+func runOverrideExpiry() {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("❌ 手動判定の期限切れ処理: トランザクション開始エラー: %v", err)
+		return
+	}
+	defer tx.Rollback()
+
+	expired, err := expireOverrides(tx, nowTimestamp())
+	if err != nil {
+		log.Printf("❌ 手動判定の期限切れ処理エラー: %v", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("❌ 手動判定の期限切れ処理: コミットエラー: %v", err)
+		return
+	}
+	if expired > 0 {
+		log.Printf("✅ 期限切れの手動判定を解除しました (%d件)", expired)
+	}
+}
+
+// startOverrideExpiry function: 期限切れの手動判定を定期的に解除（危険判定モードに関係なく実行）
+func startOverrideExpiry() {
+	go func() {
+		ticker := time.NewTicker(overrideExpiryInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if db != nil {
+				runOverrideExpiry()
+			}
+		}
+	}()
+}
+
+// queryOverrides function: 条件に一致する有効な手動判定を取得
+func queryOverrides(where string, args ...interface{}) ([]DeviceOverride, error) {
+	query := `SELECT mac_address, mode, COALESCE(reason, ''), operator, created_at, COALESCE(expires_at, '')
+		FROM device_override WHERE (expires_at IS NULL OR expires_at > ?)`
+	args = append([]interface{}{nowTimestamp()}, args...)
+	if where != "" {
+		query += " AND " + where
+	}
+	query += " ORDER BY created_at DESC, mac_address"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("手動判定取得エラー: %v", err)
+	}
+	defer rows.Close()
+
+	overrides := []DeviceOverride{}
+	for rows.Next() {
+		var o DeviceOverride
+		if err := rows.Scan(&o.MACAddress, &o.Mode, &o.Reason, &o.Operator, &o.CreatedAt, &o.ExpiresAt); err != nil {
+			return nil, fmt.Errorf("手動判定読み込みエラー: %v", err)
+		}
+		overrides = append(overrides, o)
+	}
+	return overrides, rows.Err()
+}
+
+// ActiveOverrides function: 有効な手動判定をMACアドレスごとに返す（ダッシュボード表示用）
+func ActiveOverrides() (map[string]DeviceOverride, error) {
+	overrides, err := queryOverrides("")
+	if err != nil {
+		return nil, err
+	}
+	byMAC := map[string]DeviceOverride{}
+	for _, o := range overrides {
+		byMAC[o.MACAddress] = o
+	}
+	return byMAC, nil
+}
+
+// queryOverrideEvents function: 機器の手動判定の記録を古い順に取得
+func queryOverrideEvents(macAddress string) ([]OverrideEvent, error) {
+	rows, err := db.Query(`SELECT id, mac_address, action, mode, COALESCE(reason, ''), operator, COALESCE(expires_at, ''), created_at
+		FROM device_override_event WHERE mac_address = ? ORDER BY created_at, id`, macAddress)
+	if err != nil {
+		return nil, fmt.Errorf("手動判定の記録取得エラー: %v", err)
+	}
+	defer rows.Close()
+
+	events := []OverrideEvent{}
+	for rows.Next() {
+		var e OverrideEvent
+		if err := rows.Scan(&e.ID, &e.MACAddress, &e.Action, &e.Mode, &e.Reason, &e.Operator, &e.ExpiresAt, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("手動判定の記録読み込みエラー: %v", err)
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// overridesHandler function: 有効な手動判定の一覧を返す（?mode= で dangerous / trusted を指定して絞り込み）
+func overridesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeRequest(w, r) || !databaseReady(w) {
+		return
+	}
+
+	where := ""
+	var args []interface{}
+	if mode := r.URL.Query().Get("mode"); mode != "" {
+		where = "mode = ?"
+		args = append(args, mode)
+	}
+	overrides, err := queryOverrides(where, args...)
+	if err != nil {
+		log.Printf("❌ %v", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":    "success",
+		"count":     len(overrides),
+		"overrides": overrides,
+		"timestamp": time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
+
+// deviceOverrideHandler function: 機器の手動判定の取得（GET）・設定（PUT）・解除（DELETE）
+// 設定・解除は管理トークン（ADMIN_TOKENS）が必要で、記録するオペレーターはトークンから決める
+func deviceOverrideHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodPut, http.MethodDelete:
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Method == http.MethodGet {
+		if !authorizeRequest(w, r) || !databaseReady(w) {
+			return
+		}
+		if mac, ok := annotationMACFromPath(w, r); ok {
+			writeOverride(w, mac)
+		}
+		return
+	}
+
+	operator, ok := authorizeAdmin(w, r)
+	if !ok || !databaseReady(w) {
+		return
+	}
+	mac, ok := annotationMACFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var setReq overrideRequest
+	var clearReq overrideClearRequest
+	var err error
+	if r.Method == http.MethodPut {
+		err = json.NewDecoder(r.Body).Decode(&setReq)
+	} else {
+		err = json.NewDecoder(r.Body).Decode(&clearReq)
+	}
+	// 解除は本文（理由）を省略できる
+	if err != nil && !(err == io.EOF && r.Method == http.MethodDelete) {
+		http.Error(w, fmt.Sprintf("Invalid JSON data: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	now := nowTimestamp()
+	var override DeviceOverride
+	var severity string
+	if r.Method == http.MethodPut {
+		if override, severity, err = setReq.validate(mac, operator, now); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("❌ トランザクション開始エラー: %v", err)
+		http.Error(w, "Database update failed", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM device WHERE mac_address = ?)", mac).Scan(&exists); err != nil {
+		log.Printf("❌ 機器存在確認エラー: %v", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		err = setOverride(tx, override, severity)
+	} else {
+		var found bool
+		found, err = removeOverride(tx, mac, overrideActionClear, operator, strings.TrimSpace(clearReq.Reason), now)
+		if err == nil && !found {
+			http.Error(w, "Override not found", http.StatusNotFound)
+			return
+		}
+	}
+	if err != nil {
+		log.Printf("❌ %v", err)
+		http.Error(w, "Database update failed", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("❌ コミットエラー: %v", err)
+		http.Error(w, "Database update failed", http.StatusInternalServerError)
+		return
+	}
+	if r.Method == http.MethodPut {
+		log.Printf("✅ 手動判定を設定しました (MAC: %s, %s by %s)", mac, override.Mode, override.Operator)
+	} else {
+		log.Printf("✅ 手動判定を解除しました (MAC: %s, by %s)", mac, operator)
+	}
+	writeOverride(w, mac)
+}
+
+// writeOverride function: 機器の現在の手動判定・危険フラグと記録を返す
+func writeOverride(w http.ResponseWriter, mac string) {
+	overrides, err := queryOverrides("mac_address = ?", mac)
+	var events []OverrideEvent
+	if err == nil {
+		events, err = queryOverrideEvents(mac)
+	}
+	var isDangerous bool
+	if err == nil {
+		err = db.QueryRow("SELECT COALESCE(is_dangerous, FALSE) FROM device WHERE mac_address = ?", mac).Scan(&isDangerous)
+		if err == sql.ErrNoRows {
+			err = nil
+		}
+	}
+	if err != nil {
+		log.Printf("❌ %v", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+
+	var override *DeviceOverride
+	if len(overrides) > 0 {
+		override = &overrides[0]
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":       "success",
+		"mac_address":  mac,
+		"override":     override,
+		"is_dangerous": isDangerous,
+		"history":      events,
+		"timestamp":    time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
@@ -0,0 +1,177 @@
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOverrideRequestValidate(t *testing.T) {
+	const at = "2026-10-15 12:00:00"
+	tests := []struct {
+		name         string
+		req          overrideRequest
+		wantSeverity string
+		wantExpires  string
+		wantErr      bool
+	}{
+		{name: "dangerous defaults to high", req: overrideRequest{Mode: OverrideDangerous, Reason: "rogue AP"}, wantSeverity: SeverityHigh},
+		{name: "trusted with severity", req: overrideRequest{Mode: OverrideTrusted, Reason: "printer", Severity: SeverityLow}, wantSeverity: SeverityLow},
+		{name: "expires in minutes", req: overrideRequest{Mode: OverrideTrusted, Reason: "test", ExpiresInMinutes: 90}, wantSeverity: SeverityHigh, wantExpires: "2026-10-15 13:30:00"},
+		{name: "expires at RFC3339", req: overrideRequest{Mode: OverrideTrusted, Reason: "test", ExpiresAt: "2026-10-16T09:00:00+09:00"}, wantSeverity: SeverityHigh, wantExpires: "2026-10-16 00:00:00"},
+		{name: "unknown mode", req: overrideRequest{Mode: "ignore", Reason: "x"}, wantErr: true},
+		{name: "reason is required", req: overrideRequest{Mode: OverrideDangerous, Reason: "  "}, wantErr: true},
+		{name: "unknown severity", req: overrideRequest{Mode: OverrideDangerous, Reason: "x", Severity: "urgent"}, wantErr: true},
+		{name: "both expirations", req: overrideRequest{Mode: OverrideTrusted, Reason: "x", ExpiresAt: "2026-10-16T00:00:00Z", ExpiresInMinutes: 10}, wantErr: true},
+		{name: "negative expiration", req: overrideRequest{Mode: OverrideTrusted, Reason: "x", ExpiresInMinutes: -1}, wantErr: true},
+		{name: "expiration in the past", req: overrideRequest{Mode: OverrideTrusted, Reason: "x", ExpiresAt: "2026-10-15T11:00:00Z"}, wantErr: true},
+		{name: "invalid expires_at", req: overrideRequest{Mode: OverrideTrusted, Reason: "x", ExpiresAt: "tomorrow"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, severity, err := tt.req.validate("aa:bb:cc:00:00:01", "alice", at)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("validate = %+v, want error", o)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("validate error: %v", err)
+			}
+			if severity != tt.wantSeverity || o.ExpiresAt != tt.wantExpires || o.Operator != "alice" {
+				t.Errorf("validate = %+v, %q; want severity %q, expires_at %q, operator alice", o, severity, tt.wantSeverity, tt.wantExpires)
+			}
+		})
+	}
+}
+
+func TestAdminTokens(t *testing.T) {
+	tests := []struct {
+		name         string
+		value        string
+		want         []adminToken
+		wantWarnings int
+	}{
+		{name: "unset", value: ""},
+		{name: "two operators", value: "alice:a-token, bob:b-token", want: []adminToken{{"alice", "a-token"}, {"bob", "b-token"}}},
+		{name: "malformed entries are ignored", value: "alice,:x,bob:,carol:c-token", want: []adminToken{{"carol", "c-token"}}, wantWarnings: 3},
+		{name: "sensor token is not an admin token", value: "alice:sensor-token,bob:b-token", want: []adminToken{{"bob", "b-token"}}, wantWarnings: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("NET_TOKEN", "sensor-token")
+			t.Setenv("ADMIN_TOKENS", tt.value)
+			tokens, warnings := adminTokens()
+			if !reflect.DeepEqual(tokens, tt.want) {
+				t.Errorf("tokens = %+v, want %+v", tokens, tt.want)
+			}
+			if len(warnings) != tt.wantWarnings {
+				t.Errorf("warnings = %q, want %d", warnings, tt.wantWarnings)
+			}
+		})
+	}
+}
+
+func TestDeviceOverrideHandler(t *testing.T) {
+	t.Setenv("NET_TOKEN", "sensor-token")
+	const mac = "aa:bb:cc:00:00:01"
+	const dangerous = `{"mode":"dangerous","reason":"rogue AP","operator":"mallory"}`
+
+	tests := []struct {
+		name          string
+		adminTokens   string
+		token         string
+		method        string
+		body          string
+		wantStatus    int
+		wantOverride  string // 処理後の device_override.mode（空は手動判定なし）
+		wantOperator  string
+		wantDangerous bool
+	}{
+		{name: "read with the sensor token", adminTokens: "alice:admin-token", token: "sensor-token", method: http.MethodGet, wantStatus: http.StatusOK},
+		{name: "admin operations disabled without ADMIN_TOKENS", token: "sensor-token", method: http.MethodPut, body: dangerous, wantStatus: http.StatusForbidden},
+		{name: "sensor token cannot set", adminTokens: "alice:admin-token", token: "sensor-token", method: http.MethodPut, body: dangerous, wantStatus: http.StatusUnauthorized},
+		{name: "set dangerous as the token's operator", adminTokens: "alice:admin-token", token: "admin-token", method: http.MethodPut, body: dangerous,
+			wantStatus: http.StatusOK, wantOverride: OverrideDangerous, wantOperator: "alice", wantDangerous: true},
+		{name: "set trusted", adminTokens: "alice:admin-token,bob:bob-token", token: "bob-token", method: http.MethodPut, body: `{"mode":"trusted","reason":"printer"}`,
+			wantStatus: http.StatusOK, wantOverride: OverrideTrusted, wantOperator: "bob"},
+		{name: "invalid request", adminTokens: "alice:admin-token", token: "admin-token", method: http.MethodPut, body: `{"mode":"trusted"}`, wantStatus: http.StatusBadRequest},
+		{name: "clear without body", adminTokens: "alice:admin-token", token: "admin-token", method: http.MethodDelete, wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ADMIN_TOKENS", tt.adminTokens)
+			database := useTestDatabase(t)
+			if _, err := database.Exec(`INSERT INTO device (mac_address, ip_address, is_dangerous) VALUES (?, '192.168.1.10', FALSE)`, mac); err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(tt.method, "/api/v1/devices/"+mac+"/override", strings.NewReader(tt.body))
+			req.SetPathValue("mac", mac)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			rec := httptest.NewRecorder()
+			deviceOverrideHandler(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+
+			var mode, operator string
+			var dangerous bool
+			database.QueryRow("SELECT mode, operator FROM device_override WHERE mac_address = ?", mac).Scan(&mode, &operator)
+			database.QueryRow("SELECT is_dangerous FROM device WHERE mac_address = ?", mac).Scan(&dangerous)
+			if mode != tt.wantOverride || operator != tt.wantOperator || dangerous != tt.wantDangerous {
+				t.Errorf("override = %q by %q, is_dangerous = %v; want %q by %q, %v",
+					mode, operator, dangerous, tt.wantOverride, tt.wantOperator, tt.wantDangerous)
+			}
+		})
+	}
+}
+
+func TestTrustedOverrideMasksAutomatedDangers(t *testing.T) {
+	database := openTestDatabase(t)
+	const mac = "aa:bb:cc:00:00:01"
+	const at = "2026-10-15 12:00:00"
+	if _, err := database.Exec(`INSERT INTO device (mac_address, ip_address, is_dangerous) VALUES (?, '192.168.1.10', FALSE)`, mac); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := database.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	dangerous := func() bool {
+		var v bool
+		if err := tx.QueryRow("SELECT is_dangerous FROM device WHERE mac_address = ?", mac).Scan(&v); err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	steps := []struct {
+		name string
+		do   func() error
+		want bool
+	}{
+		{name: "automated danger", do: func() error {
+			return raiseDanger(tx, mac, dangerHit{Source: DangerSourceKernLog, Severity: SeverityHigh, Reason: "scan"}, at)
+		}, want: true},
+		{name: "trusted override", do: func() error {
+			return setOverride(tx, DeviceOverride{MACAddress: mac, Mode: OverrideTrusted, Reason: "printer", Operator: "alice", CreatedAt: at, ExpiresAt: "2026-10-15 13:00:00"}, SeverityHigh)
+		}, want: false},
+		{name: "expired override restores the automated danger", do: func() error {
+			_, err := expireOverrides(tx, "2026-10-15 13:00:00")
+			return err
+		}, want: true},
+	}
+	for _, s := range steps {
+		if err := s.do(); err != nil {
+			t.Fatalf("%s: %v", s.name, err)
+		}
+		if got := dangerous(); got != s.want {
+			t.Fatalf("%s: is_dangerous = %v, want %v", s.name, got, s.want)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PayloadVersion2: v2 形式のリクエストの version フィールドの値
+const PayloadVersion2 = 2
+
+// ContentTypeV2: v2 形式であることを示す Content-Type（version フィールドを省略できる）
+const ContentTypeV2 = "application/vnd.nethygiene.v2+json"
+
+// maxFutureSkew: observed_at として受け付ける未来の時刻の許容範囲（センサーの時計のずれ）
+const maxFutureSkew = 5 * time.Minute
+
+// Observation type: v2 形式の機器1台分の観測
+type Observation struct {
+	MAC        string   `json:"mac"`
+	IPs        []string `json:"ips"`
+	Vendor     string   `json:"vendor,omitempty"`
+	Hostname   string   `json:"hostname,omitempty"`
+	Interface  string   `json:"interface,omitempty"`
+	ObservedAt string   `json:"observed_at,omitempty"` // RFC3339（省略時は受信日時）
+	Log        string   `json:"log,omitempty"`         // /status のみ: 危険判定の証跡となる元のログ行
+}
+
+// PayloadV2 type: v2 形式の /upload・/status のリクエスト
+type PayloadV2 struct {
+	Version      int           `json:"version"`
+	SensorID     string        `json:"sensor_id,omitempty"` // 省略時は X-Sensor-ID ヘッダー
+	ScanID       string        `json:"scan_id,omitempty"`   // センサー側で付けたスキャンのID
+	Observations []Observation `json:"observations"`
+}
+
+// observation type: v1・v2 共通の機器1台分の観測（ハンドラー内部で使用）
+type observation struct {
+	Key        string // ログ表示用（v1 は "device1" などのキー、v2 は配列の位置）
+	MAC        string
+	IPs        []string
+	Vendor     string
+	Hostname   string
+	Interface  string
+	ObservedAt string // DB保存用の書式（UTC）
+	Log        string
+
+	// observed_at を解釈できなかった場合のエラー（検証時にこの観測だけを受け付けない）
+	ObservedAtError string
+}
+
+// IP function: 代表のIPアドレス（device.ip_address に保存する値）
+func (o observation) IP() string {
+	if len(o.IPs) == 0 {
+		return ""
+	}
+	return o.IPs[0]
+}
+
+// ingestBatch type: 1リクエスト分の観測
+type ingestBatch struct {
+	Version      int
+	SensorID     string
+	ScanID       string
+	Observations []observation
+}
+
+// payloadVersion function: Content-Type または version フィールドからリクエストの形式を判定
+// version のない JSON は従来の {"devices": {"device1": {"mac": {"key": ...}}}} 形式（v1）とみなす
+func payloadVersion(r *http.Request, body []byte) (int, error) {
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil && mediaType == ContentTypeV2 {
+		return PayloadVersion2, nil
+	}
+	var probe struct {
+		Version *int `json:"version"`
+	}
+	if err := json.Unmarshal(body, &probe); err != nil {
+		return 0, err
+	}
+	if probe.Version == nil {
+		return 1, nil
+	}
+	if *probe.Version != 1 && *probe.Version != PayloadVersion2 {
+		return 0, fmt.Errorf("unsupported payload version %d (1 or 2)", *probe.Version)
+	}
+	return *probe.Version, nil
+}
+
+// decodeIngestBatch function: /upload・/status のリクエストを形式に応じて読み込む
+// statusLog が true なら v1 の log.key を証跡として読み込む（/status 用）
+func decodeIngestBatch(r *http.Request, statusLog bool) (ingestBatch, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return ingestBatch{}, err
+	}
+	version, err := payloadVersion(r, body)
+	if err != nil {
+		return ingestBatch{}, err
+	}
+	receivedAt := nowTimestamp()
+
+	if version == PayloadVersion2 {
+		var payload PayloadV2
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return ingestBatch{}, err
+		}
+		batch := ingestBatch{Version: PayloadVersion2, SensorID: strings.TrimSpace(payload.SensorID), ScanID: strings.TrimSpace(payload.ScanID)}
+		for i, o := range payload.Observations {
+			observedAt, err := parseObservedAt(o.ObservedAt, receivedAt)
+			observedAtError := ""
+			if err != nil {
+				observedAtError = fmt.Sprintf("observed_at: %v", err)
+			}
+			batch.Observations = append(batch.Observations, observation{
+				Key:        fmt.Sprintf("observations[%d]", i),
+				MAC:        o.MAC,
+				IPs:        o.IPs,
+				Vendor:     o.Vendor,
+				Hostname:   strings.TrimSpace(o.Hostname),
+				Interface:  strings.TrimSpace(o.Interface),
+				ObservedAt: observedAt,
+				Log:        o.Log,
+
+				ObservedAtError: observedAtError,
+			})
+		}
+		return batch, nil
+	}
+
+	// v1: キー（"device1" など）の順に処理する
+	batch := ingestBatch{Version: 1}
+	if statusLog {
+		var data StatusJSON
+		if err := json.Unmarshal(body, &data); err != nil {
+			return ingestBatch{}, err
+		}
+		for _, key := range sortedKeys(data.Devices) {
+			d := data.Devices[key]
+			batch.Observations = append(batch.Observations, observation{Key: key, MAC: d.MAC.Key, IPs: singleIP(d.IP.Key), ObservedAt: receivedAt, Log: d.Log.Key})
+		}
+		return batch, nil
+	}
+	var data JSON
+	if err := json.Unmarshal(body, &data); err != nil {
+		return ingestBatch{}, err
+	}
+	for _, key := range sortedKeys(data.Devices) {
+		d := data.Devices[key]
+		batch.Observations = append(batch.Observations, observation{Key: key, MAC: d.MAC.Key, IPs: singleIP(d.IP.Key), Vendor: d.Vendor.Key, ObservedAt: receivedAt})
+	}
+	return batch, nil
+}
+
+// parseObservedAt function: observed_at（RFC3339 または DB保存用の書式）を DB保存用の書式に変換
+// 省略時と、時計のずれの許容範囲を超えて未来の場合は受信日時とする
+func parseObservedAt(value, receivedAt string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return receivedAt, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		if t, err = time.Parse(timestampLayout, value); err != nil {
+			return "", fmt.Errorf("RFC3339 形式の日時ではありません: %q", value)
+		}
+	}
+	if t.After(time.Now().Add(maxFutureSkew)) {
+		return receivedAt, nil
+	}
+	return t.UTC().Format(timestampLayout), nil
+}
+
+// singleIP function: v1 の1つのIPアドレスを配列にする（空なら空配列）
+func singleIP(ip string) []string {
+	if ip == "" {
+		return nil
+	}
+	return []string{ip}
+}
+
+// sortedKeys function: map のキーをソートして返す
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
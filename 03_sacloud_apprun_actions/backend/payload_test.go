@@ -0,0 +1,46 @@
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseObservedAt(t *testing.T) {
+	const receivedAt = "2026-10-15 12:00:00"
+	future := time.Now().Add(maxFutureSkew + time.Hour).UTC().Format(time.RFC3339)
+
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{name: "empty uses received_at", value: "", want: receivedAt},
+		{name: "blank uses received_at", value: "   ", want: receivedAt},
+		{name: "RFC3339 UTC", value: "2026-10-15T11:58:30Z", want: "2026-10-15 11:58:30"},
+		{name: "RFC3339 with offset", value: "2026-10-15T20:58:30+09:00", want: "2026-10-15 11:58:30"},
+		{name: "RFC3339 with fraction", value: "2026-10-15T11:58:30.123Z", want: "2026-10-15 11:58:30"},
+		{name: "database layout", value: "2026-10-15 11:58:30", want: "2026-10-15 11:58:30"},
+		{name: "too far in the future", value: future, want: receivedAt},
+		{name: "date only", value: "2026-10-15", wantErr: true},
+		{name: "unix time", value: "1760529510", wantErr: true},
+		{name: "garbage", value: "yesterday", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseObservedAt(tt.value, receivedAt)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseObservedAt(%q) = %q, want error", tt.value, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseObservedAt(%q) error: %v", tt.value, err)
+			}
+			if got != tt.want {
+				t.Errorf("parseObservedAt(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
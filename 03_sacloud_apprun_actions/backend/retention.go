@@ -0,0 +1,294 @@
+package backend
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// データ種別ごとの保持期間のデフォルト値（日数。0 なら削除しない）
+const (
+	defaultObservationRetentionDays = 90
+	defaultFlowRetentionDays        = 30
+	defaultIncidentRetentionDays    = 365
+	defaultDeviceRetentionDays      = 0
+)
+
+// 削除処理の設定のデフォルト値
+const (
+	defaultRetentionBatchSize       = 500
+	defaultRetentionIntervalMinutes = 60
+)
+
+// retentionBatchPause: バッチの間に空ける時間（その間に /upload・/status の書き込みを通す）
+const retentionBatchPause = 200 * time.Millisecond
+
+// retentionTarget type: 削除対象のテーブルと条件（条件の ? にはすべて保持期限の日時が入る）
+type retentionTarget struct {
+	Table string
+	Where string
+}
+
+// retentionClass type: 保持期間を設定するデータ種別（Targets は関連する行から順に削除する）
+type retentionClass struct {
+	Name        string
+	Env         string
+	DefaultDays int
+	Targets     []retentionTarget
+}
+
+// purgeableDevice: 長期未検出の機器として削除してよい条件（危険判定中・手動判定あり・未解決のインシデントがある機器は残す）
+const purgeableDevice = `last_seen < ? AND COALESCE(is_dangerous, FALSE) = FALSE
+	AND mac_address NOT IN (SELECT mac_address FROM device_override)
+	AND mac_address NOT IN (SELECT mac_address FROM incident WHERE status != 'resolved')`
+
+// retainedScanCount: 保持期間を過ぎても観測履歴を残す、センサーごとの最新のスキャン数（スキャン差分の既定の比較対象）
+const retainedScanCount = 2
+
+// purgeableObservation: 保持期間を過ぎた観測履歴として削除してよい条件
+// スキャン差分の既定の比較対象になるセンサーごとの最新のスキャンの観測と、
+// ゲートウェイのMACアドレス変化の検知が前回の値として参照する、IPアドレスごとの最新の観測は残す
+var purgeableObservation = fmt.Sprintf(`observed_at < ?
+	AND COALESCE(scan_id, 0) NOT IN (SELECT id FROM (
+		SELECT id, ROW_NUMBER() OVER (PARTITION BY sensor_id ORDER BY id DESC) AS n FROM scan_session) WHERE n <= %d)
+	AND (COALESCE(ip_address, '') = '' OR EXISTS (SELECT 1 FROM device_observation newer
+		WHERE newer.ip_address = device_observation.ip_address
+		AND (newer.observed_at > device_observation.observed_at OR (newer.observed_at = device_observation.observed_at AND newer.id > device_observation.id))))`,
+	retainedScanCount)
+
+// retentionClasses: データ種別ごとの削除対象
+// devices は機器に関連するすべての行（注釈・タグ・手動判定の履歴・解決済みのインシデントを含む）を削除してから機器を削除する
+var retentionClasses = []retentionClass{
+	{"observations", "RETENTION_OBSERVATION_DAYS", defaultObservationRetentionDays, []retentionTarget{
+		{"device_observation", purgeableObservation},
+		{"scan_session", "started_at < ? AND NOT EXISTS (SELECT 1 FROM device_observation o WHERE o.scan_id = scan_session.id)"},
+	}},
+	{"flows", "RETENTION_FLOW_DAYS", defaultFlowRetentionDays, []retentionTarget{
+		{"flow", "observed_at < ?"},
+	}},
+	{"incidents", "RETENTION_INCIDENT_DAYS", defaultIncidentRetentionDays, []retentionTarget{
+		{"incident_note", "incident_id IN (SELECT id FROM incident WHERE status = 'resolved' AND resolved_at < ?)"},
+		{"incident", "status = 'resolved' AND resolved_at < ?"},
+	}},
+	{"devices", "RETENTION_DEVICE_DAYS", defaultDeviceRetentionDays, []retentionTarget{
+		{"device_observation", "mac_address IN (SELECT mac_address FROM device WHERE " + purgeableDevice + ")"},
+		{"device_address", "mac_address IN (SELECT mac_address FROM device WHERE " + purgeableDevice + ")"},
+		{"device_danger", "mac_address IN (SELECT mac_address FROM device WHERE " + purgeableDevice + ")"},
+		{"danger_hit", "mac_address IN (SELECT mac_address FROM device WHERE " + purgeableDevice + ")"},
+		{"danger_transition", "mac_address IN (SELECT mac_address FROM device WHERE " + purgeableDevice + ")"},
+		{"dhcp_lease", "mac_address IN (SELECT mac_address FROM device WHERE " + purgeableDevice + ")"},
+		{"security_event", "mac_address IN (SELECT mac_address FROM device WHERE " + purgeableDevice + ")"},
+		{"flow", "mac_address IN (SELECT mac_address FROM device WHERE " + purgeableDevice + ")"},
+		{"device_tag", "mac_address IN (SELECT mac_address FROM device WHERE " + purgeableDevice + ")"},
+		{"device_annotation", "mac_address IN (SELECT mac_address FROM device WHERE " + purgeableDevice + ")"},
+		{"device_override_event", "mac_address IN (SELECT mac_address FROM device WHERE " + purgeableDevice + ")"},
+		{"incident_note", "incident_id IN (SELECT id FROM incident WHERE mac_address IN (SELECT mac_address FROM device WHERE " + purgeableDevice + "))"},
+		{"incident", "mac_address IN (SELECT mac_address FROM device WHERE " + purgeableDevice + ")"},
+		{"device", purgeableDevice},
+	}},
+}
+
+// RetentionReport type: データ種別1つ分の削除対象（または削除した件数）
+type RetentionReport struct {
+	Class         string         `json:"class"`
+	Env           string         `json:"env"`
+	RetentionDays int            `json:"retention_days"` // 0 なら削除しない
+	Cutoff        string         `json:"cutoff,omitempty"`
+	Tables        map[string]int `json:"tables"`
+	Total         int            `json:"total"`
+}
+
+// RetentionRun type: 削除処理1回分の結果
+type RetentionRun struct {
+	StartedAt  string            `json:"started_at"`
+	FinishedAt string            `json:"finished_at"`
+	Deleted    []RetentionReport `json:"deleted"`
+	Error      string            `json:"error,omitempty"`
+}
+
+var (
+	lastRetentionRunMu sync.Mutex
+	lastRetentionRun   *RetentionRun
+)
+
+// retentionDays function: 環境変数から保持日数を取得（0 は削除しない。未設定・不正値の場合はデフォルト値）
+func retentionDays(name string, defaultValue int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Printf("警告: 環境変数 %s の値が不正です (%q)。デフォルト値 %d を使用します", name, value, defaultValue)
+		return defaultValue
+	}
+	return n
+}
+
+// cutoffArgs function: 条件の ? の数だけ保持期限の日時を並べる
+func cutoffArgs(where, cutoff string) []interface{} {
+	args := make([]interface{}, strings.Count(where, "?"))
+	for i := range args {
+		args[i] = cutoff
+	}
+	return args
+}
+
+// newRetentionReport function: データ種別の設定から保持期限を計算
+func newRetentionReport(c retentionClass) RetentionReport {
+	report := RetentionReport{Class: c.Name, Env: c.Env, RetentionDays: retentionDays(c.Env, c.DefaultDays), Tables: map[string]int{}}
+	if report.RetentionDays > 0 {
+		report.Cutoff = cutoffTimestamp(time.Duration(report.RetentionDays) * 24 * time.Hour)
+	}
+	return report
+}
+
+// retentionDryRun function: 保持期間を過ぎて削除対象になっている件数をデータ種別・テーブルごとに数える
+func retentionDryRun() ([]RetentionReport, error) {
+	reports := []RetentionReport{}
+	for _, c := range retentionClasses {
+		report := newRetentionReport(c)
+		if report.RetentionDays > 0 {
+			for _, t := range c.Targets {
+				var count int
+				query := "SELECT COUNT(*) FROM " + t.Table + " WHERE " + t.Where
+				if err := db.QueryRow(query, cutoffArgs(t.Where, report.Cutoff)...).Scan(&count); err != nil {
+					return nil, fmt.Errorf("削除対象の件数取得エラー (%s): %v", t.Table, err)
+				}
+				report.Tables[t.Table] += count
+				report.Total += count
+			}
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// purgeBatch function: 削除対象の行を最大 limit 件削除する（1バッチ = 1トランザクション）
+func purgeBatch(t retentionTarget, cutoff string, limit int) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("トランザクション開始エラー: %v", err)
+	}
+	defer tx.Rollback()
+
+	args := append(cutoffArgs(t.Where, cutoff), limit)
+	result, err := tx.Exec("DELETE FROM "+t.Table+" WHERE rowid IN (SELECT rowid FROM "+t.Table+" WHERE "+t.Where+" LIMIT ?)", args...)
+	if err != nil {
+		return 0, fmt.Errorf("削除エラー (%s): %v", t.Table, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("コミットエラー (%s): %v", t.Table, err)
+	}
+	n, _ := result.RowsAffected()
+	return int(n), nil
+}
+
+// runRetention function: 保持期間を過ぎたデータを小さなバッチに分けて削除
+func runRetention(batchSize int) RetentionRun {
+	run := RetentionRun{StartedAt: nowTimestamp(), Deleted: []RetentionReport{}}
+	for _, c := range retentionClasses {
+		report := newRetentionReport(c)
+		if report.RetentionDays > 0 {
+		targets:
+			for _, t := range c.Targets {
+				for {
+					n, err := purgeBatch(t, report.Cutoff, batchSize)
+					report.Tables[t.Table] += n
+					report.Total += n
+					if err != nil {
+						run.Error = err.Error()
+						break targets
+					}
+					if n < batchSize {
+						break
+					}
+					time.Sleep(retentionBatchPause)
+				}
+			}
+		}
+		run.Deleted = append(run.Deleted, report)
+		if run.Error != "" {
+			break
+		}
+	}
+	run.FinishedAt = nowTimestamp()
+
+	lastRetentionRunMu.Lock()
+	lastRetentionRun = &run
+	lastRetentionRunMu.Unlock()
+	return run
+}
+
+// startRetention function: 保持期間を過ぎたデータを RETENTION_INTERVAL_MINUTES ごとに削除
+// 環境変数 RETENTION_OBSERVATION_DAYS / RETENTION_FLOW_DAYS / RETENTION_INCIDENT_DAYS / RETENTION_DEVICE_DAYS で保持日数を設定する
+func startRetention() {
+	interval := time.Duration(envInt("RETENTION_INTERVAL_MINUTES", defaultRetentionIntervalMinutes)) * time.Minute
+	batchSize := envInt("RETENTION_BATCH_SIZE", defaultRetentionBatchSize)
+	summary := []string{}
+	for _, c := range retentionClasses {
+		summary = append(summary, fmt.Sprintf("%s=%d日", c.Name, retentionDays(c.Env, c.DefaultDays)))
+	}
+	log.Printf("データ保持期間: %s (%v ごとに %d 件ずつ削除、0日は削除しない)", strings.Join(summary, ", "), interval, batchSize)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if db == nil {
+				continue
+			}
+			run := runRetention(batchSize)
+			if run.Error != "" {
+				log.Printf("❌ データ削除処理エラー: %s", run.Error)
+			}
+			for _, report := range run.Deleted {
+				if report.Total > 0 {
+					log.Printf("✅ 保持期間を過ぎたデータを削除しました (%s: %d件 %v)", report.Class, report.Total, report.Tables)
+				}
+			}
+		}
+	}()
+}
+
+// retentionHandler function: 保持期間の設定と、次の削除処理で削除される件数（dry-run）・前回の削除処理の結果を返す
+func retentionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeRequest(w, r) || !databaseReady(w) {
+		return
+	}
+
+	reports, err := retentionDryRun()
+	if err != nil {
+		log.Printf("❌ %v", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	total := 0
+	for _, report := range reports {
+		total += report.Total
+	}
+
+	lastRetentionRunMu.Lock()
+	lastRun := lastRetentionRun
+	lastRetentionRunMu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":           "success",
+		"dry_run":          true,
+		"count":            total,
+		"classes":          reports,
+		"batch_size":       envInt("RETENTION_BATCH_SIZE", defaultRetentionBatchSize),
+		"interval_minutes": envInt("RETENTION_INTERVAL_MINUTES", defaultRetentionIntervalMinutes),
+		"last_run":         lastRun,
+		"timestamp":        time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
@@ -0,0 +1,122 @@
+package backend
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestRetentionDays(t *testing.T) {
+	tests := []struct {
+		env  string
+		want int
+	}{
+		{env: "", want: 90},
+		{env: "30", want: 30},
+		{env: "0", want: 0},
+		{env: "-1", want: 90},
+		{env: "x", want: 90},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			t.Setenv("RETENTION_OBSERVATION_DAYS", tt.env)
+			if got := retentionDays("RETENTION_OBSERVATION_DAYS", 90); got != tt.want {
+				t.Errorf("retentionDays = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunRetentionKeepsObservationsInUse(t *testing.T) {
+	database := useTestDatabase(t)
+	t.Setenv("RETENTION_OBSERVATION_DAYS", "90")
+	t.Setenv("RETENTION_FLOW_DAYS", "0")
+	t.Setenv("RETENTION_INCIDENT_DAYS", "0")
+	t.Setenv("RETENTION_DEVICE_DAYS", "0")
+
+	const old = "2025-01-01 00:00:00"
+	exec := func(query string, args ...interface{}) {
+		t.Helper()
+		if _, err := database.Exec(query, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id, sensor := range map[int]string{1: "s1", 2: "s1", 3: "s1", 4: "s1", 5: "s2"} {
+		exec("INSERT INTO scan_session (id, sensor_id, started_at) VALUES (?, ?, ?)", id, sensor, old)
+	}
+
+	observations := []struct {
+		name   string
+		scanID interface{}
+		mac    string
+		ip     string
+		at     string
+		kept   bool
+	}{
+		{name: "old scan, newer observation of the ip exists", scanID: 1, mac: "aa:bb:cc:00:00:01", ip: "192.168.1.10", at: "2025-01-01 00:00:00"},
+		{name: "latest observation of the gateway ip", scanID: 2, mac: "aa:bb:cc:00:00:fe", ip: "192.168.1.1", at: "2025-01-02 00:00:00", kept: true},
+		{name: "old scan, superseded ip", scanID: 2, mac: "aa:bb:cc:00:00:01", ip: "192.168.1.10", at: "2025-01-02 00:00:00"},
+		{name: "second latest scan of the sensor", scanID: 3, mac: "aa:bb:cc:00:00:01", ip: "192.168.1.10", at: "2025-01-03 00:00:00", kept: true},
+		{name: "latest scan of the sensor", scanID: 4, mac: "aa:bb:cc:00:00:01", ip: "192.168.1.10", at: "2025-01-04 00:00:00", kept: true},
+		{name: "latest scan of another sensor", scanID: 5, mac: "aa:bb:cc:00:00:02", ip: "192.168.1.20", at: "2025-01-01 00:00:00", kept: true},
+		{name: "old observation without ip or scan", scanID: nil, mac: "aa:bb:cc:00:00:03", at: "2025-01-01 00:00:00"},
+		{name: "recent observation", scanID: nil, mac: "aa:bb:cc:00:00:03", ip: "192.168.1.30", at: nowTimestamp(), kept: true},
+	}
+	ids := map[int64]int{}
+	for i, o := range observations {
+		result, err := database.Exec("INSERT INTO device_observation (mac_address, ip_address, observed_at, scan_id) VALUES (?, NULLIF(?, ''), ?, ?)",
+			o.mac, o.ip, o.at, o.scanID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := result.LastInsertId()
+		ids[id] = i
+	}
+
+	reports, err := retentionDryRun()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reports[0].Tables["device_observation"]; got != 3 {
+		t.Errorf("dry run device_observation = %d, want 3", got)
+	}
+
+	run := runRetention(2)
+	if run.Error != "" {
+		t.Fatal(run.Error)
+	}
+	if got := run.Deleted[0].Tables["device_observation"]; got != 3 {
+		t.Errorf("deleted device_observation = %d, want 3", got)
+	}
+
+	for id, i := range ids {
+		o := observations[i]
+		var exists bool
+		if err := database.QueryRow("SELECT EXISTS(SELECT 1 FROM device_observation WHERE id = ?)", id).Scan(&exists); err != nil {
+			t.Fatal(err)
+		}
+		if exists != o.kept {
+			t.Errorf("%s: kept = %v, want %v", o.name, exists, o.kept)
+		}
+	}
+
+	// 観測がすべて削除されたスキャンだけを削除する
+	for id, kept := range map[int64]bool{1: false, 2: true, 3: true, 4: true, 5: true} {
+		_, err := getScanSession(id)
+		if exists := err == nil; exists != kept {
+			t.Errorf("scan_session %d: kept = %v (%v), want %v", id, exists, err, kept)
+		} else if err != nil && err != sql.ErrNoRows {
+			t.Fatal(err)
+		}
+	}
+
+	// 残した観測でスキャン差分を計算できる
+	from, _ := getScanSession(3)
+	to, _ := getScanSession(4)
+	diff, err := diffScanSessions(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Appeared) != 0 || len(diff.Disappeared) != 0 || len(diff.Changed) != 0 {
+		t.Errorf("diff after retention = %+v, want no changes", diff)
+	}
+}
@@ -0,0 +1,316 @@
+package backend
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ScanSession type: 1回の /upload（arp-scan --localnet の1回分）を表す
+type ScanSession struct {
+	ID       int64  `json:"id"`
+	SensorID string `json:"sensor_id"`
+	// v2 のリクエストでセンサー側が付けたスキャンのID
+	SensorScanID string `json:"sensor_scan_id,omitempty"`
+	StartedAt    string `json:"started_at"`
+	DeviceCount  int    `json:"device_count"`
+}
+
+// ScanDeviceState type: スキャン時点での機器の状態
+type ScanDeviceState struct {
+	MACAddress string `json:"mac_address"`
+	IPAddress  string `json:"ip_address"`
+	Vendor     string `json:"vendor"`
+}
+
+// ScanDeviceChange type: 2つのスキャン間でIPまたはベンダーが変化した機器
+type ScanDeviceChange struct {
+	MACAddress string          `json:"mac_address"`
+	Before     ScanDeviceState `json:"before"`
+	After      ScanDeviceState `json:"after"`
+	Fields     []string        `json:"fields"`
+}
+
+// ScanDiff type: 2つのスキャンの差分
+type ScanDiff struct {
+	From        ScanSession        `json:"from"`
+	To          ScanSession        `json:"to"`
+	Appeared    []ScanDeviceState  `json:"appeared"`
+	Disappeared []ScanDeviceState  `json:"disappeared"`
+	Changed     []ScanDeviceChange `json:"changed"`
+}
+
+// sensorIDFromRequest function: X-Sensor-ID ヘッダーからセンサーIDを取得（未指定時は送信元IP）
+func sensorIDFromRequest(r *http.Request) string {
+	if id := strings.TrimSpace(r.Header.Get("X-Sensor-ID")); id != "" {
+		return id
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// startScanSession function: スキャンセッションを作成
+func startScanSession(sensorID, sensorScanID, startedAt string) (ScanSession, error) {
+	result, err := db.Exec("INSERT INTO scan_session (sensor_id, sensor_scan_id, started_at, device_count) VALUES (?, NULLIF(?, ''), ?, 0)",
+		sensorID, sensorScanID, startedAt)
+	if err != nil {
+		return ScanSession{}, fmt.Errorf("スキャンセッション作成エラー: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return ScanSession{}, fmt.Errorf("スキャンセッションID取得エラー: %v", err)
+	}
+	return ScanSession{ID: id, SensorID: sensorID, SensorScanID: sensorScanID, StartedAt: startedAt}, nil
+}
+
+// finishScanSession function: スキャンセッションに記録できた機器数を保存
+func finishScanSession(session ScanSession, deviceCount int) error {
+	_, err := db.Exec("UPDATE scan_session SET device_count = ? WHERE id = ?", deviceCount, session.ID)
+	if err != nil {
+		return fmt.Errorf("スキャンセッション更新エラー (ID: %d): %v", session.ID, err)
+	}
+	return nil
+}
+
+// getScanSession function: IDを指定してスキャンセッションを取得
+func getScanSession(id int64) (ScanSession, error) {
+	var s ScanSession
+	err := db.QueryRow("SELECT id, sensor_id, COALESCE(sensor_scan_id, ''), started_at, device_count FROM scan_session WHERE id = ?", id).
+		Scan(&s.ID, &s.SensorID, &s.SensorScanID, &s.StartedAt, &s.DeviceCount)
+	return s, err
+}
+
+// findScanSession function: 条件に一致する最初のスキャンセッションを取得
+func findScanSession(where, order string, args ...interface{}) (ScanSession, error) {
+	var s ScanSession
+	err := db.QueryRow("SELECT id, sensor_id, COALESCE(sensor_scan_id, ''), started_at, device_count FROM scan_session WHERE "+where+" ORDER BY "+order+" LIMIT 1", args...).
+		Scan(&s.ID, &s.SensorID, &s.SensorScanID, &s.StartedAt, &s.DeviceCount)
+	return s, err
+}
+
+// scanDeviceStates function: スキャンセッションで観測された機器の状態をMACアドレスごとに取得
+func scanDeviceStates(scanID int64) (map[string]ScanDeviceState, error) {
+	rows, err := db.Query(`SELECT mac_address, COALESCE(ip_address, ''), COALESCE(vendor, '') FROM device_observation
+		WHERE scan_id = ? ORDER BY id`, scanID)
+	if err != nil {
+		return nil, fmt.Errorf("観測履歴取得エラー (スキャンID: %d): %v", scanID, err)
+	}
+	defer rows.Close()
+
+	states := map[string]ScanDeviceState{}
+	for rows.Next() {
+		var s ScanDeviceState
+		if err := rows.Scan(&s.MACAddress, &s.IPAddress, &s.Vendor); err != nil {
+			return nil, fmt.Errorf("観測履歴読み込みエラー (スキャンID: %d): %v", scanID, err)
+		}
+		states[s.MACAddress] = s
+	}
+	return states, rows.Err()
+}
+
+// diffScanSessions function: 2つのスキャンセッションの差分を計算
+func diffScanSessions(from, to ScanSession) (ScanDiff, error) {
+	before, err := scanDeviceStates(from.ID)
+	if err != nil {
+		return ScanDiff{}, err
+	}
+	after, err := scanDeviceStates(to.ID)
+	if err != nil {
+		return ScanDiff{}, err
+	}
+
+	diff := ScanDiff{
+		From:        from,
+		To:          to,
+		Appeared:    []ScanDeviceState{},
+		Disappeared: []ScanDeviceState{},
+		Changed:     []ScanDeviceChange{},
+	}
+	for mac, a := range after {
+		b, ok := before[mac]
+		if !ok {
+			diff.Appeared = append(diff.Appeared, a)
+			continue
+		}
+		var fields []string
+		if a.IPAddress != b.IPAddress {
+			fields = append(fields, "ip_address")
+		}
+		if a.Vendor != b.Vendor {
+			fields = append(fields, "vendor")
+		}
+		if len(fields) > 0 {
+			diff.Changed = append(diff.Changed, ScanDeviceChange{MACAddress: mac, Before: b, After: a, Fields: fields})
+		}
+	}
+	for mac, b := range before {
+		if _, ok := after[mac]; !ok {
+			diff.Disappeared = append(diff.Disappeared, b)
+		}
+	}
+
+	sort.Slice(diff.Appeared, func(i, j int) bool { return diff.Appeared[i].MACAddress < diff.Appeared[j].MACAddress })
+	sort.Slice(diff.Disappeared, func(i, j int) bool { return diff.Disappeared[i].MACAddress < diff.Disappeared[j].MACAddress })
+	sort.Slice(diff.Changed, func(i, j int) bool { return diff.Changed[i].MACAddress < diff.Changed[j].MACAddress })
+	return diff, nil
+}
+
+// parseSinceParam function: since パラメータ（RFC3339 またはローカル時刻の "2006-01-02 15:04"）をDB保存用の文字列に変換
+func parseSinceParam(value string) (string, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC().Format(timestampLayout), nil
+	}
+	for _, layout := range []string{timestampLayout, "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t.UTC().Format(timestampLayout), nil
+		}
+	}
+	return "", fmt.Errorf("invalid time %q", value)
+}
+
+// scansHandler function: 最近のスキャンセッション一覧を返す
+func scansHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeRequest(w, r) || !databaseReady(w) {
+		return
+	}
+
+	query := "SELECT id, sensor_id, COALESCE(sensor_scan_id, ''), started_at, device_count FROM scan_session"
+	var args []interface{}
+	if sensor := r.URL.Query().Get("sensor"); sensor != "" {
+		query += " WHERE sensor_id = ?"
+		args = append(args, sensor)
+	}
+	limit := 50
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("❌ スキャンセッション取得エラー: %v", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	sessions := []ScanSession{}
+	for rows.Next() {
+		var s ScanSession
+		if err := rows.Scan(&s.ID, &s.SensorID, &s.SensorScanID, &s.StartedAt, &s.DeviceCount); err != nil {
+			log.Printf("❌ スキャンセッション読み込みエラー: %v", err)
+			http.Error(w, "Database query failed", http.StatusInternalServerError)
+			return
+		}
+		sessions = append(sessions, s)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":    "success",
+		"count":     len(sessions),
+		"scans":     sessions,
+		"timestamp": time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
+
+// scanDiffHandler function: 2つのスキャンセッション間で出現・消失・変化した機器を返す
+// to を省略すると最新のスキャン、from を省略すると since 以降の最初のスキャン（since も省略時は to の直前のスキャン）を使用
+func scanDiffHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeRequest(w, r) || !databaseReady(w) {
+		return
+	}
+
+	q := r.URL.Query()
+	sensor := q.Get("sensor")
+
+	// 比較先（新しい方）のスキャン
+	var to ScanSession
+	var err error
+	if value := q.Get("to"); value != "" {
+		id, convErr := strconv.ParseInt(value, 10, 64)
+		if convErr != nil {
+			http.Error(w, "to must be a scan id", http.StatusBadRequest)
+			return
+		}
+		to, err = getScanSession(id)
+	} else if sensor != "" {
+		to, err = findScanSession("sensor_id = ?", "id DESC", sensor)
+	} else {
+		to, err = findScanSession("1 = 1", "id DESC")
+	}
+	if err == sql.ErrNoRows {
+		http.Error(w, "Scan session not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("❌ スキャンセッション取得エラー: %v", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+	if sensor == "" {
+		sensor = to.SensorID
+	}
+
+	// 比較元（古い方）のスキャン
+	var from ScanSession
+	if value := q.Get("from"); value != "" {
+		id, convErr := strconv.ParseInt(value, 10, 64)
+		if convErr != nil {
+			http.Error(w, "from must be a scan id", http.StatusBadRequest)
+			return
+		}
+		from, err = getScanSession(id)
+	} else if value := q.Get("since"); value != "" {
+		since, convErr := parseSinceParam(value)
+		if convErr != nil {
+			http.Error(w, "since must be RFC3339 or \"YYYY-MM-DD HH:MM\"", http.StatusBadRequest)
+			return
+		}
+		from, err = findScanSession("sensor_id = ? AND started_at >= ? AND id < ?", "id", sensor, since, to.ID)
+	} else {
+		from, err = findScanSession("sensor_id = ? AND id < ?", "id DESC", sensor, to.ID)
+	}
+	if err == sql.ErrNoRows {
+		http.Error(w, "No earlier scan session to compare", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("❌ スキャンセッション取得エラー: %v", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+
+	diff, err := diffScanSessions(from, to)
+	if err != nil {
+		log.Printf("❌ スキャン差分計算エラー: %v", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":    "success",
+		"diff":      diff,
+		"timestamp": time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
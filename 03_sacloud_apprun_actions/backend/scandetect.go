@@ -0,0 +1,174 @@
+package backend
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// 検知の種類
+const (
+	ScanVertical   = "vertical_scan"   // 1台の宛先の多数のポートへの接続（ポートスキャン）
+	ScanHorizontal = "horizontal_scan" // 多数の宛先の同じポートへの接続（横展開・スイープ）
+)
+
+// スキャン検知のデフォルト値
+const (
+	defaultScanWindowMinutes   = 5
+	defaultScanVerticalPorts   = 20
+	defaultScanHorizontalHosts = 10
+)
+
+// maxScanTargetsInReason: 理由に列挙する宛先（ポート・ホスト）の上限
+const maxScanTargetsInReason = 10
+
+// scanDetectConfig type: スキャン検知の閾値
+type scanDetectConfig struct {
+	Window          time.Duration // この期間の通信記録で判定する（スライディングウィンドウ）
+	VerticalPorts   int           // 1台の宛先に対する異なるポート数がこれ以上で縦スキャン
+	HorizontalHosts int           // 同じポートに対する異なる宛先数がこれ以上で横スキャン
+}
+
+// ScanDetection type: 送信元1台分のスキャン検知結果
+type ScanDetection struct {
+	MACAddress string   `json:"mac_address"`
+	Kind       string   `json:"kind"`
+	Target     string   `json:"target"`  // 縦スキャンは宛先IP、横スキャンは "TCP/445" などのポート
+	Targets    []string `json:"targets"` // 縦スキャンはポート、横スキャンは宛先IP
+	Count      int      `json:"count"`
+}
+
+// loadScanDetectConfig function: 環境変数 SCAN_WINDOW_MINUTES / SCAN_VERTICAL_PORTS / SCAN_HORIZONTAL_HOSTS から閾値を読み込む
+func loadScanDetectConfig() scanDetectConfig {
+	return scanDetectConfig{
+		Window:          time.Duration(envInt("SCAN_WINDOW_MINUTES", defaultScanWindowMinutes)) * time.Minute,
+		VerticalPorts:   envInt("SCAN_VERTICAL_PORTS", defaultScanVerticalPorts),
+		HorizontalHosts: envInt("SCAN_HORIZONTAL_HOSTS", defaultScanHorizontalHosts),
+	}
+}
+
+// detectScans function: 送信元の直近の通信記録から縦スキャン・横スキャンを検知
+// windowEnd は今回取り込んだ通信の最新の観測日時で、そこから Window 前までを対象にする
+func (c scanDetectConfig) detectScans(tx *sql.Tx, macAddress, windowEnd string) ([]ScanDetection, error) {
+	windowStart := parseTimestamp(windowEnd).Add(-c.Window).Format(timestampLayout)
+	var detections []ScanDetection
+
+	// 縦スキャン: 宛先ごとの異なるポート数
+	vertical, err := groupFlows(tx, `SELECT dst_ip, COUNT(DISTINCT dst_port), group_concat(DISTINCT dst_port)
+		FROM flow WHERE mac_address = ? AND observed_at > ? AND observed_at <= ? AND dst_port > 0
+		GROUP BY dst_ip HAVING COUNT(DISTINCT dst_port) >= ? ORDER BY dst_ip`,
+		macAddress, windowStart, windowEnd, c.VerticalPorts)
+	if err != nil {
+		return nil, fmt.Errorf("縦スキャン検知エラー (MAC: %s): %v", macAddress, err)
+	}
+	for _, g := range vertical {
+		detections = append(detections, ScanDetection{MACAddress: macAddress, Kind: ScanVertical, Target: g.key, Targets: g.values, Count: g.count})
+	}
+
+	// 横スキャン: プロトコル・ポートごとの異なる宛先数
+	horizontal, err := groupFlows(tx, `SELECT COALESCE(protocol, '') || '/' || dst_port, COUNT(DISTINCT dst_ip), group_concat(DISTINCT dst_ip)
+		FROM flow WHERE mac_address = ? AND observed_at > ? AND observed_at <= ? AND dst_port > 0
+		GROUP BY protocol, dst_port HAVING COUNT(DISTINCT dst_ip) >= ? ORDER BY protocol, dst_port`,
+		macAddress, windowStart, windowEnd, c.HorizontalHosts)
+	if err != nil {
+		return nil, fmt.Errorf("横スキャン検知エラー (MAC: %s): %v", macAddress, err)
+	}
+	for _, g := range horizontal {
+		detections = append(detections, ScanDetection{MACAddress: macAddress, Kind: ScanHorizontal, Target: g.key, Targets: g.values, Count: g.count})
+	}
+	return detections, nil
+}
+
+// flowGroup type: 検知クエリの1行（集計キー・異なる値の数・値の一覧）
+type flowGroup struct {
+	key    string
+	count  int
+	values []string
+}
+
+// groupFlows function: 検知クエリを実行して集計結果を返す
+func groupFlows(tx *sql.Tx, query string, args ...interface{}) ([]flowGroup, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []flowGroup
+	for rows.Next() {
+		var g flowGroup
+		var values string
+		if err := rows.Scan(&g.key, &g.count, &values); err != nil {
+			return nil, err
+		}
+		g.values = strings.Split(values, ",")
+		groups = append(groups, g)
+	}
+	return groups, rows.Err()
+}
+
+// scanHit function: スキャン検知結果から危険判定のヒットを作る（理由に宛先を列挙する）
+func (c scanDetectConfig) scanHit(d ScanDetection) dangerHit {
+	targets := d.Targets
+	more := ""
+	if len(targets) > maxScanTargetsInReason {
+		more = fmt.Sprintf(" 他%d件", len(targets)-maxScanTargetsInReason)
+		targets = targets[:maxScanTargetsInReason]
+	}
+	minutes := int(c.Window / time.Minute)
+
+	var reason string
+	if d.Kind == ScanVertical {
+		reason = fmt.Sprintf("ポートスキャンを検知しました: %s の %dポート (%s%s) に%d分以内に接続を試みました",
+			d.Target, d.Count, strings.Join(targets, ", "), more, minutes)
+	} else {
+		reason = fmt.Sprintf("横展開（スイープ）を検知しました: %s で %d台 (%s%s) に%d分以内に接続を試みました",
+			d.Target, d.Count, strings.Join(targets, ", "), more, minutes)
+	}
+	return dangerHit{
+		Source:   DangerSourceRule,
+		Severity: SeverityHigh,
+		Reason:   reason,
+		Evidence: []string{fmt.Sprintf("[%s] %s", d.Kind, reason)},
+	}
+}
+
+// raiseScans function: 機器の通信記録からスキャンを検知し、検知ルール由来の危険判定に反映する（反映した検知と反映後の状態を返す）
+// スキャン検知は1回の検知で危険とする（閾値はスキャン検知側で判定済み）。
+// 同じ機器・種類の前回の検知がウィンドウ内にある場合は同じスキャンとみなし、ヒットを重ねない
+func (c scanDetectConfig) raiseScans(tx *sql.Tx, policy dangerPolicy, macAddress, windowEnd, at string) ([]ScanDetection, string, error) {
+	found, err := c.detectScans(tx, macAddress, windowEnd)
+	if err != nil {
+		return nil, "", err
+	}
+	windowStart := parseTimestamp(windowEnd).Add(-c.Window).Format(timestampLayout)
+	rulePolicy := policy
+	rulePolicy.RaiseHits = 1
+	raised := []ScanDetection{}
+	state := ""
+	for _, d := range found {
+		var lastEnd string
+		err := tx.QueryRow("SELECT window_end FROM scan_detection WHERE mac_address = ? AND kind = ?", macAddress, d.Kind).Scan(&lastEnd)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, "", fmt.Errorf("前回のスキャン検知取得エラー (MAC: %s): %v", macAddress, err)
+		}
+		if err == nil && lastEnd > windowStart {
+			continue
+		}
+
+		log.Printf("  🚨 スキャン検知 [%s] %s → %s (%d)", d.Kind, macAddress, d.Target, d.Count)
+		if state, err = rulePolicy.applyHit(tx, macAddress, c.scanHit(d), at); err != nil {
+			return nil, "", fmt.Errorf("危険フラグ設定エラー (MAC: %s): %v", macAddress, err)
+		}
+		_, err = tx.Exec(`INSERT INTO scan_detection (mac_address, kind, window_end, detected_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT (mac_address, kind) DO UPDATE SET window_end = excluded.window_end, detected_at = excluded.detected_at`,
+			macAddress, d.Kind, windowEnd, at)
+		if err != nil {
+			return nil, "", fmt.Errorf("スキャン検知記録エラー (MAC: %s): %v", macAddress, err)
+		}
+		raised = append(raised, d)
+	}
+	return raised, state, nil
+}
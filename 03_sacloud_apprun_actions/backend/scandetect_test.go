@@ -0,0 +1,136 @@
+package backend
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+)
+
+const scanTestMAC = "aa:bb:cc:00:00:01"
+
+var scanTestConfig = scanDetectConfig{Window: 5 * time.Minute, VerticalPorts: 3, HorizontalHosts: 3}
+
+// verticalFlows function: 1台の宛先の ports 個のポートへの通信記録を作る
+func verticalFlows(ports int, at string) []Flow {
+	var flows []Flow
+	for i := 0; i < ports; i++ {
+		flows = append(flows, Flow{MACAddress: scanTestMAC, Prefix: "LAN_TCP_SYN", SrcIP: "192.168.1.10", DstIP: "192.168.1.20",
+			Protocol: "TCP", DstPort: 20 + i, ObservedAt: at, ReceivedAt: at})
+	}
+	return flows
+}
+
+// horizontalFlows function: hosts 台の宛先の同じポートへの通信記録を作る
+func horizontalFlows(hosts int, at string) []Flow {
+	var flows []Flow
+	for i := 0; i < hosts; i++ {
+		flows = append(flows, Flow{MACAddress: scanTestMAC, Prefix: "LAN_TCP_SYN", SrcIP: "192.168.1.10", DstIP: fmt.Sprintf("192.168.1.%d", 100+i),
+			Protocol: "TCP", DstPort: 445, ObservedAt: at, ReceivedAt: at})
+	}
+	return flows
+}
+
+// raiseTestScans function: 通信記録を保存してスキャン検知を行い、反映した検知を返す
+func raiseTestScans(t *testing.T, database *sql.DB, flows []Flow, at string) []ScanDetection {
+	t.Helper()
+	tx, err := database.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	latestByMAC, err := insertFlows(tx, flows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := dangerPolicy{Mode: DangerModeIncremental, TTL: time.Hour, RaiseHits: 3, RaiseWindow: 5 * time.Minute}
+	raised, _, err := scanTestConfig.raiseScans(tx, policy, scanTestMAC, latestByMAC[scanTestMAC], at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return raised
+}
+
+func TestDetectScansThresholds(t *testing.T) {
+	const at = "2026-10-18 10:00:00"
+	tests := []struct {
+		name  string
+		flows []Flow
+		want  []string // 検知の種類
+	}{
+		{name: "ports below the vertical threshold", flows: verticalFlows(2, at)},
+		{name: "port scan at the vertical threshold", flows: verticalFlows(3, at), want: []string{ScanVertical}},
+		{name: "hosts below the horizontal threshold", flows: horizontalFlows(2, at)},
+		{name: "lateral movement at the horizontal threshold", flows: horizontalFlows(3, at), want: []string{ScanHorizontal}},
+		{name: "flows outside the window are ignored", flows: append(verticalFlows(2, at), Flow{MACAddress: scanTestMAC, Prefix: "LAN_TCP_SYN",
+			SrcIP: "192.168.1.10", DstIP: "192.168.1.20", Protocol: "TCP", DstPort: 99, ObservedAt: "2026-10-18 09:55:00", ReceivedAt: at})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			database := openTestDatabase(t)
+			tx, err := database.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Rollback()
+			if _, err := insertFlows(tx, tt.flows); err != nil {
+				t.Fatal(err)
+			}
+			found, err := scanTestConfig.detectScans(tx, scanTestMAC, at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(found) != len(tt.want) {
+				t.Fatalf("detectScans = %+v, want kinds %v", found, tt.want)
+			}
+			for i, d := range found {
+				if d.Kind != tt.want[i] {
+					t.Errorf("detection %d kind = %q, want %q", i, d.Kind, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRaiseScansOncePerWindow(t *testing.T) {
+	database := openTestDatabase(t)
+	if _, err := database.Exec(`INSERT INTO device (mac_address, ip_address) VALUES (?, '192.168.1.10')`, scanTestMAC); err != nil {
+		t.Fatal(err)
+	}
+	hitCount := func() int {
+		t.Helper()
+		var count int
+		if err := database.QueryRow("SELECT hit_count FROM device_danger WHERE mac_address = ? AND source = ?",
+			scanTestMAC, DangerSourceRule).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+
+	steps := []struct {
+		at        string
+		flows     []Flow
+		wantRaise int
+		wantHits  int
+	}{
+		{at: "2026-10-18 10:00:00", flows: verticalFlows(3, "2026-10-18 10:00:00"), wantRaise: 1, wantHits: 1},
+		// 同じウィンドウ内の再送・追加の通信では重ねて検知しない
+		{at: "2026-10-18 10:01:00", flows: verticalFlows(1, "2026-10-18 10:01:00"), wantRaise: 0, wantHits: 1},
+		// 別の種類の検知は反映する
+		{at: "2026-10-18 10:02:00", flows: horizontalFlows(3, "2026-10-18 10:02:00"), wantRaise: 1, wantHits: 2},
+		// 前回の検知がウィンドウ外になったら、続いているスキャンを再度検知する
+		{at: "2026-10-18 10:06:00", flows: verticalFlows(3, "2026-10-18 10:06:00"), wantRaise: 1, wantHits: 3},
+	}
+	for i, s := range steps {
+		raised := raiseTestScans(t, database, s.flows, s.at)
+		if len(raised) != s.wantRaise {
+			t.Errorf("step %d: raised %+v, want %d detections", i, raised, s.wantRaise)
+		}
+		if got := hitCount(); got != s.wantHits {
+			t.Errorf("step %d: hit_count = %d, want %d", i, got, s.wantHits)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package backend
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// timestampLayout: DBに保存する日時の書式（UTC）。文字列比較で大小判定できる形式にしている
+const timestampLayout = "2006-01-02 15:04:05"
+
+// NewDeviceWindow: 「新規機器」とみなす初回検出からの期間
+const NewDeviceWindow = 24 * time.Hour
+
+// defaultStaleDays: 「長期未検出」とみなす日数のデフォルト値
+const defaultStaleDays = 7
+
+// DeviceRecord type: device テーブルの1行を表す
+type DeviceRecord struct {
+	MACAddress  string `json:"mac_address"`
+	IPAddress   string `json:"ip_address"`
+	Vendor      string `json:"vendor"`
+	Hostname    string `json:"hostname"`
+	IsDangerous bool   `json:"is_dangerous"`
+	IsUnknown   bool   `json:"is_unknown"`
+	// OUIから引いたベンダーと照合結果
+	OUIVendor      string `json:"oui_vendor"`
+	IsRandomized   bool   `json:"is_randomized"`
+	VendorMismatch bool   `json:"vendor_mismatch"`
+	FirstSeen      string `json:"first_seen"`
+	LastSeen       string `json:"last_seen"`
+	SeenCount      int    `json:"seen_count"`
+	// 現在のIPアドレス（ip_address は代表の1つ）
+	Addresses []DeviceAddress `json:"addresses"`
+	// 有効な危険判定（なぜ・いつから危険と判定されているか）
+	Dangers []DangerRecord `json:"dangers"`
+	// 注釈のタグ
+	Tags []string `json:"tags"`
+	// オペレーターによる手動判定（設定されている場合のみ）
+	Override *DeviceOverride `json:"override,omitempty"`
+}
+
+// nowTimestamp function: 現在時刻をDB保存用の文字列で返す
+func nowTimestamp() string {
+	return time.Now().UTC().Format(timestampLayout)
+}
+
+// cutoffTimestamp function: 現在時刻から d だけ前の時刻をDB保存用の文字列で返す
+func cutoffTimestamp(d time.Duration) string {
+	return time.Now().UTC().Add(-d).Format(timestampLayout)
+}
+
+// FormatTimestamp function: DBに保存された日時をローカル時刻の表示用文字列に変換
+func FormatTimestamp(value string) string {
+	if value == "" {
+		return "-"
+	}
+	t, err := time.Parse(timestampLayout, value)
+	if err != nil {
+		return value
+	}
+	return t.Local().Format(timestampLayout)
+}
+
+// StaleDays function: 長期未検出とみなす日数を環境変数 STALE_DAYS から取得
+func StaleDays() int {
+	return envInt("STALE_DAYS", defaultStaleDays)
+}
+
+// envInt function: 環境変数を正の整数として読み込む。未設定・不正値の場合はデフォルト値
+func envInt(name string, defaultValue int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Printf("警告: 環境変数 %s の値が不正です (%q)。デフォルト値 %d を使用します", name, value, defaultValue)
+		return defaultValue
+	}
+	return n
+}
+
+// IsNewDevice function: 初回検出が NewDeviceWindow 以内かどうか
+func IsNewDevice(firstSeen string) bool {
+	return firstSeen != "" && firstSeen >= cutoffTimestamp(NewDeviceWindow)
+}
+
+// IsStaleDevice function: 最終検出から StaleDays 日以上経過しているかどうか
+func IsStaleDevice(lastSeen string) bool {
+	return lastSeen != "" && lastSeen < cutoffTimestamp(time.Duration(StaleDays())*24*time.Hour)
+}
+
+// CountNewDevices function: 直近 NewDeviceWindow 以内に初めて検出された機器数
+func CountNewDevices() int {
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM device WHERE first_seen >= ?", cutoffTimestamp(NewDeviceWindow)).Scan(&count)
+	return count
+}
+
+// CountDevices function: 検出済みの機器数（ダッシュボードの「検出機器数」）
+func CountDevices() int {
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM device").Scan(&count)
+	return count
+}
+
+// CountDangerousDevices function: 危険と判定されている機器数（ダッシュボードの「危険機器数」）
+func CountDangerousDevices() int {
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM device WHERE is_dangerous = TRUE").Scan(&count)
+	return count
+}
+
+// CountStaleDevices function: StaleDays 日以上検出されていない機器数
+func CountStaleDevices() int {
+	var count int
+	cutoff := cutoffTimestamp(time.Duration(StaleDays()) * 24 * time.Hour)
+	db.QueryRow("SELECT COUNT(*) FROM device WHERE last_seen < ?", cutoff).Scan(&count)
+	return count
+}
+
+// queryDevices function: 条件に一致する機器一覧を取得
+func queryDevices(where string, args ...interface{}) ([]DeviceRecord, error) {
+	return queryDevicesOrdered(where, "last_seen DESC, mac_address", 0, args...)
+}
+
+// queryDevicesOrdered function: 条件に一致する機器一覧を order の順に取得（limit が 0 なら全件）
+func queryDevicesOrdered(where, order string, limit int, args ...interface{}) ([]DeviceRecord, error) {
+	query := `SELECT mac_address, COALESCE(ip_address, ''), COALESCE(vendor, ''), COALESCE(hostname, ''), COALESCE(is_dangerous, FALSE), COALESCE(is_unknown, FALSE),
+		COALESCE(oui_vendor, ''), COALESCE(is_randomized, FALSE), COALESCE(vendor_mismatch, FALSE),
+		COALESCE(first_seen, ''), COALESCE(last_seen, ''), COALESCE(seen_count, 0) FROM device`
+	if where != "" {
+		query += " WHERE " + where
+	}
+	query += " ORDER BY " + order
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("機器一覧取得エラー: %v", err)
+	}
+	defer rows.Close()
+
+	devices := []DeviceRecord{}
+	for rows.Next() {
+		var d DeviceRecord
+		if err := rows.Scan(&d.MACAddress, &d.IPAddress, &d.Vendor, &d.Hostname, &d.IsDangerous, &d.IsUnknown, &d.OUIVendor, &d.IsRandomized, &d.VendorMismatch, &d.FirstSeen, &d.LastSeen, &d.SeenCount); err != nil {
+			return nil, fmt.Errorf("機器一覧読み込みエラー: %v", err)
+		}
+		devices = append(devices, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	dangers, err := ActiveDangers()
+	if err != nil {
+		return nil, err
+	}
+	addresses, err := CurrentDeviceAddresses()
+	if err != nil {
+		return nil, err
+	}
+	tags, err := deviceTags()
+	if err != nil {
+		return nil, err
+	}
+	overrides, err := ActiveOverrides()
+	if err != nil {
+		return nil, err
+	}
+	for i := range devices {
+		if o, ok := overrides[devices[i].MACAddress]; ok {
+			devices[i].Override = &o
+		}
+		devices[i].Tags = tags[devices[i].MACAddress]
+		if devices[i].Tags == nil {
+			devices[i].Tags = []string{}
+		}
+		devices[i].Addresses = addresses[devices[i].MACAddress]
+		if devices[i].Addresses == nil {
+			devices[i].Addresses = []DeviceAddress{}
+		}
+		devices[i].Dangers = dangers[devices[i].MACAddress]
+		if devices[i].Dangers == nil {
+			devices[i].Dangers = []DangerRecord{}
+		}
+	}
+	return devices, nil
+}
+
+// recordObservation function: /upload で受信した機器の観測履歴を1件記録
+func recordObservation(tx *sql.Tx, session ScanSession, obs observation) error {
+	observedAt := obs.ObservedAt
+	if observedAt == "" {
+		observedAt = session.StartedAt
+	}
+	_, err := tx.Exec(`INSERT INTO device_observation (mac_address, ip_address, vendor, hostname, interface, observed_at, scan_id)
+		VALUES (?, ?, ?, NULLIF(?, ''), NULLIF(?, ''), ?, ?)`,
+		obs.MAC, obs.IP(), obs.Vendor, obs.Hostname, obs.Interface, observedAt, session.ID)
+	if err != nil {
+		return fmt.Errorf("観測履歴記録エラー (MAC: %s): %v", obs.MAC, err)
+	}
+	return nil
+}
+
+// newDevicesHandler function: 直近24時間以内に初めて検出された機器を返す
+func newDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeRequest(w, r) || !databaseReady(w) {
+		return
+	}
+
+	window := NewDeviceWindow
+	if hours := r.URL.Query().Get("hours"); hours != "" {
+		n, err := strconv.Atoi(hours)
+		if err != nil || n <= 0 {
+			http.Error(w, "hours must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		window = time.Duration(n) * time.Hour
+	}
+
+	devices, err := queryDevices("first_seen >= ?", cutoffTimestamp(window))
+	if err != nil {
+		log.Printf("❌ %v", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":       "success",
+		"window_hours": int(window / time.Hour),
+		"count":        len(devices),
+		"devices":      devices,
+		"timestamp":    time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
+
+// staleDevicesHandler function: N日以上検出されていない機器を返す
+func staleDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeRequest(w, r) || !databaseReady(w) {
+		return
+	}
+
+	days := StaleDays()
+	if value := r.URL.Query().Get("days"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, "days must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+
+	devices, err := queryDevices("last_seen < ?", cutoffTimestamp(time.Duration(days)*24*time.Hour))
+	if err != nil {
+		log.Printf("❌ %v", err)
+		http.Error(w, "Database query failed", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":    "success",
+		"days":      days,
+		"count":     len(devices),
+		"devices":   devices,
+		"timestamp": time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
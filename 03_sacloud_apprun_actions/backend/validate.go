@@ -0,0 +1,109 @@
+package backend
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// maxHostnameLength: ホスト名の最大長（DNS名の上限）
+const maxHostnameLength = 253
+
+// itemError type: /upload・/status で受け付けなかった機器（キーと理由）
+type itemError struct {
+	Key   string `json:"key"`
+	Error string `json:"error"`
+}
+
+// normalizeMAC function: MACアドレスを小文字・コロン区切りに揃える
+// "AA-BB-CC-DD-EE-FF"、Cisco 形式の "aabb.ccdd.eeff"、区切りなしの "AABBCCDDEEFF" を受け付け、
+// 空・OUIのみ・全ゼロ・ブロードキャスト・マルチキャストのアドレスは機器のMACアドレスとして受け付けない
+func normalizeMAC(value string) (string, error) {
+	if strings.TrimSpace(value) == "" {
+		return "", fmt.Errorf("mac is required")
+	}
+	mac, kind, err := parseKnownPattern(value)
+	if err != nil || kind != KnownKindMAC {
+		return "", fmt.Errorf("invalid MAC address: %q", value)
+	}
+	switch {
+	case mac == "00:00:00:00:00:00":
+		return "", fmt.Errorf("invalid MAC address (all zeros): %q", value)
+	case mac == "ff:ff:ff:ff:ff:ff":
+		return "", fmt.Errorf("invalid MAC address (broadcast): %q", value)
+	}
+	if first, _ := strconv.ParseUint(mac[:2], 16, 8); first&0x01 != 0 {
+		return "", fmt.Errorf("invalid MAC address (multicast): %q", value)
+	}
+	return mac, nil
+}
+
+// macFilter function: 検索条件の ?mac= を正規化する（MACアドレスとして解釈できなければ小文字にしてそのまま使う）
+func macFilter(value string) string {
+	if mac, err := normalizeMAC(value); err == nil {
+		return mac
+	}
+	return strings.ToLower(strings.TrimSpace(value))
+}
+
+// normalizeIP function: IPv4・IPv6 アドレスを検証して正規の表記に揃える（IPv4射影IPv6アドレスは IPv4 にする）
+func normalizeIP(value string) (string, error) {
+	addr, err := netip.ParseAddr(strings.TrimSpace(value))
+	if err != nil {
+		return "", fmt.Errorf("invalid IP address: %q", value)
+	}
+	addr = addr.Unmap()
+	if addr.IsUnspecified() {
+		return "", fmt.Errorf("invalid IP address (unspecified): %q", value)
+	}
+	return addr.String(), nil
+}
+
+// normalizeObservation function: 観測の observed_at・MACアドレス・IPアドレス・ホスト名を検証して正規化する
+func normalizeObservation(o *observation) error {
+	if o.ObservedAtError != "" {
+		return fmt.Errorf("%s", o.ObservedAtError)
+	}
+	mac, err := normalizeMAC(o.MAC)
+	if err != nil {
+		return err
+	}
+	o.MAC = mac
+
+	ips := make([]string, 0, len(o.IPs))
+	seen := map[string]bool{}
+	for _, value := range o.IPs {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		ip, err := normalizeIP(value)
+		if err != nil {
+			return err
+		}
+		if !seen[ip] {
+			seen[ip] = true
+			ips = append(ips, ip)
+		}
+	}
+	o.IPs = ips
+
+	if len(o.Hostname) > maxHostnameLength {
+		return fmt.Errorf("hostname is too long (max %d characters)", maxHostnameLength)
+	}
+	return nil
+}
+
+// validateObservations function: 観測を1件ずつ検証し、受け付けた観測と受け付けなかった機器の一覧を返す
+func validateObservations(observations []observation) ([]observation, []itemError) {
+	valid := make([]observation, 0, len(observations))
+	errors := []itemError{}
+	for _, o := range observations {
+		if err := normalizeObservation(&o); err != nil {
+			errors = append(errors, itemError{Key: o.Key, Error: err.Error()})
+			continue
+		}
+		valid = append(valid, o)
+	}
+	return valid, errors
+}
@@ -0,0 +1,74 @@
+package backend
+
+import "testing"
+
+func TestNormalizeMAC(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: "aa:bb:cc:00:00:03", want: "aa:bb:cc:00:00:03"},
+		{value: "AA:BB:CC:00:00:03", want: "aa:bb:cc:00:00:03"},
+		{value: "AA-BB-CC-00-00-03", want: "aa:bb:cc:00:00:03"},
+		{value: "aabb.cc00.0003", want: "aa:bb:cc:00:00:03"},
+		{value: "AABBCC000003", want: "aa:bb:cc:00:00:03"},
+		{value: "", wantErr: true},
+		{value: "zz:bb", wantErr: true},
+		{value: "aa:bb:cc", wantErr: true},
+		{value: "00:00:00:00:00:00", wantErr: true},
+		{value: "ff:ff:ff:ff:ff:ff", wantErr: true},
+		{value: "01:00:5e:00:00:01", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeMAC(tt.value)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("normalizeMAC(%q) = %q, want error", tt.value, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("normalizeMAC(%q) error: %v", tt.value, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("normalizeMAC(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeIP(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: "192.168.1.10", want: "192.168.1.10"},
+		{value: " 192.168.1.10 ", want: "192.168.1.10"},
+		{value: "::ffff:192.168.1.10", want: "192.168.1.10"},
+		{value: "FE80:0:0:0:0:0:0:1", want: "fe80::1"},
+		{value: "2001:db8::0001", want: "2001:db8::1"},
+		{value: "999.1.1.1", wantErr: true},
+		{value: "192.168.1", wantErr: true},
+		{value: "192.168.1.0/24", wantErr: true},
+		{value: "0.0.0.0", wantErr: true},
+		{value: "::", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeIP(tt.value)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("normalizeIP(%q) = %q, want error", tt.value, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("normalizeIP(%q) error: %v", tt.value, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("normalizeIP(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// requestTimeout: バックエンドへの1リクエストのタイムアウト
+const requestTimeout = 30 * time.Second
+
+// client type: バックエンドAPIのクライアント（送信できなかったリクエストは spool に保存して順に再送する）
+type client struct {
+	host     string
+	token    string
+	sensorID string
+	http     *http.Client
+
+	mu    sync.Mutex // spool の順序を保つため、送信は1件ずつ行う
+	spool *spool
+}
+
+// newClient function: 設定からクライアントを作成
+func newClient(cfg config) *client {
+	return &client{
+		host:     cfg.NetHost,
+		token:    cfg.NetToken,
+		sensorID: cfg.SensorID,
+		http:     &http.Client{Timeout: requestTimeout},
+		spool:    newSpool(cfg.spoolDir(), cfg.SpoolMaxBytes),
+	}
+}
+
+// postJSON function: body を JSON にして Idempotency-Key（空ならランダムに生成）とともに POST する
+// 一時的な失敗（接続できない・5xx など）の場合は spool に保存して nil を返し、後で順に再送する。
+// 再送待ちのリクエストがあれば、順序を保つため今回のリクエストもその後ろに並べる
+func (c *client) postJSON(ctx context.Context, path, key string, body interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("JSON変換エラー: %v", err)
+	}
+	if key == "" {
+		key = newIdempotencyKey()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pending, err := c.flushLocked(ctx)
+	if err != nil {
+		return err
+	}
+	if pending == 0 {
+		retryable, err := c.post(ctx, path, key, payload)
+		if err == nil || !retryable {
+			return err
+		}
+		log.Printf("⚠️ %v", err)
+		c.spool.backoff()
+	}
+
+	if err := c.spool.enqueue(path, key, payload); err != nil {
+		return fmt.Errorf("%s のリクエストを spool に保存できませんでした: %v", path, err)
+	}
+	log.Printf("[spool] %s のリクエストを保存しました。%s 以降に再送します", path, c.spool.nextRetry.Format(time.RFC3339))
+	return nil
+}
+
+// flushSpool function: spool のリクエストを古い順に再送する（バックオフ中は何もしない）
+func (c *client) flushSpool(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.flushLocked(ctx)
+	return err
+}
+
+// flushLocked function: spool のリクエストを古い順に再送し、残っている件数を返す
+// 一時的な失敗ならそこで止めてバックオフし、再送しても成功しない失敗（4xx）はそのリクエストを破棄して続ける
+func (c *client) flushLocked(ctx context.Context) (int, error) {
+	files, err := c.spool.files()
+	if err != nil || len(files) == 0 {
+		return 0, err
+	}
+	if c.spool.waiting() {
+		return len(files), nil
+	}
+
+	for i, f := range files {
+		name := filepath.Join(c.spool.dir, f.Name())
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return len(files) - i, fmt.Errorf("spool を読み込めません: %v", err)
+		}
+		var entry spoolEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			log.Printf("❌ [spool] 壊れたファイルを破棄しました (%s): %v", f.Name(), err)
+			os.Remove(name)
+			continue
+		}
+
+		retryable, err := c.post(ctx, entry.Path, entry.Key, entry.Body)
+		if err != nil && retryable {
+			c.spool.backoff()
+			log.Printf("⚠️ [spool] 再送に失敗しました（残り %d 件、次回 %s）: %v", len(files)-i, c.spool.nextRetry.Format(time.RFC3339), err)
+			return len(files) - i, nil
+		}
+		if err != nil {
+			log.Printf("❌ [spool] 再送しても受け付けられないため破棄しました (%s, %s 保存): %v", f.Name(), entry.QueuedAt, err)
+		} else {
+			log.Printf("[spool] %s に再送しました (%s 保存)", entry.Path, entry.QueuedAt)
+		}
+		if err := os.Remove(name); err != nil {
+			return len(files) - i, fmt.Errorf("spool のファイルを削除できません: %v", err)
+		}
+		c.spool.reset()
+	}
+	return 0, nil
+}
+
+// post function: JSON を POST し、2xx 以外はエラーにする（retryable は再送すれば成功しうるか）
+func (c *client) post(ctx context.Context, path, key string, payload []byte) (retryable bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.host+path, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("X-Sensor-ID", c.sensorID)
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("%s への送信に失敗しました: %v", path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		// 409 は同じ Idempotency-Key のリクエストが処理中（前回の送信の途中でバックエンドが再起動した場合など）。
+		// バックエンドは処理中の予約を一定時間で引き継ぐため、spool に残して再送する
+		retryable = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests ||
+			resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusConflict
+		return retryable, fmt.Errorf("%s への送信に失敗しました [HTTP %d] %s", path, resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return false, nil
+}
+
+// newIdempotencyKey function: ランダムな Idempotency-Key を生成
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
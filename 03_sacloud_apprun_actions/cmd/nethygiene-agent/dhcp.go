@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxLeaseFileSize: 送信するリースファイルの上限（サーバー側の上限と同じ）
+const maxLeaseFileSize = 16 << 20
+
+// leaseRequest type: /api/v1/dhcp/leases に送るリクエスト
+type leaseRequest struct {
+	Format  string `json:"format,omitempty"` // 省略時はサーバーが内容から判定
+	Content string `json:"content"`
+}
+
+// leaseFileState type: 前回送信したリースファイルの状態（変更がなければ送らない）
+type leaseFileState struct {
+	modTime time.Time
+	size    int64
+}
+
+var (
+	sentLeaseFilesMu sync.Mutex
+	sentLeaseFiles   = map[string]leaseFileState{}
+)
+
+// runDHCP function: DHCP_LEASES のリースファイル（dnsmasq / ISC dhcpd）を読み、変更があれば /api/v1/dhcp/leases に送信
+func runDHCP(ctx context.Context, cfg config, c *client) error {
+	sentLeaseFilesMu.Lock()
+	defer sentLeaseFilesMu.Unlock()
+
+	var failed []string
+	for _, path := range cfg.DHCPLeaseFiles {
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Printf("❌ [dhcp] %s を読み込めません: %v", path, err)
+			failed = append(failed, path)
+			continue
+		}
+		state := leaseFileState{modTime: info.ModTime(), size: info.Size()}
+		if sentLeaseFiles[path] == state {
+			continue
+		}
+		if info.Size() > maxLeaseFileSize {
+			log.Printf("❌ [dhcp] %s が大きすぎます (%d バイト)", path, info.Size())
+			failed = append(failed, path)
+			continue
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("❌ [dhcp] %s を読み込めません: %v", path, err)
+			failed = append(failed, path)
+			continue
+		}
+		if err := c.postJSON(ctx, "/api/v1/dhcp/leases", "", leaseRequest{Format: cfg.DHCPLeaseFormat, Content: string(content)}); err != nil {
+			log.Printf("❌ [dhcp] %v", err)
+			failed = append(failed, path)
+			continue
+		}
+		sentLeaseFiles[path] = state
+		log.Printf("[dhcp] Sent %s to %s/api/v1/dhcp/leases", path, cfg.NetHost)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d file(s) failed: %v", len(failed), failed)
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// fileInode function: inode のない環境では 0（ローテーションはサイズの縮小でのみ検出する）
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
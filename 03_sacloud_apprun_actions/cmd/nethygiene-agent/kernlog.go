@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ippanpeople/sample-go/backend"
+)
+
+// statusPrefixes: /status に送る netfilter のログのタグ
+var statusPrefixes = []string{"[LAN_TCP_SYN]", "[LAN_UDP]"}
+
+// maxStatusBatch: 1リクエストで /status に送るログ行数の上限
+const maxStatusBatch = 500
+
+// runStatus function: kern.log の前回の送信位置以降から不審な通信のログを取り出して /status に送信
+// 送信に成功した（または spool に保存した）分だけチェックポイントを進めるため、同じ行を取りこぼさない。
+// Idempotency-Key はログの位置と内容から決めるため、チェックポイントの保存前に停止して同じ行を再送しても二重に数えられない
+func runStatus(ctx context.Context, cfg config, c *client) error {
+	follower := newLogFollower(cfg.KernLogPath, cfg.kernLogStatePath(), cfg.TailLines)
+	lines, err := follower.readNew()
+	if err != nil {
+		return err
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+
+	sent := 0
+	var batch []string
+	first := lines[0]
+	for i, line := range lines {
+		if batch == nil {
+			first = line
+		}
+		if hasStatusPrefix(line.Text) {
+			batch = append(batch, line.Text)
+		}
+		if len(batch) < maxStatusBatch && i < len(lines)-1 {
+			continue
+		}
+
+		payload := buildStatus(cfg, batch)
+		if len(payload.Observations) > 0 {
+			if err := c.postJSON(ctx, "/status", statusIdempotencyKey(first, batch), payload); err != nil {
+				return err
+			}
+			sent += len(payload.Observations)
+		}
+		if err := follower.saveCheckpoint(line); err != nil {
+			return err
+		}
+		batch = nil
+	}
+
+	if sent == 0 {
+		log.Printf("[status] No target lines in %s (%d new line(s))", cfg.KernLogPath, len(lines))
+		return nil
+	}
+	log.Printf("[status] Sent %d line(s) to %s/status", sent, cfg.NetHost)
+	return nil
+}
+
+// statusIdempotencyKey function: ログの位置（inode・先頭の行の位置）と送る行から決まる Idempotency-Key
+func statusIdempotencyKey(first logLine, batch []string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d:%d\n", first.Inode, first.Start)
+	for _, line := range batch {
+		fmt.Fprintln(h, line)
+	}
+	return "kernlog-" + hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+// buildStatus function: ログ行から /status の v2 形式のリクエストを作る（元のログ行を証跡として添付）
+func buildStatus(cfg config, lines []string) backend.PayloadV2 {
+	payload := backend.PayloadV2{Version: backend.PayloadVersion2, SensorID: cfg.SensorID, Observations: []backend.Observation{}}
+	for _, line := range lines {
+		// kern.log の日時はセンサーのタイムゾーンで書かれるため、ここで UTC にそろえて observed_at として送る
+		flow, err := backend.ParseNetfilterLine(line, "", time.Local)
+		if err != nil {
+			log.Printf("[status] 解析できないログ行を読み飛ばしました: %v", err)
+			continue
+		}
+		payload.Observations = append(payload.Observations, backend.Observation{
+			MAC:        flow.MACAddress,
+			IPs:        []string{flow.SrcIP},
+			Interface:  flow.InIface,
+			ObservedAt: flow.ObservedAt,
+			Log:        line,
+		})
+	}
+	return payload
+}
+
+// hasStatusPrefix function: /status に送る対象のタグを含むか
+func hasStatusPrefix(line string) bool {
+	for _, prefix := range statusPrefixes {
+		if strings.Contains(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
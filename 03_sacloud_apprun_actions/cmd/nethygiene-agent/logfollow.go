@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// tailChunkSize: ファイル末尾から読み込む単位
+const tailChunkSize = 64 * 1024
+
+// maxFollowBytes: 1回の実行で1ファイルから読み込む上限（残りは次回に読む）
+const maxFollowBytes = 4 * 1024 * 1024
+
+// logCheckpoint type: ログファイルの送信済み位置（チェックポイントファイルに JSON で保存）
+type logCheckpoint struct {
+	Path      string `json:"path"`
+	Inode     uint64 `json:"inode"`
+	Offset    int64  `json:"offset"` // この位置（行の先頭）より前は送信済み
+	LineStart int64  `json:"line_start"`
+	LineCRC   uint32 `json:"line_crc"` // 最後に送信した行（LineStart〜Offset）の CRC32。切り詰め後の書き直しの検出に使う
+	UpdatedAt string `json:"updated_at"`
+}
+
+// logLine type: 読み込んだ1行と、その行まで処理した場合のチェックポイント
+type logLine struct {
+	Text  string
+	Inode uint64
+	Start int64
+	End   int64 // 次の行の先頭の位置
+	CRC   uint32
+}
+
+// logFollower type: ログファイルを inode とオフセットで追跡する（logrotate・切り詰めに対応）
+type logFollower struct {
+	path         string
+	statePath    string
+	initialLines int // チェックポイントがない初回に末尾から読む行数
+}
+
+// newLogFollower function: ログファイルとチェックポイントファイルのパスからフォロワーを作成
+func newLogFollower(path, statePath string, initialLines int) *logFollower {
+	return &logFollower{path: path, statePath: statePath, initialLines: initialLines}
+}
+
+// readNew function: 前回のチェックポイント以降に追記された完全な行を返す
+// ローテーションされていれば、ローテーション後のファイル（path.1）の残りを先に返してから新しいファイルを先頭から読む。
+// 書き込み途中の最後の行（改行で終わっていない行）は次回に読む
+func (f *logFollower) readNew() ([]logLine, error) {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("%s を開けません: %v", f.path, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	inode := fileInode(info)
+
+	cp, found, err := f.loadCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		// 初回はスクリプトと同じく末尾 TAIL_LINES 行から読み始める
+		start, err := tailOffset(file, info.Size(), f.initialLines)
+		if err != nil {
+			return nil, fmt.Errorf("%s の読み込みに失敗しました: %v", f.path, err)
+		}
+		log.Printf("[status] チェックポイントがないため %s の末尾 %d 行から読み始めます", f.path, f.initialLines)
+		return readLines(file, inode, start, info.Size())
+	}
+
+	if cp.Inode == inode || cp.Inode == 0 || inode == 0 {
+		if info.Size() < cp.Offset || !sameLine(file, cp) {
+			// copytruncate などで切り詰められた（同じ長さ以上に書き直された場合も含む）: 先頭から読み直す
+			log.Printf("[status] %s が切り詰められました (%d → %d バイト)。先頭から読み直します", f.path, cp.Offset, info.Size())
+			cp.Offset = 0
+		}
+		return readLines(file, inode, cp.Offset, info.Size())
+	}
+
+	// ローテーションされた: 前回のファイルの未送信分を先に読む
+	var lines []logLine
+	rotatedPath := f.path + ".1"
+	if rotated, err := os.Open(rotatedPath); err == nil {
+		defer rotated.Close()
+		if rotatedInfo, err := rotated.Stat(); err == nil && fileInode(rotatedInfo) == cp.Inode {
+			lines, err = readLines(rotated, cp.Inode, cp.Offset, rotatedInfo.Size())
+			if err != nil {
+				return nil, fmt.Errorf("%s の読み込みに失敗しました: %v", rotatedPath, err)
+			}
+			if rotatedInfo.Size()-cp.Offset > maxFollowBytes {
+				// 前回のファイルを今回読み切れなければ、新しいファイルは次回に読む
+				return lines, nil
+			}
+		} else {
+			log.Printf("⚠️ [status] %s がローテーションされましたが、前回のファイルが見つかりません。未送信の行が失われた可能性があります", f.path)
+		}
+	} else {
+		log.Printf("⚠️ [status] %s がローテーションされましたが、%s を開けません: %v", f.path, rotatedPath, err)
+	}
+
+	current, err := readLines(file, inode, 0, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	return append(lines, current...), nil
+}
+
+// readLines function: start から size までの完全な行を読み込む（1回あたり maxFollowBytes まで）
+func readLines(file *os.File, inode uint64, start, size int64) ([]logLine, error) {
+	if size-start > maxFollowBytes {
+		size = start + maxFollowBytes
+	}
+	if size <= start {
+		return nil, nil
+	}
+	data := make([]byte, size-start)
+	if _, err := file.ReadAt(data, start); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	var lines []logLine
+	offset := start
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		lines = append(lines, logLine{
+			Text:  string(bytes.TrimRight(data[:i], "\r")),
+			Inode: inode,
+			Start: offset,
+			End:   offset + int64(i+1),
+			CRC:   crc32.ChecksumIEEE(data[:i+1]),
+		})
+		offset += int64(i + 1)
+		data = data[i+1:]
+	}
+	if len(lines) == 0 && size-start >= maxFollowBytes {
+		return nil, fmt.Errorf("%d バイトを超える行があります (offset: %d)", maxFollowBytes, start)
+	}
+	return lines, nil
+}
+
+// sameLine function: チェックポイントの最後の行が現在のファイルの同じ位置にあるか
+func sameLine(file *os.File, cp logCheckpoint) bool {
+	if cp.Offset <= cp.LineStart {
+		return true
+	}
+	data := make([]byte, cp.Offset-cp.LineStart)
+	if _, err := file.ReadAt(data, cp.LineStart); err != nil {
+		return false
+	}
+	return crc32.ChecksumIEEE(data) == cp.LineCRC
+}
+
+// tailOffset function: ファイルの末尾 n 行が始まる位置を返す（tail -n と同じ範囲）
+func tailOffset(file *os.File, size int64, n int) (int64, error) {
+	// 末尾の改行は数えない（最後の行の終わり）
+	end := size
+	if end > 0 {
+		last := make([]byte, 1)
+		if _, err := file.ReadAt(last, end-1); err != nil && err != io.EOF {
+			return 0, err
+		}
+		if last[0] == '\n' {
+			end--
+		}
+	}
+
+	offset := end
+	for offset > 0 {
+		chunkSize := int64(tailChunkSize)
+		if offset < chunkSize {
+			chunkSize = offset
+		}
+		chunk := make([]byte, chunkSize)
+		if _, err := file.ReadAt(chunk, offset-chunkSize); err != nil && err != io.EOF {
+			return 0, err
+		}
+		for i := len(chunk) - 1; i >= 0; i-- {
+			if chunk[i] != '\n' {
+				continue
+			}
+			if n--; n == 0 {
+				return offset - chunkSize + int64(i) + 1, nil
+			}
+		}
+		offset -= chunkSize
+	}
+	return 0, nil
+}
+
+// loadCheckpoint function: チェックポイントファイルを読み込む（ファイルがなければ found = false）
+func (f *logFollower) loadCheckpoint() (logCheckpoint, bool, error) {
+	var cp logCheckpoint
+	data, err := os.ReadFile(f.statePath)
+	if os.IsNotExist(err) {
+		return cp, false, nil
+	} else if err != nil {
+		return cp, false, fmt.Errorf("チェックポイントを読み込めません: %v", err)
+	}
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return cp, false, fmt.Errorf("チェックポイントが不正です (%s): %v", f.statePath, err)
+	}
+	if cp.Path != f.path {
+		// KERN_LOG を変更した場合は初回と同じ扱い
+		log.Printf("[status] 監視するファイルが変わりました (%s → %s)", cp.Path, f.path)
+		return cp, false, nil
+	}
+	return cp, true, nil
+}
+
+// saveCheckpoint function: line まで送信済みとしてチェックポイントを保存（一時ファイル経由で置き換える）
+func (f *logFollower) saveCheckpoint(line logLine) error {
+	data, err := json.MarshalIndent(logCheckpoint{
+		Path:      f.path,
+		Inode:     line.Inode,
+		Offset:    line.End,
+		LineStart: line.Start,
+		LineCRC:   line.CRC,
+		UpdatedAt: time.Now().UTC().Format(time.RFC3339),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(f.statePath), 0o755); err != nil {
+		return fmt.Errorf("チェックポイントを保存できません: %v", err)
+	}
+	tmp := f.statePath + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("チェックポイントを保存できません: %v", err)
+	}
+	if err := os.Rename(tmp, f.statePath); err != nil {
+		return fmt.Errorf("チェックポイントを保存できません: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLogFollowerReadNew(t *testing.T) {
+	// 各ステップでファイルを操作してから readNew し、返った行を送信済みとしてチェックポイントを保存する
+	type step struct {
+		name   string
+		change func(t *testing.T, path string)
+		want   []string
+	}
+	tests := []struct {
+		name      string
+		needInode bool // ローテーションの検出に inode を使う
+		steps     []step
+	}{
+		{
+			name: "first run reads the last lines, then only appended lines",
+			steps: []step{
+				{name: "initial", change: writeLog("a\nb\nc\nd\n"), want: []string{"c", "d"}},
+				{name: "no change", want: nil},
+				{name: "append", change: appendLog("e\nf\n"), want: []string{"e", "f"}},
+			},
+		},
+		{
+			name: "partial last line is read once completed",
+			steps: []step{
+				{name: "initial", change: writeLog("a\nb\n"), want: []string{"a", "b"}},
+				{name: "partial", change: appendLog("par"), want: nil},
+				{name: "completed", change: appendLog("tial\n"), want: []string{"partial"}},
+			},
+		},
+		{
+			name:      "rotation reads the rest of the rotated file first",
+			needInode: true,
+			steps: []step{
+				{name: "initial", change: writeLog("a\nb\n"), want: []string{"a", "b"}},
+				{name: "rotate", change: func(t *testing.T, path string) {
+					appendLog("c\n")(t, path)
+					if err := os.Rename(path, path+".1"); err != nil {
+						t.Fatal(err)
+					}
+					writeLog("d\ne\n")(t, path)
+				}, want: []string{"c", "d", "e"}},
+				{name: "append after rotation", change: appendLog("f\n"), want: []string{"f"}},
+			},
+		},
+		{
+			name:      "rotation without the rotated file reads the new file",
+			needInode: true,
+			steps: []step{
+				{name: "initial", change: writeLog("a\nb\n"), want: []string{"a", "b"}},
+				{name: "rotate", change: func(t *testing.T, path string) {
+					if err := os.Remove(path); err != nil {
+						t.Fatal(err)
+					}
+					writeLog("c\n")(t, path)
+				}, want: []string{"c"}},
+			},
+		},
+		{
+			name: "truncated file is read from the beginning",
+			steps: []step{
+				{name: "initial", change: writeLog("aaaa\nbbbb\n"), want: []string{"aaaa", "bbbb"}},
+				{name: "copytruncate", change: truncateLog("x\n"), want: []string{"x"}},
+			},
+		},
+		{
+			name: "file rewritten to the same length or longer is read from the beginning",
+			steps: []step{
+				{name: "initial", change: writeLog("aaaa\nbbbb\n"), want: []string{"aaaa", "bbbb"}},
+				{name: "rewrite", change: truncateLog("cccc\ndddd\ne\n"), want: []string{"cccc", "dddd", "e"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.needInode && !inodeSupported(t, dir) {
+				t.Skip("inode を取得できない環境ではローテーションを検出できません")
+			}
+			path := filepath.Join(dir, "kern.log")
+			follower := newLogFollower(path, filepath.Join(dir, "state", "kernlog.json"), 2)
+			for _, s := range tt.steps {
+				if s.change != nil {
+					s.change(t, path)
+				}
+				lines, err := follower.readNew()
+				if err != nil {
+					t.Fatalf("%s: readNew error: %v", s.name, err)
+				}
+				var got []string
+				for _, line := range lines {
+					got = append(got, line.Text)
+				}
+				if !reflect.DeepEqual(got, s.want) {
+					t.Fatalf("%s: readNew = %q, want %q", s.name, got, s.want)
+				}
+				if len(lines) > 0 {
+					if err := follower.saveCheckpoint(lines[len(lines)-1]); err != nil {
+						t.Fatalf("%s: saveCheckpoint error: %v", s.name, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// inodeSupported function: この環境で fileInode が inode を返すか
+func inodeSupported(t *testing.T, dir string) bool {
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fileInode(info) != 0
+}
+
+// writeLog function: ログファイルを新しく作成する
+func writeLog(content string) func(*testing.T, string) {
+	return func(t *testing.T, path string) {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// appendLog function: ログファイルに追記する
+func appendLog(content string) func(*testing.T, string) {
+	return func(t *testing.T, path string) {
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		if _, err := file.WriteString(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// truncateLog function: 同じ inode のまま切り詰めて書き直す（logrotate の copytruncate）
+func truncateLog(content string) func(*testing.T, string) {
+	return func(t *testing.T, path string) {
+		file, err := os.OpenFile(path, os.O_TRUNC|os.O_WRONLY, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		if _, err := file.WriteString(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
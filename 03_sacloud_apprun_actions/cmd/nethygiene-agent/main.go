@@ -0,0 +1,264 @@
+// nethygiene-agent: LAN内の機器検出（arp-scan → /upload）と kern.log の監視（→ /status）を
+// 定期的に実行するセンサーエージェント。以前の bash スクリプト（scan_and_post.sh / lan_scan_post.sh）を置き換える。
+//
+// 設定はスクリプトと同じ .env のキーを読み込む:
+//
+//	NET_HOST    バックエンドのURL（例: https://example.apprun.sakura.ne.jp）
+//	NET_TOKEN   Bearer トークン
+//	IFACE       arp-scan を実行するインターフェース
+//	TAIL_LINES  初回（チェックポイントがない場合）に kern.log の末尾から読む行数（デフォルト 10）
+//
+// 追加の任意設定: SENSOR_ID, KERN_LOG, STATE_DIR, SPOOL_MAX_MB, SCAN_INTERVAL_SECONDS, STATUS_INTERVAL_SECONDS
+//
+// DHCP_LEASES（カンマ区切りのリースファイルのパス）を設定すると、dnsmasq / ISC dhcpd のリースファイルを
+// DHCP_INTERVAL_SECONDS ごとに確認し、変更があれば送信してホスト名を機器に付ける（形式は DHCP_LEASE_FORMAT で指定可）
+//
+// kern.log は STATE_DIR（デフォルトは実行ファイルと同じディレクトリ）のチェックポイントに
+// inode と送信済みの位置を記録して追跡するため、logrotate や切り詰めがあっても各行を1回だけ送信する。
+// バックエンドに接続できない間のリクエストは STATE_DIR/spool に保存し（上限 SPOOL_MAX_MB）、
+// 接続できるようになってから保存した順に再送する。
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// デフォルト値
+const (
+	defaultTailLines             = 10
+	defaultKernLogPath           = "/var/log/kern.log"
+	kernLogStateFile             = "kernlog.checkpoint.json"
+	spoolDirName                 = "spool"
+	defaultSpoolMaxMB            = 50
+	spoolFlushInterval           = 10 * time.Second
+	defaultScanIntervalSeconds   = 300
+	defaultStatusIntervalSeconds = 60
+	defaultDHCPIntervalSeconds   = 300
+)
+
+// config type: エージェントの設定
+type config struct {
+	NetHost        string
+	NetToken       string
+	Iface          string
+	TailLines      int
+	KernLogPath    string
+	SensorID       string
+	StateDir       string
+	SpoolMaxBytes  int64
+	ScanInterval   time.Duration
+	StatusInterval time.Duration
+	// DHCPリースファイル（空なら dhcp ジョブは実行しない）
+	DHCPLeaseFiles  []string
+	DHCPLeaseFormat string
+	DHCPInterval    time.Duration
+}
+
+// job type: 定期実行するジョブ
+type job struct {
+	name     string
+	interval time.Duration
+	run      func(ctx context.Context) error
+}
+
+func main() {
+	envPath := flag.String("env", defaultEnvPath(), ".env ファイルのパス")
+	once := flag.Bool("once", false, "各ジョブを1回だけ実行して終了する")
+	only := flag.String("job", "all", "実行するジョブ (all | scan | status | dhcp)")
+	flag.Parse()
+
+	if err := loadEnvFile(*envPath); err != nil {
+		log.Fatal(err)
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	c := newClient(cfg)
+	// spool の再送はどのジョブを選んでも行う（バックオフ中は何もしない）
+	jobs := []job{{"spool", spoolFlushInterval, c.flushSpool}}
+	if *only == "all" || *only == "scan" {
+		jobs = append(jobs, job{"scan", cfg.ScanInterval, func(ctx context.Context) error { return runScan(ctx, cfg, c) }})
+	}
+	if *only == "all" || *only == "status" {
+		jobs = append(jobs, job{"status", cfg.StatusInterval, func(ctx context.Context) error { return runStatus(ctx, cfg, c) }})
+	}
+	if (*only == "all" && len(cfg.DHCPLeaseFiles) > 0) || *only == "dhcp" {
+		if len(cfg.DHCPLeaseFiles) == 0 {
+			log.Fatalf("DHCP_LEASES が設定されていません")
+		}
+		jobs = append(jobs, job{"dhcp", cfg.DHCPInterval, func(ctx context.Context) error { return runDHCP(ctx, cfg, c) }})
+	}
+	if len(jobs) == 1 {
+		log.Fatalf("unknown job %q (all | scan | status | dhcp)", *only)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *once {
+		failed := false
+		for _, j := range jobs {
+			if err := j.run(ctx); err != nil {
+				log.Printf("❌ [%s] %v", j.name, err)
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+		return
+	}
+
+	log.Printf("nethygiene-agent started (host: %s, sensor: %s)", cfg.NetHost, cfg.SensorID)
+	done := make(chan struct{})
+	for _, j := range jobs {
+		go func(j job) {
+			schedule(ctx, j)
+			done <- struct{}{}
+		}(j)
+	}
+	for range jobs {
+		<-done
+	}
+	log.Printf("nethygiene-agent stopped")
+}
+
+// schedule function: ジョブを起動直後と interval ごとに実行（前回の実行が終わるまで次は始めない）
+func schedule(ctx context.Context, j job) {
+	log.Printf("[%s] every %v", j.name, j.interval)
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+	for {
+		if err := j.run(ctx); err != nil {
+			log.Printf("❌ [%s] %v", j.name, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// defaultEnvPath function: 実行ファイルと同じディレクトリの .env（スクリプトと同じ配置）
+func defaultEnvPath() string {
+	return filepath.Join(executableDir(), ".env")
+}
+
+// executableDir function: 実行ファイルのディレクトリ（取得できなければカレントディレクトリ）
+func executableDir() string {
+	exe, err := os.Executable()
+	if err != nil {
+		return "."
+	}
+	return filepath.Dir(exe)
+}
+
+// loadEnvFile function: KEY=VALUE 形式の .env を環境変数に読み込む
+// スクリプトの `set -a; source .env` と同じく .env の値を優先する。ファイルがなければ環境変数のみを使う
+func loadEnvFile(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		log.Printf("警告: %s が見つかりません。環境変数のみを使用します", path)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf(".env を開けません: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: KEY=VALUE の形式ではありません", path, lineNo)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		os.Setenv(key, value)
+	}
+	return scanner.Err()
+}
+
+// loadConfig function: 環境変数から設定を読み込む
+func loadConfig() (config, error) {
+	cfg := config{
+		NetHost:         strings.TrimRight(os.Getenv("NET_HOST"), "/"),
+		NetToken:        os.Getenv("NET_TOKEN"),
+		Iface:           os.Getenv("IFACE"),
+		TailLines:       envInt("TAIL_LINES", defaultTailLines),
+		KernLogPath:     os.Getenv("KERN_LOG"),
+		SensorID:        os.Getenv("SENSOR_ID"),
+		StateDir:        os.Getenv("STATE_DIR"),
+		SpoolMaxBytes:   int64(envInt("SPOOL_MAX_MB", defaultSpoolMaxMB)) * 1024 * 1024,
+		ScanInterval:    time.Duration(envInt("SCAN_INTERVAL_SECONDS", defaultScanIntervalSeconds)) * time.Second,
+		StatusInterval:  time.Duration(envInt("STATUS_INTERVAL_SECONDS", defaultStatusIntervalSeconds)) * time.Second,
+		DHCPLeaseFormat: os.Getenv("DHCP_LEASE_FORMAT"),
+		DHCPInterval:    time.Duration(envInt("DHCP_INTERVAL_SECONDS", defaultDHCPIntervalSeconds)) * time.Second,
+	}
+	for _, path := range strings.Split(os.Getenv("DHCP_LEASES"), ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			cfg.DHCPLeaseFiles = append(cfg.DHCPLeaseFiles, path)
+		}
+	}
+	if cfg.NetHost == "" {
+		return cfg, fmt.Errorf("NET_HOST が設定されていません")
+	}
+	if cfg.NetToken == "" {
+		return cfg, fmt.Errorf("NET_TOKEN が設定されていません")
+	}
+	if cfg.KernLogPath == "" {
+		cfg.KernLogPath = defaultKernLogPath
+	}
+	if cfg.SensorID == "" {
+		cfg.SensorID, _ = os.Hostname()
+	}
+	if cfg.StateDir == "" {
+		cfg.StateDir = executableDir()
+	}
+	return cfg, nil
+}
+
+// kernLogStatePath function: kern.log のチェックポイントファイルのパス
+func (cfg config) kernLogStatePath() string {
+	return filepath.Join(cfg.StateDir, kernLogStateFile)
+}
+
+// spoolDir function: 送信できなかったリクエストを保存するディレクトリ
+func (cfg config) spoolDir() string {
+	return filepath.Join(cfg.StateDir, spoolDirName)
+}
+
+// envInt function: 正の整数の環境変数を読み込む（未設定・不正な場合はデフォルト値）
+func envInt(name string, defaultValue int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Printf("警告: %s の値が不正です (%q)。デフォルト値 %d を使用します", name, value, defaultValue)
+		return defaultValue
+	}
+	return n
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ippanpeople/sample-go/backend"
+)
+
+// arpScanLinePattern: arp-scan の結果行（"192.168.1.10   aa:bb:cc:dd:ee:ff   Vendor Name"）
+var arpScanLinePattern = regexp.MustCompile(`^(\d{1,3}(?:\.\d{1,3}){3})\s+([0-9A-Fa-f]{2}(?::[0-9A-Fa-f]{2}){5})\s*(.*)$`)
+
+// runScan function: arp-scan で LAN 内の機器を検出して /upload に送信
+func runScan(ctx context.Context, cfg config, c *client) error {
+	if cfg.Iface == "" {
+		return fmt.Errorf("IFACE が設定されていません")
+	}
+	output, err := exec.CommandContext(ctx, "arp-scan", "-I", cfg.Iface, "--localnet").Output()
+	if err != nil && len(output) == 0 {
+		return fmt.Errorf("arp-scan の実行に失敗しました: %v", err)
+	}
+
+	payload := parseArpScan(output, cfg, time.Now())
+	if len(payload.Observations) == 0 {
+		return fmt.Errorf("No devices found")
+	}
+	if err := c.postJSON(ctx, "/upload", "", payload); err != nil {
+		return err
+	}
+	log.Printf("[scan] Sent %d device(s) to %s/upload (scan: %s)", len(payload.Observations), cfg.NetHost, payload.ScanID)
+	return nil
+}
+
+// parseArpScan function: arp-scan の出力を /upload の v2 形式のリクエストに変換
+func parseArpScan(output []byte, cfg config, scannedAt time.Time) backend.PayloadV2 {
+	payload := backend.PayloadV2{
+		Version:      backend.PayloadVersion2,
+		SensorID:     cfg.SensorID,
+		ScanID:       fmt.Sprintf("%s-%s", cfg.SensorID, scannedAt.UTC().Format("20060102T150405Z")),
+		Observations: []backend.Observation{},
+	}
+	seen := map[string]int{}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		m := arpScanLinePattern.FindStringSubmatch(strings.TrimRight(scanner.Text(), "\r"))
+		if m == nil {
+			continue
+		}
+		// 複数のIPアドレスで応答した機器は1つの観測にまとめる
+		mac := strings.ToLower(m[2])
+		if i, ok := seen[mac]; ok {
+			payload.Observations[i].IPs = append(payload.Observations[i].IPs, m[1])
+			continue
+		}
+		seen[mac] = len(payload.Observations)
+		payload.Observations = append(payload.Observations, backend.Observation{
+			MAC:        mac,
+			IPs:        []string{m[1]},
+			Vendor:     strings.TrimSpace(m[3]),
+			Interface:  cfg.Iface,
+			ObservedAt: scannedAt.UTC().Format(time.RFC3339),
+		})
+	}
+	return payload
+}
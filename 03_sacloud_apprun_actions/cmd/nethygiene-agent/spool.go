@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 再送の間隔（失敗するたびに2倍にする）
+const (
+	retryInitialInterval = 10 * time.Second
+	retryMaxInterval     = 10 * time.Minute
+)
+
+// spoolSeq: 同じ時刻に保存したファイルの順序を保つための連番
+var spoolSeq atomic.Uint64
+
+// spoolEntry type: 送信できなかったリクエスト（spool ディレクトリに1件1ファイルで保存）
+type spoolEntry struct {
+	Path     string          `json:"path"`
+	Key      string          `json:"idempotency_key"` // 再送でも同じキーを送り、サーバー側で重複を除く
+	Body     json.RawMessage `json:"body"`
+	QueuedAt string          `json:"queued_at"`
+}
+
+// spool type: 送信できなかったリクエストのディスク上のキュー（ファイル名の順 = 送信順）
+type spool struct {
+	dir      string
+	maxBytes int64
+
+	// 再送のバックオフ（メモリ上のみ。再起動後はすぐに再送を試みる）
+	interval  time.Duration
+	nextRetry time.Time
+}
+
+// newSpool function: spool ディレクトリと容量の上限からキューを作成
+func newSpool(dir string, maxBytes int64) *spool {
+	return &spool{dir: dir, maxBytes: maxBytes}
+}
+
+// files function: キューのファイルを古い順に返す
+func (s *spool) files() ([]os.DirEntry, error) {
+	entries, err := os.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("spool を読み込めません: %v", err)
+	}
+	var files []os.DirEntry
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			files = append(files, e)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	return files, nil
+}
+
+// enqueue function: リクエストを末尾に追加（容量の上限を超える場合は古いものから破棄する）
+func (s *spool) enqueue(path, key string, body []byte) error {
+	data, err := json.Marshal(spoolEntry{Path: path, Key: key, Body: body, QueuedAt: time.Now().UTC().Format(time.RFC3339)})
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) > s.maxBytes {
+		return fmt.Errorf("リクエストが spool の上限 (%d バイト) を超えるため保存できません", s.maxBytes)
+	}
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return fmt.Errorf("spool を作成できません: %v", err)
+	}
+
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+	sizes := make([]int64, len(files))
+	total := int64(len(data))
+	for i, f := range files {
+		if info, err := f.Info(); err == nil {
+			sizes[i] = info.Size()
+			total += sizes[i]
+		}
+	}
+	dropped := 0
+	for i := 0; total > s.maxBytes && i < len(files); i++ {
+		if err := os.Remove(filepath.Join(s.dir, files[i].Name())); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("spool の古いリクエストを削除できません: %v", err)
+		}
+		total -= sizes[i]
+		dropped++
+	}
+	if dropped > 0 {
+		log.Printf("⚠️ [spool] 容量の上限 (%d バイト) を超えたため、古いリクエストを %d 件破棄しました", s.maxBytes, dropped)
+	}
+
+	name := fmt.Sprintf("%s-%06d.json", time.Now().UTC().Format("20060102T150405.000000000"), spoolSeq.Add(1)%1000000)
+	tmp := filepath.Join(s.dir, name+".tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("spool に保存できません: %v", err)
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, name))
+}
+
+// backoff function: 再送に失敗したので次の再送までの間隔を延ばす
+func (s *spool) backoff() {
+	if s.interval == 0 {
+		s.interval = retryInitialInterval
+	} else if s.interval *= 2; s.interval > retryMaxInterval {
+		s.interval = retryMaxInterval
+	}
+	s.nextRetry = time.Now().Add(s.interval)
+}
+
+// reset function: 送信に成功したのでバックオフを戻す
+func (s *spool) reset() {
+	s.interval = 0
+	s.nextRetry = time.Time{}
+}
+
+// waiting function: バックオフ中（まだ再送しない）か
+func (s *spool) waiting() bool {
+	return time.Now().Before(s.nextRetry)
+}
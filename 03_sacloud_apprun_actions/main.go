@@ -3,9 +3,11 @@ package main
 import (
 	"database/sql"
 	"fmt"
+	"html"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/ippanpeople/sample-go/backend"
 	_ "github.com/mattn/go-sqlite3"
@@ -27,22 +29,31 @@ func main() {
     }
     defer globalDB.Close()
 
-    _, err = globalDB.Exec(`CREATE TABLE IF NOT EXISTS device (
-        mac_address VARCHAR(50) PRIMARY KEY,
-        ip_address VARCHAR(50),
-        vendor VARCHAR(50),
-        is_dangerous BOOLEAN DEFAULT FALSE
-    )`)
-    if err != nil {
-        log.Fatal(err)
+    // migrate サブコマンド: スキーマの適用状況の確認・適用のみ行って終了
+    if len(os.Args) > 1 && os.Args[1] == "migrate" {
+        if err := backend.RunMigrateCommand(globalDB, os.Args[2:], os.Stdout); err != nil {
+            log.Fatal(err)
+        }
+        return
     }
 
-    // 既存テーブルにis_dangerousカラムが存在しない場合は追加
-    _, err = globalDB.Exec(`ALTER TABLE device ADD COLUMN is_dangerous BOOLEAN DEFAULT FALSE`)
+    // oui サブコマンド: IEEE の oui.csv の取り込み・ベンダーの確認
+    if len(os.Args) > 1 && os.Args[1] == "oui" {
+        if _, err := backend.Migrate(globalDB); err != nil {
+            log.Fatal(err)
+        }
+        if err := backend.RunOUICommand(globalDB, os.Args[2:], os.Stdout); err != nil {
+            log.Fatal(err)
+        }
+        return
+    }
+
+    // 起動時に未適用のマイグレーションを適用
+    applied, err := backend.Migrate(globalDB)
     if err != nil {
-        // カラムが既に存在する場合はエラーを無視
-        log.Printf("Column is_dangerous might already exist: %v", err)
+        log.Fatal(err)
     }
+    log.Printf("Schema migrations applied: %d", applied)
 
     backend.SetDatabase(globalDB)
 
@@ -179,6 +190,79 @@ func main() {
             background: #f8d7da; 
             color: #721c24; 
         }
+        .device-badge { 
+            display: inline-block; 
+            margin-left: 8px; 
+            padding: 2px 8px; 
+            border-radius: 10px; 
+            font-size: 0.75rem; 
+            font-weight: normal; 
+            vertical-align: middle; 
+        }
+        .badge-new { 
+            background: #cce5ff; 
+            color: #004085; 
+        }
+        .badge-stale { 
+            background: #e2e3e5; 
+            color: #383d41; 
+        }
+        .badge-unknown { 
+            background: #fff3cd; 
+            color: #856404; 
+        }
+        .danger-reason { 
+            margin-top: 8px; 
+            padding: 8px 12px; 
+            border-left: 4px solid #f5c6cb; 
+            background: #fdf2f3; 
+            font-size: 0.85rem; 
+            color: #721c24; 
+        }
+        .danger-reason.severity-high, .danger-reason.severity-critical { 
+            border-left-color: #dc3545; 
+        }
+        .incidents-table { 
+            width: 100%; 
+            border-collapse: collapse; 
+            font-size: 0.9rem; 
+        }
+        .incidents-table th, .incidents-table td { 
+            border-bottom: 1px solid #e1e8ed; 
+            padding: 8px; 
+            text-align: left; 
+            vertical-align: top; 
+        }
+        .incidents-table th { 
+            color: #666; 
+            font-weight: normal; 
+        }
+        .incident-metrics { 
+            font-size: 0.85rem; 
+            color: #666; 
+            margin-bottom: 8px; 
+        }
+        .device-tag { 
+            display: inline-block; 
+            background: #e1e8ed; 
+            color: #444; 
+            border-radius: 10px; 
+            padding: 1px 8px; 
+            margin: 2px 4px 0 0; 
+            font-size: 0.75rem; 
+        }
+        .device-notes { 
+            font-size: 0.8rem; 
+            color: #666; 
+            white-space: pre-wrap; 
+            margin-top: 4px; 
+        }
+        .evidence { 
+            margin: 4px 0 0 0; 
+            font-size: 0.75rem; 
+            white-space: pre-wrap; 
+            word-break: break-all; 
+        }
         </style>
         <script>
         // 60秒ごとにページを自動更新（機器からの送信が1分間隔のため）
@@ -217,15 +301,17 @@ func main() {
         fmt.Fprintln(w, `<div class='subtitle'>リアルタイム機器検出・脅威分析ダッシュボード</div>`)
         fmt.Fprintln(w, `</div>`)
         
-        // デバイス統計の取得
-        var totalDevices, dangerousDevices int
-        globalDB.QueryRow("SELECT COUNT(*) FROM device").Scan(&totalDevices)
-        globalDB.QueryRow("SELECT COUNT(*) FROM device WHERE is_dangerous = TRUE").Scan(&dangerousDevices)
+        // デバイス統計の取得（/api/v1/devices の summary と同じ集計）
+        totalDevices := backend.CountDevices()
+        dangerousDevices := backend.CountDangerousDevices()
         
         fmt.Fprintln(w, `<div class='status-bar'>`)
         fmt.Fprintln(w, `<div class='status-item'><span class='status-label'>監視状態</span><span class='status-value'>🟢 アクティブ</span></div>`)
         fmt.Fprintf(w, `<div class='status-item'><span class='status-label'>検出機器数</span><span class='status-value'>%d台</span></div>`, totalDevices)
         fmt.Fprintf(w, `<div class='status-item'><span class='status-label'>危険機器数</span><span class='status-value'>%d台</span></div>`, dangerousDevices)
+        fmt.Fprintf(w, `<div class='status-item'><span class='status-label'>未登録</span><span class='status-value'>%d台</span></div>`, backend.CountUnknownDevices())
+        fmt.Fprintf(w, `<div class='status-item'><span class='status-label'>新規機器数(24h)</span><span class='status-value'>%d台</span></div>`, backend.CountNewDevices())
+        fmt.Fprintf(w, `<div class='status-item'><span class='status-label'>%d日以上未検出</span><span class='status-value'>%d台</span></div>`, backend.StaleDays(), backend.CountStaleDevices())
         fmt.Fprintf(w, `<div class='status-item'><span class='status-label'>最終更新</span><span class='status-value' id='last-update'>更新中...</span></div>`)
         fmt.Fprintln(w, `</div>`)
         
@@ -242,20 +328,72 @@ func main() {
             fmt.Fprintln(w, `</div>`)
         }
         
+        // 未解決のインシデント
+        fmt.Fprintln(w, `<div class='devices-section'>`)
+        fmt.Fprintln(w, `<h2 class='section-title'>🚨 インシデント</h2>`)
+        if metrics, err := backend.ComputeIncidentMetrics(30 * 24 * time.Hour); err == nil {
+            fmt.Fprintf(w, `<div class='incident-metrics'>直近30日: %d件（未解決 %d件） / 確認までの平均 %s / 解決までの平均 %s</div>`,
+                metrics.Total, metrics.Unresolved, backend.FormatDuration(metrics.MeanTimeToAck), backend.FormatDuration(metrics.MeanTimeToResolve))
+        }
+        incidents, err := backend.UnresolvedIncidents()
+        if err != nil {
+            fmt.Fprintf(w, `<div class='incident-metrics'>❌ インシデントの取得に失敗しました: %s</div>`, html.EscapeString(err.Error()))
+        } else if len(incidents) == 0 {
+            fmt.Fprintln(w, `<div class='incident-metrics'>未解決のインシデントはありません</div>`)
+        } else {
+            fmt.Fprintln(w, `<table class='incidents-table'><tr><th>#</th><th>状態</th><th>危険度</th><th>機器</th><th>内容</th><th>発生</th><th>ヒット</th></tr>`)
+            for _, incident := range incidents {
+                statusText := "🔴 未対応"
+                if incident.Status == backend.IncidentAcknowledged {
+                    statusText = "🟡 確認済み (" + html.EscapeString(incident.AcknowledgedBy) + ")"
+                }
+                fmt.Fprintf(w, `<tr><td>%d</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%d回</td></tr>`,
+                    incident.ID, statusText, incident.Severity, incident.MACAddress, html.EscapeString(incident.Summary),
+                    backend.FormatTimestamp(incident.OpenedAt), incident.HitCount)
+            }
+            fmt.Fprintln(w, `</table>`)
+        }
+        fmt.Fprintln(w, `</div>`)
+        
         fmt.Fprintln(w, `<div class='devices-section'>`)
         fmt.Fprintln(w, `<h2 class='section-title'>🖥️ 検出機器一覧</h2>`)
         fmt.Fprintln(w, `<div class='devices-grid'>`)
         
-        rows, err := globalDB.Query("SELECT mac_address, ip_address, vendor, is_dangerous FROM device ORDER BY is_dangerous DESC, mac_address")
+        // 危険判定の理由・危険度・証跡
+        dangersByMAC, err := backend.ActiveDangers()
+        if err != nil {
+            log.Printf("危険判定の取得に失敗: %v", err)
+        }
+        
+        // 名前・所有者・設置場所・タグなどの注釈
+        annotationsByMAC, err := backend.DeviceAnnotations()
+        if err != nil {
+            log.Printf("注釈の取得に失敗: %v", err)
+        }
+        
+        // 現在のIPアドレス（IPv4 の別名・IPv6 を含む）
+        addressesByMAC, err := backend.CurrentDeviceAddresses()
+        if err != nil {
+            log.Printf("アドレスの取得に失敗: %v", err)
+        }
+        
+        // オペレーターによる手動判定（危険・信頼済み）
+        overridesByMAC, err := backend.ActiveOverrides()
+        if err != nil {
+            log.Printf("手動判定の取得に失敗: %v", err)
+        }
+        
+        rows, err := globalDB.Query("SELECT mac_address, ip_address, vendor, COALESCE(hostname, ''), is_dangerous, COALESCE(is_unknown, FALSE), COALESCE(oui_vendor, ''), COALESCE(is_randomized, FALSE), COALESCE(vendor_mismatch, FALSE), COALESCE(first_seen, ''), COALESCE(last_seen, ''), COALESCE(seen_count, 0) FROM device ORDER BY is_dangerous DESC, mac_address")
         if err != nil {
             fmt.Fprintf(w, "<div class='device-card'><div class='device-info'><h3>❌ エラー</h3><div class='device-details'>%s</div></div></div>", err.Error())
         } else {
             defer rows.Close()
             deviceCount := 0
             for rows.Next() {
-                var macAddress, ipAddress, vendor string
-                var isDangerous bool
-                rows.Scan(&macAddress, &ipAddress, &vendor, &isDangerous)
+                var macAddress, ipAddress, vendor, hostname, ouiVendor, firstSeen, lastSeen string
+                var isDangerous, isUnknown, isRandomized, vendorMismatch bool
+                var seenCount int
+                rows.Scan(&macAddress, &ipAddress, &vendor, &hostname, &isDangerous, &isUnknown, &ouiVendor, &isRandomized, &vendorMismatch, &firstSeen, &lastSeen, &seenCount)
                 deviceCount++
                 
                 // ステータス判定
@@ -268,13 +406,103 @@ func main() {
                 }
                 
                 // ベンダー情報の表示調整
-                vendorDisplay := vendor
-                if vendor == "" {
+                vendorDisplay := html.EscapeString(vendor)
+                if vendor == "" || vendor == "Unknown" {
                     vendorDisplay = "不明"
                 }
+                if vendorMismatch {
+                    vendorDisplay += "（OUI: " + html.EscapeString(ouiVendor) + "）"
+                }
+                
+                // IPアドレス（複数ある場合はすべて表示し、IPv6 のリンクローカルなどは範囲を添える）
+                ipDisplay := html.EscapeString(ipAddress)
+                if addresses := addressesByMAC[macAddress]; len(addresses) > 0 {
+                    ipDisplay = ""
+                    for i, address := range addresses {
+                        if i > 0 {
+                            ipDisplay += ", "
+                        }
+                        ipDisplay += html.EscapeString(address.IPAddress)
+                        if address.Scope == "link-local" {
+                            ipDisplay += "<small>（リンクローカル）</small>"
+                        }
+                    }
+                }
+                
+                // 新規・長期未検出のバッジ
+                badges := ""
+                if backend.IsNewDevice(firstSeen) {
+                    badges += `<span class='device-badge badge-new'>🆕 新規</span>`
+                }
+                if backend.IsStaleDevice(lastSeen) {
+                    badges += `<span class='device-badge badge-stale'>💤 長期未検出</span>`
+                }
+                if isUnknown {
+                    badges += `<span class='device-badge badge-unknown'>❓ 未登録</span>`
+                }
+                if isRandomized {
+                    badges += `<span class='device-badge badge-stale'>🔀 ランダムMAC</span>`
+                }
+                if vendorMismatch {
+                    badges += `<span class='device-badge badge-unknown'>⚠️ ベンダー不一致</span>`
+                }
+                if override, ok := overridesByMAC[macAddress]; ok {
+                    label := "🔒 手動: 信頼済み"
+                    if override.Mode == backend.OverrideDangerous {
+                        label = "🛑 手動: 危険"
+                    }
+                    badges += fmt.Sprintf(`<span class='device-badge badge-unknown' title='%s'>%s (%s)</span>`,
+                        html.EscapeString(override.Reason), label, html.EscapeString(override.Operator))
+                }
                 
                 fmt.Fprintln(w, `<div class='device-card'>`)
-                fmt.Fprintf(w, `<div class='device-info'><h3>🖥️ 機器 #%d</h3><div class='device-details'>IP: %s<br>MAC: %s<br>ベンダー: %s</div></div>`, deviceCount, ipAddress, macAddress, vendorDisplay)
+                // 危険と判定された理由（発生元ごと）
+                reasonDisplay := ""
+                for _, danger := range dangersByMAC[macAddress] {
+                    reasonDisplay += fmt.Sprintf(`<div class='danger-reason severity-%s'>⚠️ [%s] %s<br><small>発生元: %s / 検知: %s から（%d回, 最終: %s）</small>`,
+                        danger.Severity, danger.Severity, html.EscapeString(danger.Reason), danger.Source,
+                        backend.FormatTimestamp(danger.FlaggedAt), danger.HitCount, backend.FormatTimestamp(danger.LastHitAt))
+                    if len(danger.Evidence) > 0 {
+                        reasonDisplay += `<details><summary>証跡</summary><pre class='evidence'>`
+                        for _, line := range danger.Evidence {
+                            reasonDisplay += html.EscapeString(line) + "\n"
+                        }
+                        reasonDisplay += `</pre></details>`
+                    }
+                    reasonDisplay += `</div>`
+                }
+                
+                // 注釈（名前が登録されていれば並び順の番号の代わりに表示）。なければDHCPリースなどから得たホスト名を表示
+                title := fmt.Sprintf("機器 #%d", deviceCount)
+                if hostname != "" {
+                    title = html.EscapeString(hostname)
+                }
+                annotationDisplay := ""
+                if annotation, ok := annotationsByMAC[macAddress]; ok {
+                    if annotation.Name != "" {
+                        title = html.EscapeString(annotation.Name)
+                        if hostname != "" {
+                            annotationDisplay += "<br>ホスト名: " + html.EscapeString(hostname)
+                        }
+                    }
+                    if annotation.Owner != "" {
+                        annotationDisplay += "<br>所有者: " + html.EscapeString(annotation.Owner)
+                    }
+                    if annotation.Location != "" {
+                        annotationDisplay += "<br>設置場所: " + html.EscapeString(annotation.Location)
+                    }
+                    if len(annotation.Tags) > 0 {
+                        annotationDisplay += "<br>"
+                        for _, tag := range annotation.Tags {
+                            annotationDisplay += `<span class='device-tag'>` + html.EscapeString(tag) + `</span>`
+                        }
+                    }
+                    if annotation.Notes != "" {
+                        annotationDisplay += `<div class='device-notes'>📝 ` + html.EscapeString(annotation.Notes) + `</div>`
+                    }
+                }
+                
+                fmt.Fprintf(w, `<div class='device-info'><h3>🖥️ %s%s</h3><div class='device-details'>IP: %s<br>MAC: %s<br>ベンダー: %s<br>初回検出: %s / 最終検出: %s（%d回）%s</div>%s</div>`, title, badges, ipDisplay, macAddress, vendorDisplay, backend.FormatTimestamp(firstSeen), backend.FormatTimestamp(lastSeen), seenCount, annotationDisplay, reasonDisplay)
                 fmt.Fprintf(w, `<div class='device-status %s'>%s</div>`, statusClass, statusText)
                 fmt.Fprintln(w, `</div>`)
             }